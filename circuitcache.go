@@ -0,0 +1,53 @@
+package fuzzycrypto
+
+import (
+    "sync"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+//
+// The Fractional circuits, built once per gamma and shared by every Flag and
+// Test after that. Garbling and evaluating only read a circuit, so once built
+// it is never touched again and any number of goroutines can use it at once.
+type CircuitCache struct {
+    mu          sync.Mutex
+    circuits    map[int]*cachedCircuit
+}
+
+type cachedCircuit struct {
+    once        sync.Once
+    circuit     *toygarble.Circuit
+    err         error
+}
+
+// Used by every Fractional that doesn't bring its own cache
+var defaultCircuits = NewCircuitCache()
+
+func NewCircuitCache() *CircuitCache {
+    return &CircuitCache{circuits: make(map[int]*cachedCircuit)}
+}
+
+//
+// The circuit for gamma, building it if this is the first time it is asked for.
+// Callers must not modify it.
+func (c *CircuitCache) Get(gamma int) (*toygarble.Circuit, error) {
+    // nothing is cached for a gamma there is no circuit for, or a stream of
+    // bad keys could grow the cache without bound
+    if err := checkGammaFR(gamma); err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    entry, ok := c.circuits[gamma]
+    if !ok {
+        entry = new(cachedCircuit)
+        c.circuits[gamma] = entry
+    }
+    c.mu.Unlock()
+
+    // the lock isn't held while building, a slow gamma doesn't hold up the others
+    entry.once.Do(func() {
+        entry.circuit, entry.err = loadCircuit(gamma)
+    })
+    return entry.circuit, entry.err
+}
@@ -4,7 +4,6 @@ import (
     "bytes"
     "fmt"
     "math/big"
-    "crypto/elliptic"
     "io"
     "encoding/json"
     //"golang.org/x/crypto/blake2b"
@@ -19,241 +18,436 @@ import (
 
 
 type ElGamalPower2 struct {
+    // Emit and accept flags as JSON instead of the compact binary encoding.
+    // Only meant for debugging, the JSON form is several times larger.
+    DebugJSON   bool
+    // How Test, TestBatch and PreparedFlag.Test go through the subkeys
+    Mode        TestMode
+}
+
+//
+// Test can either stop as soon as the answer is known or always do the same work.
+type TestMode int
+
+const (
+    // Stop at the first bit that decrypts to 0. Most flags are rejected after one
+    // or two scalar multiplications, but the running time tells an observer how
+    // far the flag got.
+    TestFast        TestMode = 0
+    // Decrypt every bit and combine the bits without branching, so this package
+    // does the same work whatever the flag and whether it matches. That is all
+    // it promises: the group operations underneath are only constant time for
+    // Ristretto255(). The NIST groups are not, their Mult and point encoding go
+    // through big.Int in crypto/elliptic, as does checking the key's scalars.
+    TestConstantTime TestMode = 1
+)
+
+func (el *ElGamalPower2) mode() TestMode {
+    if el == nil {
+        return TestFast
+    }
+    return el.Mode
 }
 
 type Ciphertext struct {
-    U           GroupElement
+    U           Element
     BitVec      []byte
-    Y           *big.Int
+    Y           Scalar
+
+    // the group U and Y belong to, needed for the encodings
+    group       Group
+}
+
+func (el *ElGamalPower2) debugJSON() bool {
+    return el != nil && el.DebugJSON
 }
 
 // Generate a full keypair for an n-bit ciphertext
 //
-func (el *ElGamalPower2) KeyGen(curve elliptic.Curve, numKeys int, rand io.Reader) (priv *SecKey, pub *PubKey) {
-    
+func (el *ElGamalPower2) KeyGen(group Group, numKeys int, rand io.Reader) (priv *SecKey, pub *PubKey, err error) {
+
+    // Can't build a ciphertext out of no bits
+    if numKeys < 1 {
+        return nil, nil, fmt.Errorf("%w: number of keys must be positive, got %d", ErrUnsupportedParameter, numKeys)
+    }
+
     // Allocate the structs for public and secret key
     pub = new(PubKey)
+    pub.scheme, pub.group, pub.gamma = SchemeElGamalPower2, group, numKeys
     pub.NumKeys = numKeys
-    pub.PubKeys = make([]*GroupElement, numKeys)
-    
+    pub.PubKeys = make([]Element, numKeys)
+
     priv = new(SecKey)
+    priv.scheme, priv.group, priv.gamma = SchemeElGamalPower2, group, numKeys
     priv.numKeys = numKeys
-    priv.secKeys = make([]*big.Int, numKeys)
+    priv.secKeys = make([]Scalar, numKeys)
     priv.prob = uint32(numKeys)
     // Now generate each individual public and secret key
     for i := 0; i < numKeys; i++ {
-        priv.secKeys[i], pub.PubKeys[i]  = keyGenSingle(curve, rand)
+        priv.secKeys[i], pub.PubKeys[i], err = keyGenSingle(group, rand)
+        if err != nil {
+            return nil, nil, err
+        }
     }
 
-    return     
+    return
 }
 
 //
 // Encrypt a ciphertext
-func (el *ElGamalPower2) Flag(curve elliptic.Curve, rand io.Reader, pk *PubKey) []byte {
+func (el *ElGamalPower2) Flag(group Group, rand io.Reader, pk *PubKey) ([]byte, error) {
 
-    var pkR GroupElement
-    var Z GroupElement
-    
-    // Allocate the ciphertext struct and the vector of bits
-    ctext := new(Ciphertext)
-    ctext.BitVec = make([]byte, (pk.NumKeys + 7) / 8)
-    
-    // First generate two random scalar values r, z
-    r := sampleRandomScalar(curve, rand)
-    z := sampleRandomScalar(curve, rand)
-    
-    // Compute u = r * P
-    ctext.U.X, ctext.U.Y = curve.ScalarBaseMult(r.Bytes())
-    
-    // Compute Z = z * P
-    Z.X, Z.Y = curve.ScalarBaseMult(z.Bytes())
+    ctext, err := el.TheoreticalFlag(group, rand, pk)
+    if err != nil {
+        return nil, err
+    }
 
-    // For each bit 1...NumKeys, encrypt "1" under the appropriate public key
-    for i := 0; i < pk.NumKeys; i++ {
-    
-        // Compute pkR = r * pk_i
-        pkR.X, pkR.Y = curve.ScalarMult(pk.PubKeys[i].X, pk.PubKeys[i].Y, r.Bytes())
-        
-        // Compute pad = H(pk_i || pkR || Z), truncated to 1 bit, then XOR with "1"
-        // (we obtain this as a uint8 to make life easier)
-        padChar := computeHashH(curve, &ctext.U, &pkR, &Z)
-        padChar ^= 0x01
-        
-        // Now pack this into the appropriate location in bitVec
-        ctext.BitVec[i / 8] |= padChar << (i % 8)
+    if el.debugJSON() {
+        return json.Marshal(ctext)
     }
-    
-    // Now hash the resulting ciphertext elements to obtain v = G(u, bitVec)
-    v := computeHashG(curve, ctext.U, ctext.BitVec)
-    
-    // Find a solution to "y" such that v*P + y*u = zP
-    // (since u = r*P, this means: v + yr = z mod N, or y = (z-v)/r mod N)
-    ctext.Y = new(big.Int)
-    ctext.Y.Sub(z, v)
-    ctext.Y.Mod(ctext.Y, curve.Params().N)
-    rInv := new(big.Int)
-    rInv.ModInverse(r, curve.Params().N)
-    ctext.Y.Mul(ctext.Y, rInv)
-    ctext.Y.Mod(ctext.Y, curve.Params().N)
-    
-    ctAsBytes, err := json.Marshal(*ctext)
-    check(err)
-    return ctAsBytes
+    return ctext.MarshalBinary()
 }
 
 
 //
 // Encrypt a ciphertext
-func (el *ElGamalPower2) TheoreticalFlag(curve elliptic.Curve, rand io.Reader, pk *PubKey) *Ciphertext {
+func (el *ElGamalPower2) TheoreticalFlag(group Group, rand io.Reader, pk *PubKey) (*Ciphertext, error) {
+
+    if err := validatePubKey(group, pk); err != nil {
+        return nil, err
+    }
 
-    var pkR GroupElement
-    var Z GroupElement
-    
     // Allocate the ciphertext struct and the vector of bits
     ctext := new(Ciphertext)
+    ctext.group = group
     ctext.BitVec = make([]byte, (pk.NumKeys + 7) / 8)
-    
+
     // First generate two random scalar values r, z
-    r := sampleRandomScalar(curve, rand)
-    z := sampleRandomScalar(curve, rand)
-    
+    r, err := sampleRandomScalar(group, rand)
+    if err != nil {
+        return nil, err
+    }
+    z, err := sampleRandomScalar(group, rand)
+    if err != nil {
+        return nil, err
+    }
+
     // Compute u = r * P
-    ctext.U.X, ctext.U.Y = curve.ScalarBaseMult(r.Bytes())
-    
+    ctext.U = group.BaseMult(r)
+
     // Compute Z = z * P
-    Z.X, Z.Y = curve.ScalarBaseMult(z.Bytes())
+    Z := group.BaseMult(z)
 
     // For each bit 1...NumKeys, encrypt "1" under the appropriate public key
     for i := 0; i < pk.NumKeys; i++ {
-    
+
         // Compute pkR = r * pk_i
-        pkR.X, pkR.Y = curve.ScalarMult(pk.PubKeys[i].X, pk.PubKeys[i].Y, r.Bytes())
-        
+        pkR := group.Mult(pk.PubKeys[i], r)
+
         // Compute pad = H(pk_i || pkR || Z), truncated to 1 bit, then XOR with "1"
         // (we obtain this as a uint8 to make life easier)
-        padChar := computeHashH(curve, &ctext.U, &pkR, &Z)
+        padChar := computeHashH(group, ctext.U, pkR, Z)
         padChar ^= 0x01
-        
+
         // Now pack this into the appropriate location in bitVec
         ctext.BitVec[i / 8] |= padChar << (i % 8)
     }
-    
+
     // Now hash the resulting ciphertext elements to obtain v = G(u, bitVec)
-    v := computeHashG(curve, ctext.U, ctext.BitVec)
-    
+    v := computeHashG(group, ctext.U, ctext.BitVec)
+
     // Find a solution to "y" such that v*P + y*u = zP
     // (since u = r*P, this means: v + yr = z mod N, or y = (z-v)/r mod N)
-    ctext.Y = new(big.Int)
-    ctext.Y.Sub(z, v)
-    ctext.Y.Mod(ctext.Y, curve.Params().N)
-    rInv := new(big.Int)
-    rInv.ModInverse(r, curve.Params().N)
-    ctext.Y.Mul(ctext.Y, rInv)
-    ctext.Y.Mod(ctext.Y, curve.Params().N)
-    
-    return ctext
+    ctext.Y = group.ScalarMul(group.ScalarSub(z, v), group.ScalarInvert(r))
+
+    return ctext, nil
 }
 
 //
 // Extract a dsk from a secret key. In practice this just involves making a copy of the
 // same structure, but it contains only a subset of the private keys.
-func (el *ElGamalPower2) Extract(numKeys int, priv *SecKey) (dsk *SecKey) {
-    
+// The rate must be exactly 2^-n for some n <= number of subkeys, anything else is
+// rejected with ErrProbabilityNotRepresentable.
+func (el *ElGamalPower2) Extract(p Probability, priv *SecKey) (dsk *SecKey, err error) {
+
+    if err = validateSecKey(nil, priv); err != nil {
+        return nil, err
+    }
+    if err = checkKeyKind(priv, SchemeElGamalPower2, keyKindSecret); err != nil {
+        return nil, err
+    }
+
+    // Find n such that p = 2^-n
+    numKeys := -1
+    for n := 0; n <= priv.numKeys && n < 64; n++ {
+        if k, err := p.scaleTo(n); err == nil && k == 1 {
+            numKeys = n
+            break
+        }
+    }
+
     // Make sure this number of keys makes sense
-    if (numKeys > priv.numKeys) {
-        return nil
+    if numKeys < 0 {
+        return nil, fmt.Errorf("%w: %v is not 2^-n for n <= %d", ErrProbabilityNotRepresentable, p, priv.numKeys)
     }
-    
+
     // Else, allocate a new empty SecKey structure
     dsk = new(SecKey)
+    dsk.scheme, dsk.group, dsk.gamma, dsk.detection = priv.scheme, priv.group, priv.gamma, true
     dsk.numKeys = numKeys
-    dsk.secKeys = make([]*big.Int, numKeys)
+    dsk.secKeys = make([]Scalar, numKeys)
     dsk.prob = uint32(numKeys)
     for i := 0; i < numKeys; i++ {
         dsk.secKeys[i] = priv.secKeys[i]
     }
-    
+
     return
 }
 
 //
-// Test a ciphertext given a dsk, and return true/false.
-// Note that if the number of subkeys in dsk is 0, this will always return "true".
-func (el *ElGamalPower2) Test(curve elliptic.Curve, ctBytes []byte, priv *SecKey) bool {
+// The debug JSON form of a flag: the group's canonical encodings of U and Y
+// (base64, like BitVec), plus the group's name so a flag can't be tested in the
+// wrong group by accident.
+type ciphertextJSON struct {
+    Group       string
+    U           []byte
+    BitVec      []byte
+    Y           []byte
+}
+
+func (ct *Ciphertext) MarshalJSON() ([]byte, error) {
+    if ct.group == nil || ct.U == nil || ct.Y == nil {
+        return nil, fmt.Errorf("incomplete ciphertext")
+    }
+    return json.Marshal(ciphertextJSON{
+        Group:  ct.group.Name(),
+        U:      ct.group.Encode(ct.U),
+        BitVec: ct.BitVec,
+        Y:      ct.group.EncodeScalar(ct.Y),
+    })
+}
+
+//
+// Decode a flag and make sure it is well formed: all fields present, U a valid
+// element and Y a reduced scalar of group.
+func (el *ElGamalPower2) decodeCiphertext(group Group, ctBytes []byte) (*Ciphertext, error) {
+    var ctext Ciphertext
+
+    if !el.debugJSON() {
+        if err := ctext.UnmarshalBinary(ctBytes); err != nil {
+            return nil, err
+        }
+        if ctext.group.ID() != group.ID() {
+            return nil, fmt.Errorf("%w: flag is for group %s", ErrMalformedFlag, ctext.group.Name())
+        }
+        return &ctext, nil
+    }
+
+    var raw ciphertextJSON
+    dec := json.NewDecoder(bytes.NewReader(ctBytes))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&raw); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
+    if raw.U == nil || raw.Y == nil || raw.BitVec == nil {
+        return nil, fmt.Errorf("%w: missing ciphertext component", ErrMalformedFlag)
+    }
+    if raw.Group != group.Name() {
+        return nil, fmt.Errorf("%w: flag is for group %q", ErrMalformedFlag, raw.Group)
+    }
+    U, err := group.Decode(raw.U)
+    if err != nil {
+        return nil, fmt.Errorf("%w: U: %v", ErrMalformedFlag, err)
+    }
+    Y, err := group.DecodeScalar(raw.Y)
+    if err != nil {
+        return nil, fmt.Errorf("%w: Y: %v", ErrMalformedFlag, err)
+    }
+    ctext.U, ctext.Y, ctext.BitVec, ctext.group = U, Y, raw.BitVec, group
+
+    return &ctext, nil
+}
+
+//
+// A flag that has already been decoded and had its Z = vP + yU computed, so it
+// can be tested against many detection keys without redoing that work.
+type PreparedFlag struct {
+    ctext       *Ciphertext
+    Z           Element
+    mode        TestMode
+}
+
+//
+// Decode a flag and compute everything that doesn't depend on the detection key
+func (el *ElGamalPower2) PrepareFlag(group Group, ctBytes []byte) (*PreparedFlag, error) {
+    if el.mode() != TestFast && el.mode() != TestConstantTime {
+        return nil, fmt.Errorf("%w: unknown test mode %d", ErrUnsupportedParameter, el.mode())
+    }
+
     // transform this into actual ciphertext
-    var ctext Ciphertext 
-    
-    err := json.Unmarshal(ctBytes, &ctext)
-    check(err)
+    ctext, err := el.decodeCiphertext(group, ctBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    pf := &PreparedFlag{ctext: ctext, mode: el.mode()}
 
-    var Z GroupElement
-    var temp GroupElement
-    var pkR GroupElement
-    
-    // The default output of this function is "true". If the dsk
-    // has zero subkeys, then it will always return true.
-    result := true
-    
     // Hash the ciphertext elements to obtain v = G(u, bitVec)
-    v := computeHashG(curve, ctext.U, ctext.BitVec)
-    
+    v := computeHashG(group, ctext.U, ctext.BitVec)
+
     // Compute Z = vP + yU
-    Z.X, Z.Y = curve.ScalarBaseMult(v.Bytes())
-    temp.X, temp.Y = curve.ScalarMult(ctext.U.X, ctext.U.Y, ctext.Y.Bytes())
-    Z.X, Z.Y = curve.Add(Z.X, Z.Y, temp.X, temp.Y)
-    
+    pf.Z = group.Add(group.BaseMult(v), group.Mult(ctext.U, ctext.Y))
+
+    return pf, nil
+}
+
+//
+// Test a prepared flag against one dsk, in the mode of the scheme that prepared it
+func (pf *PreparedFlag) Test(priv *SecKey) (bool, error) {
+    if err := validateSecKey(pf.ctext.group, priv); err != nil {
+        return false, err
+    }
+    if err := checkKeyKind(priv, SchemeElGamalPower2, 0); err != nil {
+        return false, err
+    }
+    if len(pf.ctext.BitVec) * 8 < priv.numKeys {
+        return false, fmt.Errorf("%w: %d bit ciphertext can't be tested with %d subkeys", ErrMalformedFlag, len(pf.ctext.BitVec) * 8, priv.numKeys)
+    }
+
+    if pf.mode == TestConstantTime {
+        return pf.testConstantTime(priv), nil
+    }
+    return pf.testFast(priv), nil
+}
+
+func (pf *PreparedFlag) testFast(priv *SecKey) bool {
+    ctext := pf.ctext
+    group := ctext.group
+
     // For each subkey 1...numKeys in the secret key, decrypt that bit
     for i := 0; i < priv.numKeys; i++ {
-    
+
         // Compute pkR = u^{sk_i}
-        pkR.X, pkR.Y = curve.ScalarMult(ctext.U.X, ctext.U.Y, priv.secKeys[i].Bytes())
-        
+        pkR := group.Mult(ctext.U, priv.secKeys[i])
+
         // Compute pad = H(pk_i || pkR || Z) XOR the i^th bit of ctext.BitVec
-        padChar := computeHashH(curve, &ctext.U, &pkR, &Z)
+        padChar := computeHashH(group, ctext.U, pkR, pf.Z)
         padChar ^= ((ctext.BitVec[i / 8] >> (i % 8))) & 0x01
-        
-        // All bits must be 1. If any result is 0, the overall output
-        // of this function should be false.
+
+        // All bits must be 1. If any result is 0 we already know the answer.
         if padChar == 0 {
-            result = false
+            return false
         }
     }
-    
-    return result
+
+    // If the dsk has zero subkeys, then it will always return true.
+    return true
 }
 
-func (el *ElGamalPower2) JsonifySK(sk *SecKey) []byte{
-    var write_buff bytes.Buffer;
-    
-    for i := range sk.secKeys {
-        _, err := fmt.Fprintf(&write_buff, "%d\n",sk.secKeys[i]);
+func (pf *PreparedFlag) testConstantTime(priv *SecKey) bool {
+    ctext := pf.ctext
+    group := ctext.group
+
+    // AND of all the decrypted bits, starting from "true"
+    acc := uint8(1)
+
+    // all that's left to do here is not to stop early, how long each Mult
+    // takes is up to the group
+    for i := 0; i < priv.numKeys; i++ {
+        pkR := group.Mult(ctext.U, priv.secKeys[i])
+
+        padChar := computeHashH(group, ctext.U, pkR, pf.Z)
+        padChar ^= ((ctext.BitVec[i / 8] >> (i % 8))) & 0x01
+        acc &= padChar
+    }
+
+    return acc == 1
+}
+
+//
+// Test a ciphertext given a dsk, and return true/false.
+// Note that if the number of subkeys in dsk is 0, this will always return "true".
+func (el *ElGamalPower2) Test(group Group, ctBytes []byte, priv *SecKey) (bool, error) {
+    if err := validateSecKey(group, priv); err != nil {
+        return false, err
+    }
+    if err := checkKeyKind(priv, SchemeElGamalPower2, 0); err != nil {
+        return false, err
+    }
+
+    pf, err := el.PrepareFlag(group, ctBytes)
+    if err != nil {
+        return false, err
+    }
+    return pf.Test(priv)
+}
+
+//
+// Test one flag against a whole list of detection keys, e.g. every key a server holds.
+// The flag is decoded and Z computed only once, then each key is tested in the
+// scheme's Mode. result[i] is the outcome for keys[i].
+func (el *ElGamalPower2) TestBatch(group Group, ctBytes []byte, keys []*SecKey) ([]bool, error) {
+    for i := range keys {
+        if err := validateSecKey(group, keys[i]); err != nil {
+            return nil, fmt.Errorf("detection key %d: %w", i, err)
+        }
+        if err := checkKeyKind(keys[i], SchemeElGamalPower2, 0); err != nil {
+            return nil, fmt.Errorf("detection key %d: %w", i, err)
+        }
+    }
+
+    pf, err := el.PrepareFlag(group, ctBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    results := make([]bool, len(keys))
+    for i := range keys {
+        results[i], err = pf.Test(keys[i])
         if err != nil {
-            panic(err);
+            return nil, fmt.Errorf("detection key %d: %w", i, err)
         }
     }
+    return results, nil
+}
 
-    return write_buff.Bytes()
+//
+// Serialize a secret or detection key as a PEM block (see SecKey.MarshalText)
+func (el *ElGamalPower2) JsonifySK(sk *SecKey) ([]byte, error) {
+    if err := validateSecKey(nil, sk); err != nil {
+        return nil, err
+    }
+    if sk.scheme != SchemeElGamalPower2 {
+        return nil, fmt.Errorf("%w: not an ElGamalPower2 key", ErrInvalidKey)
+    }
+    return sk.MarshalText()
 }
 
-func (el *ElGamalPower2) MarshalSK(fname string) *SecKey {
-    returnKey := new(SecKey);
-    returnKey.secKeys = make([]*big.Int, 0, 0)
-    bytestream, err := os.Open(fname)
+//
+// Read a key written by JsonifySK. Files in the old format (one decimal subkey
+// per line, no metadata) are still accepted; they predate the other groups, so
+// they are read as P256() keys.
+func (el *ElGamalPower2) MarshalSK(fname string) (*SecKey, error) {
+    contents, err := os.ReadFile(fname)
     if err != nil {
-        return nil
+        return nil, err
+    }
+    if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("-----BEGIN")) {
+        return readSKFile(fname, SchemeElGamalPower2)
     }
+
+    returnKey := new(SecKey);
+    returnKey.secKeys = make([]Scalar, 0, 0)
+    bytestream := bytes.NewReader(contents)
     exp := big.NewInt(0);
     numKeys := 0;
     _, err = fmt.Fscanln(bytestream, exp)
-    for err != io.EOF && err != io.ErrUnexpectedEOF { 
-        if err == io.EOF {
-            fmt.Printf("This is an end of file, quitting")
-            break
-        }
+    for err != io.EOF && err != io.ErrUnexpectedEOF {
         if err != nil {
-            fmt.Printf("Couldn't read into %v", exp)
-            panic(err)
+            return nil, fmt.Errorf("%w: subkey %d of %s: %v", ErrInvalidKey, numKeys, fname, err)
+        }
+        if !validScalar(P256(), exp) {
+            return nil, fmt.Errorf("%w: subkey %d of %s is not a P-256 scalar", ErrInvalidKey, numKeys, fname)
         }
         returnKey.secKeys = append(returnKey.secKeys, exp);
         exp = big.NewInt(0);
@@ -261,22 +455,21 @@ func (el *ElGamalPower2) MarshalSK(fname string) *SecKey {
         _, err = fmt.Fscanln(bytestream, exp)
     }
     returnKey.numKeys = numKeys;
-    return returnKey
+    returnKey.prob = uint32(numKeys)
+    returnKey.scheme, returnKey.group, returnKey.gamma = SchemeElGamalPower2, P256(), numKeys
+    return returnKey, nil
 }
 
 //
 // Compute the hash function H(A, B, C) where A, B, C are group elements
-func computeHashH(curve elliptic.Curve, one *GroupElement, two *GroupElement, three *GroupElement) uint8 {
+func computeHashH(group Group, one Element, two Element, three Element) uint8 {
     
-    // Turn the group elements into byte arrays and concatenate them as ("HashH" || one || two)
+    // Turn the group elements into byte arrays and concatenate them as ("HashH" || one || two || three)
     serialized := []byte("HashH")
-    serialized = append(serialized, elliptic.Marshal(curve, &(*one.X), &(*one.Y))...)
-    serialized = append(serialized, elliptic.Marshal(curve, &(*two.X), &(*two.Y))...)
-    serialized = append(serialized, elliptic.Marshal(curve, &(*three.X), &(*three.Y))...)
+    serialized = append(serialized, group.Encode(one)...)
+    serialized = append(serialized, group.Encode(two)...)
+    serialized = append(serialized, group.Encode(three)...)
 
-    //s, _ := json.MarshalIndent(serialized, "", "\t");
-    //fmt.Println(string(s))
-    
     // Compute SHA256(serialized)
     h := sha256.Sum256(serialized)
     
@@ -286,50 +479,15 @@ func computeHashH(curve elliptic.Curve, one *GroupElement, two *GroupElement, th
 
 //
 // Compute the hash function G(u, bitVec) u is a group element and bitVec is a byte slice.
-// Return an integer in the range [0...group order - 1]
-func computeHashG(curve elliptic.Curve, u GroupElement, bitVec []byte) (result *big.Int) {
-    
-    N := curve.Params().N
-    bitSize := N.BitLen()
-    
-    // Turn the values into byte arrays and concatenate them as ("HashG" || u || bitVec)
-    serialized := []byte("HashG")
-    serialized = append(serialized, elliptic.Marshal(curve, &(*u.X), &(*u.Y))...)
-    serialized = append(serialized, bitVec...)
-    
-    // Allocate a buffer at least 64 bits too long
-    bitSize += 64
-    bitsHashed := 0
-    h := make([]byte, 0)
- 
-    // Now repeatedly hash until we've filled the buffer
-    for (bitsHashed < bitSize) {
-
-        // Hash the serialized value and append to "h"
-        hash := sha256.Sum256(serialized)
-        h = append(h, hash[:32]...)
-        bitsHashed = len(h) / 8
-        
-        // Concatenate an "X" onto the end of serialized each time through this loop
-        // This ensures that serialized is different each time we hash it
-        if (bitsHashed < bitSize) {
-            serialized = append(serialized, []byte("X")...)
-        }
-    }
-    
-    // Now cast the resulting byte array into a Big.int
-    // and compute result % group order
-    result = new(big.Int)
-    result.SetBytes(h)
-    result.Mod(result, curve.Params().N)
-    
-    return
+// Return a scalar in the range [0...group order - 1]
+func computeHashG(group Group, u Element, bitVec []byte) Scalar {
+    return group.HashToScalar([]byte("HashG"), group.Encode(u), bitVec)
 }
 
-func efficientSerializeMeasure(curve elliptic.Curve, ct *Ciphertext) int {
+func efficientSerializeMeasure(group Group, ct *Ciphertext) int {
     serialized := []byte("")
-    serialized = append(serialized, elliptic.MarshalCompressed(curve, &(*ct.U.X), &(*ct.U.Y))...)
-    serialized = append(serialized, (ct.Y).Bytes()...)
+    serialized = append(serialized, group.Encode(ct.U)...)
+    serialized = append(serialized, group.EncodeScalar(ct.Y)...)
     serialized = append(serialized, (ct.BitVec)...)
     
     return len(serialized)
@@ -0,0 +1,502 @@
+package fuzzycrypto
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+//
+// Binary encodings for the things that go over the wire.
+//
+// An ElGamalPower2 flag is laid out as
+//
+//   [version (1)][group ID (1)][U][Y][BitVec]
+//
+// with U and Y in the group's canonical encoding (SEC1 compressed points and
+// fixed width big endian scalars for the NIST curves, RFC 9496 for ristretto255),
+// which for P-256 and 24 subkeys is 2 + 33 + 32 + 3 = 70 bytes.
+
+const FLAG_ENCODING_VERSION byte = 1
+
+//
+// Encode the ciphertext in the compact binary flag format. The ciphertext has to
+// know its group, so this only works on ciphertexts produced by TheoreticalFlag
+// or UnmarshalBinary.
+func (ct *Ciphertext) MarshalBinary() ([]byte, error) {
+    if ct.group == nil {
+        return nil, errors.New("ciphertext has no group")
+    }
+    if !validElement(ct.group, ct.U) || ct.Y == nil || len(ct.BitVec) == 0 {
+        return nil, errors.New("incomplete ciphertext")
+    }
+
+    out := make([]byte, 0, 2 + ct.group.ElementLen() + ct.group.ScalarLen() + len(ct.BitVec))
+    out = append(out, FLAG_ENCODING_VERSION, ct.group.ID())
+    out = append(out, ct.group.Encode(ct.U)...)
+    out = append(out, ct.group.EncodeScalar(ct.Y)...)
+    out = append(out, ct.BitVec...)
+    return out, nil
+}
+
+//
+// Decode a binary flag. Anything with the wrong version, an unknown group, the wrong
+// length, a U that isn't a valid element or an unreduced Y is rejected with ErrMalformedFlag.
+func (ct *Ciphertext) UnmarshalBinary(data []byte) error {
+    if len(data) < 2 {
+        return fmt.Errorf("%w: %d byte flag is too short", ErrMalformedFlag, len(data))
+    }
+    if data[0] != FLAG_ENCODING_VERSION {
+        return fmt.Errorf("%w: unknown flag version %d", ErrMalformedFlag, data[0])
+    }
+    group, err := GroupFromID(data[1])
+    if err != nil {
+        return fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
+    data = data[2:]
+
+    elLen := group.ElementLen()
+    scLen := group.ScalarLen()
+    if len(data) <= elLen + scLen {
+        return fmt.Errorf("%w: flag is truncated", ErrMalformedFlag)
+    }
+
+    U, err := group.Decode(data[:elLen])
+    if err != nil {
+        return fmt.Errorf("%w: U: %v", ErrMalformedFlag, err)
+    }
+    y, err := group.DecodeScalar(data[elLen:elLen+scLen])
+    if err != nil {
+        return fmt.Errorf("%w: Y: %v", ErrMalformedFlag, err)
+    }
+
+    ct.group = group
+    ct.U = U
+    ct.Y = y
+    ct.BitVec = append([]byte{}, data[elLen+scLen:]...)
+    return nil
+}
+
+//
+// A Fractional flag is framed so a detector can tell what it holds before it
+// touches the garbled circuit:
+//
+//   [version (1)][scheme (1)][group ID (1)][gamma (1)][circuit ID (1)][garbling (1)]
+//   [gate cipher (1)]
+//   [length (4)][DH share]
+//   [length (4)][encrypted labels for the numerator wires]
+//   [length (4)][labels for the random input wires]
+//   [length (4)][packed garbled circuit]
+//
+// with big endian lengths. The circuit ID names the circuit that was garbled,
+// a flag can only be evaluated with exactly that circuit for its gamma,
+// garbling is the toygarble.GarblingScheme it was garbled with and gate cipher
+// the toygarble.GateCipherID its tables are encrypted with.
+
+const FRACTIONAL_FLAG_VERSION byte = 1
+
+// the mod circuit toygarble.GenerateModCircuit builds for gamma + SECURITYPARAM
+// random bits
+const CIRCUIT_GENERATED_MOD byte = 1
+
+const fractionalFlagHeaderLen = 7
+
+type fractionalFlag struct {
+    group           Group
+    gamma           int
+    circuitID       byte
+    garbling        toygarble.GarblingScheme
+    cipher          toygarble.GateCipherID
+    share           []byte
+    encLabels       []byte
+    plainLabels     []byte
+    garbled         []byte
+}
+
+func (f *fractionalFlag) sections() []*[]byte {
+    return []*[]byte{&f.share, &f.encLabels, &f.plainLabels, &f.garbled}
+}
+
+var fractionalSectionNames = []string{"DH share", "encrypted labels", "plaintext labels", "garbled circuit"}
+
+func (f *fractionalFlag) marshal() []byte {
+    size := fractionalFlagHeaderLen
+    for _, sec := range f.sections() {
+        size += 4 + len(*sec)
+    }
+    out := make([]byte, fractionalFlagHeaderLen, size)
+    out[0] = FRACTIONAL_FLAG_VERSION
+    out[1] = byte(SchemeFractional)
+    out[2] = f.group.ID()
+    out[3] = byte(f.gamma)
+    out[4] = f.circuitID
+    out[5] = byte(f.garbling)
+    out[6] = byte(f.cipher)
+    length := make([]byte, 4)
+    for _, sec := range f.sections() {
+        binary.BigEndian.PutUint32(length, uint32(len(*sec)))
+        out = append(out, length...)
+        out = append(out, *sec...)
+    }
+    return out
+}
+
+//
+// Split a Fractional flag into its sections. Everything that can be checked
+// without a key is: the header, that the sections exactly fill the flag and
+// that the share and label sections have the sizes gamma calls for. Whatever is
+// wrong comes back as ErrMalformedFlag.
+func parseFractionalFlag(data []byte) (*fractionalFlag, error) {
+    if len(data) < fractionalFlagHeaderLen {
+        return nil, fmt.Errorf("%w: %d byte flag is too short", ErrMalformedFlag, len(data))
+    }
+    if data[0] != FRACTIONAL_FLAG_VERSION {
+        return nil, fmt.Errorf("%w: unknown flag version %d", ErrMalformedFlag, data[0])
+    }
+    if SchemeID(data[1]) != SchemeFractional {
+        return nil, fmt.Errorf("%w: flag is for %v, not Fractional", ErrMalformedFlag, SchemeID(data[1]))
+    }
+    group, err := GroupFromID(data[2])
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
+    f := &fractionalFlag{group: group, gamma: int(data[3]), circuitID: data[4], garbling: toygarble.GarblingScheme(data[5]), cipher: toygarble.GateCipherID(data[6])}
+    if err := checkGammaFR(f.gamma); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
+    if f.circuitID != CIRCUIT_GENERATED_MOD {
+        return nil, fmt.Errorf("%w: unknown circuit %d", ErrMalformedFlag, f.circuitID)
+    }
+    if _, err := toygarble.NewGarbledCircuit(f.garbling, f.cipher); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
+
+    rest := data[fractionalFlagHeaderLen:]
+    for i, sec := range f.sections() {
+        if len(rest) < 4 {
+            return nil, fmt.Errorf("%w: flag ends before the %s", ErrMalformedFlag, fractionalSectionNames[i])
+        }
+        n := binary.BigEndian.Uint32(rest)
+        rest = rest[4:]
+        if uint64(n) > uint64(len(rest)) {
+            return nil, fmt.Errorf("%w: %s is %d bytes but only %d are left", ErrMalformedFlag, fractionalSectionNames[i], n, len(rest))
+        }
+        *sec, rest = rest[:n], rest[n:]
+    }
+    if len(rest) != 0 {
+        return nil, fmt.Errorf("%w: %d bytes after the garbled circuit", ErrMalformedFlag, len(rest))
+    }
+
+    expected := []int{
+        group.ElementLen(),
+        2 * f.gamma * toygarble.LABEL_LEN_BYTES,
+        (f.gamma + SECURITYPARAM) * toygarble.LABEL_LEN_BYTES,
+    }
+    for i, n := range expected {
+        if got := len(*f.sections()[i]); got != n {
+            return nil, fmt.Errorf("%w: %s is %d bytes, expected %d for gamma=%d", ErrMalformedFlag, fractionalSectionNames[i], got, n, f.gamma)
+        }
+    }
+    return f, nil
+}
+
+//
+// Keys are serialized as
+//
+//   [version (1)][kind (1)][scheme (1)][group ID (1)][gamma (2)][prob (4)][count (2)][count elements]
+//
+// where the elements are the group's canonical encodings of points for public keys
+// and of scalars for secret and detection keys, and all integers are big endian.
+// prob is the scheme's own description of the rate: n for a 2^-n ElGamalPower2 key,
+// the numerator k of k / 2^gamma for a Fractional key.
+//
+// The text form wraps the binary one in a PEM block whose headers repeat the
+// metadata for humans.
+
+const KEY_ENCODING_VERSION byte = 1
+
+const (
+    keyKindPublic       byte = 1
+    keyKindSecret       byte = 2
+    keyKindDetection    byte = 3
+)
+
+const keyHeaderLen = 12
+
+var pemKeyTypes = map[byte]string{
+    keyKindPublic:      "FUZZY PUBLIC KEY",
+    keyKindSecret:      "FUZZY SECRET KEY",
+    keyKindDetection:   "FUZZY DETECTION KEY",
+}
+
+func writeKeyHeader(kind byte, scheme SchemeID, group Group, gamma int, prob uint32, count int) ([]byte, error) {
+    if scheme != SchemeElGamalPower2 && scheme != SchemeFractional {
+        return nil, fmt.Errorf("%w: unknown scheme %v", ErrInvalidKey, scheme)
+    }
+    if gamma < 0 || gamma > 0xffff || count > 0xffff {
+        return nil, fmt.Errorf("%w: key is too large to encode", ErrInvalidKey)
+    }
+    header := make([]byte, keyHeaderLen)
+    header[0] = KEY_ENCODING_VERSION
+    header[1] = kind
+    header[2] = byte(scheme)
+    header[3] = group.ID()
+    binary.BigEndian.PutUint16(header[4:], uint16(gamma))
+    binary.BigEndian.PutUint32(header[6:], prob)
+    binary.BigEndian.PutUint16(header[10:], uint16(count))
+    return header, nil
+}
+
+type keyHeader struct {
+    kind    byte
+    scheme  SchemeID
+    group   Group
+    gamma   int
+    prob    uint32
+    count   int
+}
+
+//
+// Read and sanity check a key header: the number of elements has to be the one
+// the scheme produces for that gamma and rate, and the body has to be exactly
+// count elements of elemLen bytes.
+func readKeyHeader(data []byte, elemLen func(Group) int) (*keyHeader, []byte, error) {
+    if len(data) < keyHeaderLen {
+        return nil, nil, fmt.Errorf("%w: %d byte key is too short", ErrInvalidKey, len(data))
+    }
+    if data[0] != KEY_ENCODING_VERSION {
+        return nil, nil, fmt.Errorf("%w: unknown key version %d", ErrInvalidKey, data[0])
+    }
+    h := &keyHeader{
+        kind:   data[1],
+        scheme: SchemeID(data[2]),
+        gamma:  int(binary.BigEndian.Uint16(data[4:])),
+        prob:   binary.BigEndian.Uint32(data[6:]),
+        count:  int(binary.BigEndian.Uint16(data[10:])),
+    }
+    group, err := GroupFromID(data[3])
+    if err != nil {
+        return nil, nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+    }
+    h.group = group
+
+    // What the scheme would have produced
+    expected := -1
+    switch h.scheme {
+    case SchemeElGamalPower2:
+        switch {
+        case h.kind == keyKindDetection && h.prob <= uint32(h.gamma):
+            expected = int(h.prob)
+        case h.kind != keyKindDetection && (h.kind == keyKindPublic || h.prob == uint32(h.gamma)):
+            expected = h.gamma
+        }
+    case SchemeFractional:
+        switch {
+        case checkGammaFR(h.gamma) != nil:
+        case h.kind == keyKindDetection && uint64(h.prob) < uint64(1) << uint(h.gamma):
+            expected = h.gamma
+        case h.kind != keyKindDetection && (h.kind == keyKindPublic || h.prob == ^uint32(0)):
+            expected = 2*h.gamma
+        }
+    default:
+        return nil, nil, fmt.Errorf("%w: unknown scheme %v", ErrInvalidKey, h.scheme)
+    }
+    if expected < 0 || h.count != expected {
+        return nil, nil, fmt.Errorf("%w: inconsistent %v key: gamma=%d, prob=%d, %d subkeys", ErrInvalidKey, h.scheme, h.gamma, h.prob, h.count)
+    }
+
+    body := data[keyHeaderLen:]
+    if len(body) != h.count * elemLen(group) {
+        return nil, nil, fmt.Errorf("%w: key body is %d bytes, expected %d", ErrInvalidKey, len(body), h.count * elemLen(group))
+    }
+    return h, body, nil
+}
+
+//
+// Encode a public key. Only keys that came out of KeyGen (or UnmarshalBinary)
+// know their scheme and group, hand-built keys can't be encoded.
+func (pk *PubKey) MarshalBinary() ([]byte, error) {
+    if pk.group == nil {
+        return nil, fmt.Errorf("%w: public key has no group", ErrInvalidKey)
+    }
+    if err := validatePubKey(pk.group, pk); err != nil {
+        return nil, err
+    }
+    out, err := writeKeyHeader(keyKindPublic, pk.scheme, pk.group, pk.gamma, 0, pk.NumKeys)
+    if err != nil {
+        return nil, err
+    }
+    for _, el := range pk.PubKeys {
+        out = append(out, pk.group.Encode(el)...)
+    }
+    return out, nil
+}
+
+func elementLen(group Group) int { return group.ElementLen() }
+func scalarLen(group Group) int  { return group.ScalarLen() }
+
+func (pk *PubKey) UnmarshalBinary(data []byte) error {
+    h, body, err := readKeyHeader(data, elementLen)
+    if err != nil {
+        return err
+    }
+    if h.kind != keyKindPublic {
+        return fmt.Errorf("%w: not a public key", ErrInvalidKey)
+    }
+    elLen := h.group.ElementLen()
+    keys := make([]Element, h.count)
+    for i := range keys {
+        keys[i], err = h.group.Decode(body[i*elLen:(i+1)*elLen])
+        if err != nil || !validElement(h.group, keys[i]) {
+            return fmt.Errorf("%w: public subkey %d is not an element of %s", ErrInvalidKey, i, h.group.Name())
+        }
+    }
+    *pk = PubKey{NumKeys: h.count, PubKeys: keys, scheme: h.scheme, group: h.group, gamma: h.gamma}
+    return nil
+}
+
+//
+// Encode a secret or detection key.
+func (sk *SecKey) MarshalBinary() ([]byte, error) {
+    if sk != nil && sk.group == nil {
+        return nil, fmt.Errorf("%w: secret key has no group", ErrInvalidKey)
+    }
+    if err := validateSecKey(nil, sk); err != nil {
+        return nil, err
+    }
+    kind := keyKindSecret
+    if sk.detection {
+        kind = keyKindDetection
+    }
+    out, err := writeKeyHeader(kind, sk.scheme, sk.group, sk.gamma, sk.prob, sk.numKeys)
+    if err != nil {
+        return nil, err
+    }
+    for _, x := range sk.secKeys {
+        out = append(out, sk.group.EncodeScalar(x)...)
+    }
+    return out, nil
+}
+
+func (sk *SecKey) UnmarshalBinary(data []byte) error {
+    h, body, err := readKeyHeader(data, scalarLen)
+    if err != nil {
+        return err
+    }
+    if h.kind != keyKindSecret && h.kind != keyKindDetection {
+        return fmt.Errorf("%w: not a secret or detection key", ErrInvalidKey)
+    }
+    scLen := h.group.ScalarLen()
+    keys := make([]Scalar, h.count)
+    for i := range keys {
+        keys[i], err = h.group.DecodeScalar(body[i*scLen:(i+1)*scLen])
+        if err != nil || !validScalar(h.group, keys[i]) {
+            return fmt.Errorf("%w: secret subkey %d is not a nonzero reduced scalar", ErrInvalidKey, i)
+        }
+    }
+    *sk = SecKey{
+        numKeys:    h.count,
+        secKeys:    keys,
+        prob:       h.prob,
+        scheme:     h.scheme,
+        group:      h.group,
+        gamma:      h.gamma,
+        detection:  h.kind == keyKindDetection,
+    }
+    return nil
+}
+
+//
+// Human readable rate of a key for the PEM headers
+func rateString(scheme SchemeID, gamma int, prob uint32) string {
+    if scheme == SchemeElGamalPower2 {
+        return fmt.Sprintf("1/2^%d", prob)
+    }
+    return fmt.Sprintf("%d/2^%d", prob, gamma)
+}
+
+func encodeKeyPEM(kind byte, bin []byte, scheme SchemeID, group Group, gamma int, prob uint32) []byte {
+    headers := map[string]string{
+        "Scheme":   scheme.String(),
+        "Group":    group.Name(),
+        "Gamma":    strconv.Itoa(gamma),
+    }
+    if kind == keyKindDetection {
+        headers["Probability"] = rateString(scheme, gamma, prob)
+    }
+    return pem.EncodeToMemory(&pem.Block{Type: pemKeyTypes[kind], Headers: headers, Bytes: bin})
+}
+
+func decodeKeyPEM(text []byte, kinds ...byte) ([]byte, error) {
+    block, rest := pem.Decode(text)
+    if block == nil {
+        return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidKey)
+    }
+    if len(bytes.TrimSpace(rest)) != 0 {
+        return nil, fmt.Errorf("%w: trailing data after PEM block", ErrInvalidKey)
+    }
+    for _, kind := range kinds {
+        if block.Type == pemKeyTypes[kind] {
+            if len(block.Bytes) < 2 || block.Bytes[1] != kind {
+                return nil, fmt.Errorf("%w: %s does not hold a matching key", ErrInvalidKey, block.Type)
+            }
+            return block.Bytes, nil
+        }
+    }
+    return nil, fmt.Errorf("%w: unexpected PEM block %q", ErrInvalidKey, block.Type)
+}
+
+func (pk *PubKey) MarshalText() ([]byte, error) {
+    bin, err := pk.MarshalBinary()
+    if err != nil {
+        return nil, err
+    }
+    return encodeKeyPEM(keyKindPublic, bin, pk.scheme, pk.group, pk.gamma, 0), nil
+}
+
+func (pk *PubKey) UnmarshalText(text []byte) error {
+    bin, err := decodeKeyPEM(text, keyKindPublic)
+    if err != nil {
+        return err
+    }
+    return pk.UnmarshalBinary(bin)
+}
+
+func (sk *SecKey) MarshalText() ([]byte, error) {
+    bin, err := sk.MarshalBinary()
+    if err != nil {
+        return nil, err
+    }
+    return encodeKeyPEM(bin[1], bin, sk.scheme, sk.group, sk.gamma, sk.prob), nil
+}
+
+func (sk *SecKey) UnmarshalText(text []byte) error {
+    bin, err := decodeKeyPEM(text, keyKindSecret, keyKindDetection)
+    if err != nil {
+        return err
+    }
+    return sk.UnmarshalBinary(bin)
+}
+
+//
+// Read a PEM encoded secret or detection key of the given scheme from a file
+func readSKFile(fname string, scheme SchemeID) (*SecKey, error) {
+    text, err := os.ReadFile(fname)
+    if err != nil {
+        return nil, err
+    }
+    sk := new(SecKey)
+    if err = sk.UnmarshalText(text); err != nil {
+        return nil, err
+    }
+    if sk.scheme != scheme {
+        return nil, fmt.Errorf("%w: %s holds a %v key", ErrInvalidKey, fname, sk.scheme)
+    }
+    return sk, nil
+}
@@ -0,0 +1,242 @@
+package fuzzycrypto
+
+import (
+    "bytes"
+    "crypto/rand"
+    "errors"
+    "math/big"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func checkSameSecKey(t *testing.T, want *SecKey, got *SecKey) {
+    t.Helper()
+    if got.numKeys != want.numKeys || got.prob != want.prob || got.scheme != want.scheme ||
+        got.gamma != want.gamma || got.detection != want.detection || got.group.ID() != want.group.ID() {
+        t.Fatalf("key metadata did not round trip: want %d/%d/%v/%d/%t, got %d/%d/%v/%d/%t",
+            want.numKeys, want.prob, want.scheme, want.gamma, want.detection,
+            got.numKeys, got.prob, got.scheme, got.gamma, got.detection)
+    }
+    for i := range want.secKeys {
+        if !bytes.Equal(want.group.EncodeScalar(want.secKeys[i]), got.group.EncodeScalar(got.secKeys[i])) {
+            t.Fatalf("subkey %d did not round trip", i)
+        }
+    }
+}
+
+func checkSamePubKey(t *testing.T, want *PubKey, got *PubKey) {
+    t.Helper()
+    if got.NumKeys != want.NumKeys || got.scheme != want.scheme || got.gamma != want.gamma || got.group.ID() != want.group.ID() {
+        t.Fatalf("public key metadata did not round trip")
+    }
+    for i := range want.PubKeys {
+        if !bytes.Equal(want.group.Encode(want.PubKeys[i]), got.group.Encode(got.PubKeys[i])) {
+            t.Fatalf("public subkey %d did not round trip", i)
+        }
+    }
+}
+
+// Every key of both schemes survives binary and PEM round trips and still works afterwards
+func TestKeyRoundTrip(t *testing.T) {
+    schemes := []struct {
+        scheme  FuzzyScheme
+        group   Group
+        gamma   int
+        p       Probability
+    }{
+        {new(ElGamalPower2), P256(), NUM_TOTAL_KEYS, Pow2Probability(NUM_EXTRACT_MED)},
+        {new(ElGamalPower2), Ristretto255(), NUM_TOTAL_KEYS, Pow2Probability(NUM_EXTRACT_MED)},
+        {new(Fractional), P256(), SMALL_CONSTANT, Probability{31, 1 << SMALL_CONSTANT}},
+        {new(Fractional), Ristretto255(), SMALL_CONSTANT, Probability{31, 1 << SMALL_CONSTANT}},
+    }
+
+    for _, s := range schemes {
+        group := s.group
+        sk, pk, err := s.scheme.KeyGen(group, s.gamma, rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+        dsk, err := s.scheme.Extract(s.p, sk)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        for _, key := range []*SecKey{sk, dsk} {
+            bin, err := key.MarshalBinary()
+            if err != nil {
+                t.Fatal(err)
+            }
+            var fromBin SecKey
+            if err := fromBin.UnmarshalBinary(bin); err != nil {
+                t.Fatal(err)
+            }
+            checkSameSecKey(t, key, &fromBin)
+
+            text, err := key.MarshalText()
+            if err != nil {
+                t.Fatal(err)
+            }
+            var fromText SecKey
+            if err := fromText.UnmarshalText(text); err != nil {
+                t.Fatal(err)
+            }
+            checkSameSecKey(t, key, &fromText)
+        }
+
+        bin, err := pk.MarshalBinary()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var pkFromBin PubKey
+        if err := pkFromBin.UnmarshalBinary(bin); err != nil {
+            t.Fatal(err)
+        }
+        checkSamePubKey(t, pk, &pkFromBin)
+
+        text, err := pk.MarshalText()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var pkFromText PubKey
+        if err := pkFromText.UnmarshalText(text); err != nil {
+            t.Fatal(err)
+        }
+        checkSamePubKey(t, pk, &pkFromText)
+
+        // decoded keys have to be usable
+        dskText, _ := dsk.MarshalText()
+        var decodedDsk SecKey
+        decodedDsk.UnmarshalText(dskText)
+        flag, err := s.scheme.Flag(group, rand.Reader, &pkFromText)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if res, err := s.scheme.Test(group, flag, &decodedDsk); err != nil || !res {
+            t.Errorf("decoded %T keys could not detect their own flag: %v", s.scheme, err)
+        }
+    }
+}
+
+func TestKeyTextFormat(t *testing.T) {
+    var testB *ElGamalPower2
+    sk, _, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), sk)
+    text, _ := dsk.MarshalText()
+    for _, want := range []string{"BEGIN FUZZY DETECTION KEY", "Scheme: ElGamalPower2", "Group: P-256", "Gamma: 24", "Probability: 1/2^5"} {
+        if !strings.Contains(string(text), want) {
+            t.Errorf("PEM is missing %q:\n%s", want, text)
+        }
+    }
+}
+
+func TestKeyDecodeErrors(t *testing.T) {
+    var testB *ElGamalPower2
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), sk)
+    skBin, _ := sk.MarshalBinary()
+    dskBin, _ := dsk.MarshalBinary()
+    pkBin, _ := pk.MarshalBinary()
+    // the identity encodes as all zeros in Ristretto255
+    _, rpk, _ := testB.KeyGen(Ristretto255(), NUM_TOTAL_KEYS, rand.Reader)
+    rpkBin, _ := rpk.MarshalBinary()
+    zeroSubkey := append(append([]byte{}, rpkBin[:len(rpkBin)-32]...), make([]byte, 32)...)
+    corrupt := func(b []byte, idx int, val byte) []byte {
+        bad := append([]byte{}, b...)
+        bad[idx] = val
+        return bad
+    }
+
+    var key SecKey
+    var pub PubKey
+    cases := []struct {
+        name    string
+        err     error
+    }{
+        {"empty", key.UnmarshalBinary(nil)},
+        {"version", key.UnmarshalBinary(corrupt(skBin, 0, KEY_ENCODING_VERSION+1))},
+        {"scheme", key.UnmarshalBinary(corrupt(skBin, 2, 0x7f))},
+        {"group", key.UnmarshalBinary(corrupt(skBin, 3, 0x7f))},
+        {"truncated", key.UnmarshalBinary(skBin[:len(skBin)-1])},
+        {"trailing", key.UnmarshalBinary(append(append([]byte{}, skBin...), 0))},
+        {"count", key.UnmarshalBinary(corrupt(dskBin, 11, NUM_EXTRACT_SMALL+1))},
+        {"prob above gamma", key.UnmarshalBinary(corrupt(dskBin, 9, NUM_TOTAL_KEYS+1))},
+        {"zero scalar", key.UnmarshalBinary(append(append([]byte{}, dskBin[:len(dskBin)-32]...), make([]byte, 32)...))},
+        {"public as secret", key.UnmarshalBinary(pkBin)},
+        {"secret as public", pub.UnmarshalBinary(skBin)},
+        {"off-curve point", pub.UnmarshalBinary(corrupt(pkBin, keyHeaderLen, 0x04))},
+        {"identity subkey", pub.UnmarshalBinary(zeroSubkey)},
+        {"not PEM", key.UnmarshalText([]byte("hello"))},
+        {"hand-built key", func() error { _, err := (&PubKey{NumKeys: 1, PubKeys: pk.PubKeys[:1]}).MarshalBinary(); return err }()},
+    }
+    for _, c := range cases {
+        if !errors.Is(c.err, ErrInvalidKey) {
+            t.Errorf("%s: expected ErrInvalidKey, got %v", c.name, c.err)
+        }
+    }
+
+    // a PEM block whose type disagrees with its contents
+    pkText, _ := pk.MarshalText()
+    if err := key.UnmarshalText(pkText); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("public key PEM decoded as a secret key: %v", err)
+    }
+    swapped := bytes.Replace(pkText, []byte("FUZZY PUBLIC KEY"), []byte("FUZZY SECRET KEY"), -1)
+    if err := key.UnmarshalText(swapped); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("relabelled PEM block was accepted: %v", err)
+    }
+}
+
+// JsonifySK/MarshalSK write and read files, and EG still reads the old decimal files
+func TestSKFiles(t *testing.T) {
+    dir := t.TempDir()
+    var testB *ElGamalPower2
+    var testT *Fractional
+    sk, _, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    frSk, _, _ := testT.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+
+    egFile := filepath.Join(dir, "eg.pem")
+    text, err := testB.JsonifySK(sk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    os.WriteFile(egFile, text, 0600)
+    read, err := testB.MarshalSK(egFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkSameSecKey(t, sk, read)
+
+    frFile := filepath.Join(dir, "frac.pem")
+    text, err = testT.JsonifySK(frSk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    os.WriteFile(frFile, text, 0600)
+    read, err = testT.MarshalSK(frFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    checkSameSecKey(t, frSk, read)
+
+    if _, err := testT.MarshalSK(egFile); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Fractional read an ElGamalPower2 key: %v", err)
+    }
+    if _, err := testB.JsonifySK(frSk); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("ElGamalPower2 wrote a Fractional key: %v", err)
+    }
+
+    var legacy bytes.Buffer
+    for _, x := range sk.secKeys {
+        legacy.WriteString(x.(*big.Int).String() + "\n")
+    }
+    legacyFile := filepath.Join(dir, "legacy.txt")
+    os.WriteFile(legacyFile, legacy.Bytes(), 0600)
+    read, err = testB.MarshalSK(legacyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if read.numKeys != NUM_TOTAL_KEYS || read.group != P256() || read.secKeys[3].(*big.Int).Cmp(sk.secKeys[3].(*big.Int)) != 0 {
+        t.Errorf("legacy key file was not read back correctly")
+    }
+}
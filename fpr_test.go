@@ -0,0 +1,117 @@
+package fuzzycrypto
+
+import (
+    "crypto/rand"
+    "flag"
+    "math"
+    "testing"
+)
+
+// The defaults are enough to tell a rate from one a few percent off. The
+// Fractional test takes a while, so it is skipped by go test -short, and either
+// can be run with a different number of flags with
+//   go test -run FalsePositive -fpr.trials 20000
+var fprTrials = flag.Int("fpr.trials", 0, "number of unrelated flags per false positive rate test, 0 for the defaults")
+
+const (
+    FPR_TRIALS_EG   = 1000
+    FPR_TRIALS_FR   = 5000
+    // Fractional keys are this small so that thousands of flags garble quickly
+    FPR_GAMMA_FR    = 4
+    // width of the confidence interval in standard deviations, a correct
+    // scheme fails a check about once in a few million runs
+    FPR_Z           = 5.0
+)
+
+func fprTrialCount(def int) int {
+    if *fprTrials > 0 {
+        return *fprTrials
+    }
+    return def
+}
+
+//
+// Fail unless p lies in the Wilson score interval around hits/trials
+func checkRate(t *testing.T, name string, hits int, trials int, p float64) {
+    t.Helper()
+    n, k, z2 := float64(trials), float64(hits), FPR_Z*FPR_Z
+    center := (k + z2/2) / (n + z2)
+    half := FPR_Z / (n + z2) * math.Sqrt(k*(1-k/n) + z2/4)
+    if p < center - half || p > center + half {
+        t.Errorf("%s: %d of %d unrelated flags matched (%.4f), expected rate %.4f is outside [%.4f, %.4f]",
+            name, hits, trials, k/n, p, center - half, center + half)
+    } else {
+        t.Logf("%s: %d of %d unrelated flags matched (%.4f), expected %.4f", name, hits, trials, k/n, p)
+    }
+}
+
+//
+// Flag trials messages to an unrelated key and count how often each detection
+// key matches
+func countFalsePositives(t *testing.T, scheme FuzzyScheme, group Group, pk *PubKey, dsks []*SecKey, trials int) []int {
+    hits := make([]int, len(dsks))
+    for i := 0; i < trials; i++ {
+        flag, err := scheme.Flag(group, rand.Reader, pk)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for j, dsk := range dsks {
+            res, err := scheme.Test(group, flag, dsk)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if res {
+                hits[j]++
+            }
+        }
+    }
+    return hits
+}
+
+// A 2^-n detection key matches about a 2^-n fraction of unrelated flags
+func TestFalsePositiveRateEG(t *testing.T) {
+    for _, group := range []Group{P256(), Ristretto255()} {
+        var testB *ElGamalPower2
+        // only as many subkeys as the smallest rate needs, they all cost a
+        // scalar multiplication per flag
+        sk, _, _ := testB.KeyGen(group, NUM_EXTRACT_SMALL, rand.Reader)
+        _, otherPk, _ := testB.KeyGen(group, NUM_EXTRACT_SMALL, rand.Reader)
+
+        rates := []int{1, 2, 3, NUM_EXTRACT_SMALL}
+        dsks := make([]*SecKey, len(rates))
+        for i, n := range rates {
+            dsks[i], _ = testB.Extract(Pow2Probability(n), sk)
+        }
+
+        trials := fprTrialCount(FPR_TRIALS_EG)
+        hits := countFalsePositives(t, testB, group, otherPk, dsks, trials)
+        for i, n := range rates {
+            checkRate(t, group.Name() + " " + Pow2Probability(n).String(), hits[i], trials, math.Ldexp(1, -n))
+        }
+    }
+}
+
+// A numerator/2^gamma detection key matches about that fraction of unrelated
+// flags. The numerators have their bits far from symmetric, so a key built from
+// the numerator's bits in the wrong order would flag at a very different rate.
+func TestFalsePositiveRateFR(t *testing.T) {
+    if testing.Short() {
+        t.Skip("garbles thousands of flags")
+    }
+    var testT *Fractional
+    sk, _, _ := testT.KeyGen(P256(), FPR_GAMMA_FR, rand.Reader)
+    _, otherPk, _ := testT.KeyGen(P256(), FPR_GAMMA_FR, rand.Reader)
+
+    numerators := []uint64{1, 3, 14}
+    dsks := make([]*SecKey, len(numerators))
+    for i, k := range numerators {
+        dsks[i], _ = testT.Extract(Probability{k, 1 << FPR_GAMMA_FR}, sk)
+    }
+
+    trials := fprTrialCount(FPR_TRIALS_FR)
+    hits := countFalsePositives(t, testT, P256(), otherPk, dsks, trials)
+    for i, k := range numerators {
+        p := Probability{k, 1 << FPR_GAMMA_FR}
+        checkRate(t, p.String(), hits[i], trials, float64(k) / float64(uint64(1) << FPR_GAMMA_FR))
+    }
+}
@@ -2,199 +2,238 @@ package fuzzycrypto
 
 import (
     "bytes"
-    "crypto/elliptic"
+    "errors"
     "crypto/sha256"
     "fmt"
     "github.com/becgabri/fuzzycrypto/toygarble"
     "io"
-    "math"
     "math/big"
-    "math/rand"
-    "os"
     "strconv"
 )
 // kappa (statistical param)
 const SECURITYPARAM int = 40
 
-var CIRCUITFILES []string = []string{"48Num8Mod.circ","64Num24Mod.circ"}
+// gamma can be anything from 1 up to this, the circuit is generated for it
+const MAX_GAMMA_FR int = toygarble.MAX_MOD_BITS
 
 
 type Fractional struct {
+    // where Flag and Test get their circuits, nil shares one cache with every
+    // other Fractional
+    Circuits    *CircuitCache
+    // how Flag garbles, 0 for half-gates. Test reads it from the flag.
+    Garbling    toygarble.GarblingScheme
+    // what Flag encrypts the garbled tables with, 0 for fixed-key AES. Test
+    // reads it from the flag.
+    GateCipher  toygarble.GateCipherID
 }
 
-func computeHashI(curve elliptic.Curve, one *GroupElement, two *GroupElement) []byte {
+func (frac *Fractional) circuits() *CircuitCache {
+    if frac == nil || frac.Circuits == nil {
+        return defaultCircuits
+    }
+    return frac.Circuits
+}
+
+func (frac *Fractional) garbling() toygarble.GarblingScheme {
+    if frac == nil || frac.Garbling == 0 {
+        return toygarble.GarblingHalfGates
+    }
+    return frac.Garbling
+}
+
+func (frac *Fractional) gateCipher() toygarble.GateCipherID {
+    if frac == nil || frac.GateCipher == 0 {
+        return toygarble.CipherFixedKeyAES
+    }
+    return frac.GateCipher
+}
+
+func computeHashI(group Group, one Element, two Element) []byte {
     serialized := []byte("HashI")
-    serialized = append(serialized, elliptic.Marshal(curve, &(*one.X), &(*one.Y))...)
-    serialized = append(serialized, elliptic.Marshal(curve, &(*two.X), &(*two.Y))...)
+    serialized = append(serialized, group.Encode(one)...)
+    serialized = append(serialized, group.Encode(two)...)
     h := sha256.Sum256(serialized)
 
     return h[:]
 }
 
 // Implementing the fuzzy scheme interface
-func (frac *Fractional) KeyGen(curve elliptic.Curve, gamma int, rand io.Reader) (priv *SecKey, pub *PubKey) {
-    // check the constant param to see if we have a circuit
-    // file for that granularity
-    if gamma != 8 && gamma != 24 {
-        // fail open
-        return
-    }
-    // create 2*numKeys public/private key pairs 
+func (frac *Fractional) KeyGen(group Group, gamma int, rand io.Reader) (priv *SecKey, pub *PubKey, err error) {
+    if err = checkGammaFR(gamma); err != nil {
+        return nil, nil, err
+    }
+    // create 2*numKeys public/private key pairs
     // from a Ambig. Enc scheme
     pub = new(PubKey)
+    pub.scheme, pub.group, pub.gamma = SchemeFractional, group, gamma
     pub.NumKeys = 2*gamma
-    pub.PubKeys = make([]*GroupElement, 2*gamma)
+    pub.PubKeys = make([]Element, 2*gamma)
 
     priv = new(SecKey)
+    priv.scheme, priv.group, priv.gamma = SchemeFractional, group, gamma
     priv.numKeys = 2*gamma
-    priv.secKeys = make([]*big.Int, 2*gamma)
-    // Recall this is a uint -- should be highest value 
-    priv.prob = ^uint32(0) 
+    priv.secKeys = make([]Scalar, 2*gamma)
+    // Recall this is a uint -- should be highest value
+    priv.prob = ^uint32(0)
 
     for i := 0; i < 2*gamma; i++ {
-        priv.secKeys[i], pub.PubKeys[i] = keyGenSingle(curve, rand)        
+        priv.secKeys[i], pub.PubKeys[i], err = keyGenSingle(group, rand)
+        if err != nil {
+            return nil, nil, err
+        }
     }
 
     return
 }
 
-func encryptLabel(curve elliptic.Curve, myShare *GroupElement, sharedKey *GroupElement, label toygarble.Label_t) []byte {
-    bytestream := computeHashI(curve,myShare, sharedKey)
-    enc := make([]byte, toygarble.LABEL_LEN_BYTES) 
+func encryptLabel(group Group, myShare Element, sharedKey Element, label toygarble.Label_t) []byte {
+    bytestream := computeHashI(group, myShare, sharedKey)
+    enc := make([]byte, toygarble.LABEL_LEN_BYTES)
     for i := 0; i < toygarble.LABEL_LEN_BYTES; i++ {
         enc[i] = label[i] ^ bytestream[i]
     }
-    return enc 
+    return enc
 }
 
-func generateAnonKeyStream(curve elliptic.Curve, pub *PubKey, b *big.Int, bG *GroupElement, random io.Reader, numOfWires int) []toygarble.SimpleWireLabelSet {
-    // compute all shared labels 
+func generateAnonKeyStream(group Group, pub *PubKey, b Scalar, bG Element, random io.Reader, numOfWires int) []toygarble.SimpleWireLabelSet {
+    // compute all shared labels
     allLabels := make([]toygarble.SimpleWireLabelSet, numOfWires)
     for i := 0; i < pub.NumKeys; i++ {
-        sharedKey := new(GroupElement)
-        sharedKey.X, sharedKey.Y = curve.ScalarMult(pub.PubKeys[i].X, pub.PubKeys[i].Y, b.Bytes())
+        sharedKey := group.Mult(pub.PubKeys[i], b)
         // Hash this and it's a new label
         labelValue := i % 2
         inputPair := i / 2
-        byte_stream := computeHashI(curve, bG, sharedKey)
+        byte_stream := computeHashI(group, bG, sharedKey)
         allLabels[inputPair].WireLabelPair[labelValue] = byte_stream[:toygarble.LABEL_LEN_BYTES]
     }
 
     return allLabels
 }
 
-func writeCompactDHShare(curve elliptic.Curve, bG *GroupElement, buffer *bytes.Buffer) {
-    sizeOfInts := curve.Params().P.BitLen()
-    xCoord := make([]byte, sizeOfInts)
-    yCoord := make([]byte, sizeOfInts)
-    signX := 0
-    if bG.X.Sign() == -1 {
-        signX = 1
-    }
-    err := buffer.WriteByte(byte(signX))
-    check(err)
-    bG.X.FillBytes(xCoord)
-    _, err = buffer.Write(xCoord)
-    check(err)
-    
-    signY := 0
-    if bG.Y.Sign() == -1 {
-        signY = 1
-    }
-    err = buffer.WriteByte(byte(signY))
-    check(err)
-    bG.Y.FillBytes(yCoord)
-    _, err = buffer.Write(yCoord)
-    check(err)
+func checkGammaFR(gamma int) error {
+    if gamma < 1 || gamma > MAX_GAMMA_FR {
+        return fmt.Errorf("%w: gamma=%d, Fractional supports 1 to %d", ErrUnsupportedParameter, gamma, MAX_GAMMA_FR)
+    }
+    return nil
+}
+
+//
+// Build the circuit reducing a gamma+SECURITYPARAM bit random number mod the
+// gamma bit numerator. Its inputs are the random bits then the numerator bits,
+// least significant first. Flag and Test get it from a CircuitCache instead of
+// building it every time.
+func loadCircuit(MOD_SIZE int) (*toygarble.Circuit, error) {
+    if err := checkGammaFR(MOD_SIZE); err != nil {
+        return nil, err
+    }
+    return toygarble.GenerateModCircuit(MOD_SIZE + SECURITYPARAM, MOD_SIZE)
 }
 
-func (frac *Fractional) Flag(curve elliptic.Curve, random io.Reader, pk *PubKey) []byte {
-    // first, read in the correct bristol circuit
+func (frac *Fractional) Flag(group Group, random io.Reader, pk *PubKey) ([]byte, error) {
+    if err := validatePubKey(group, pk); err != nil {
+        return nil, err
+    }
+    if pk.NumKeys % 2 != 0 {
+        return nil, fmt.Errorf("%w: Fractional public key needs an even number of subkeys, got %d", ErrInvalidKey, pk.NumKeys)
+    }
+
     MOD_SIZE := pk.NumKeys / 2
-    circuit_idx := 0
-    if MOD_SIZE == 24 {
-        circuit_idx = 1
-    } 
-    f, err := os.Open(CIRCUITFILES[circuit_idx]) 
-    check(err)
-    circuit := toygarble.Circuit{}
-    if !toygarble.ParseBRISTOLCircuitFile(&circuit, f) {
-        panic("Unable to parse circuit file")
+    circuit, err := frac.circuits().Get(MOD_SIZE)
+    if err != nil {
+        return nil, err
+    }
+    garble, err := toygarble.NewGarbledCircuit(frac.garbling(), frac.gateCipher())
+    if err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrUnsupportedParameter, err)
     }
 
     // generate the input labels...
     // generate your DH Share
-    b, bG := keyGenSingle(curve, random)
-    
-    // garble the circuit and get back the input labels
-    var garble toygarble.SimpleGarbledCircuit
-    var src toygarble.CryptoSource
-    rnd := rand.New(src)
-    success := garble.GarbleCircuit(&circuit, rnd) 
+    b, bG, err := keyGenSingle(group, random)
+    if err != nil {
+        return nil, err
+    }
+
+    // garble the circuit and get back the input labels, with the same
+    // randomness as everything else so a flag is reproducible from it
+    success := garble.GarbleCircuit(circuit, random)
     if !success {
-        fmt.Printf("Could not garble circuit")
-        return nil
+        return nil, errors.New("could not garble circuit")
     }
 
-    // ciphertext output: 
+    // ciphertext output, framed as described in encoding.go:
     // [DH Share][Encrypted Labels][Unencrypted Labels corresponding to random number ][Garbled Circuit]
-    ctBuff := new(bytes.Buffer)
-    writeCompactDHShare(curve, bG, ctBuff)
+    flag := &fractionalFlag{group: group, gamma: MOD_SIZE, circuitID: CIRCUIT_GENERATED_MOD, garbling: frac.garbling(), cipher: frac.gateCipher()}
+    flag.share = group.Encode(bG)
 
-    inputPads := generateAnonKeyStream(curve, pk, b, bG, random, MOD_SIZE)
+    ctBuff := new(bytes.Buffer)
+    wireLabels := garble.GetInputWireLabels()
+    inputPads := generateAnonKeyStream(group, pk, b, bG, random, MOD_SIZE)
     for i := 0; i < MOD_SIZE; i++ {
         for j := 0; j < 2; j++ {
-            idx := garble.NumInputWires - MOD_SIZE
-            cipher_text := garble.WireLabels[idx+i].WireLabelPair[j]
+            // encrypted in place, so the input labels the simple scheme
+            // packs with its circuit are the encrypted ones
+            idx := circuit.NumInputWires - MOD_SIZE
+            cipher_text := wireLabels[idx+i].WireLabelPair[j]
             for k := 0; k < toygarble.LABEL_LEN_BYTES; k++ {
                 cipher_text[k] = cipher_text[k] ^ inputPads[i].WireLabelPair[j][k]
             }
-            num, err := ctBuff.Write(cipher_text)
-            check(err)
-            if num != toygarble.LABEL_LEN_BYTES {
-	        fmt.Printf("Can't write into the buffer!!")
-	        return nil
-            }
+            ctBuff.Write(cipher_text)
         }
     }
+    flag.encLabels = ctBuff.Bytes()
 
-    randomInput := make([]byte, 16)
+    randomInput := make([]byte, (circuit.NumInputWires - MOD_SIZE + 7) / 8)
     _, err = io.ReadFull(random, randomInput)
-    check(err)
+    if err != nil {
+        return nil, err
+    }
 
     randomNumber := big.NewInt(0).SetBytes(randomInput)
+    ctBuff = new(bytes.Buffer)
     for i := 0; i < circuit.NumInputWires - MOD_SIZE; i++ {
         bit := randomNumber.Bit(i)
-        num, err := ctBuff.Write(garble.WireLabels[i].WireLabelPair[bit]) 
-        check(err)
-        if num != toygarble.LABEL_LEN_BYTES {
-            fmt.Printf("Can't write into the buffer!!")
-            return nil
-        }
+        ctBuff.Write(wireLabels[i].WireLabelPair[bit])
     }
-    _, err = ctBuff.Write(garble.PackedMarshal())
-    check(err)
-    return ctBuff.Bytes()
+    flag.plainLabels = ctBuff.Bytes()
+    flag.garbled = garble.PackedMarshal()
+    return flag.marshal(), nil
 }
-// the interface here is a little mixed up between
-// types and not intuitive....
-func (frac *Fractional) Extract(numerator int, priv *SecKey) (dsk *SecKey) {
+//
+// Extract a dsk that flags with probability p. The rate has to be exactly
+// numerator / 2^gamma with numerator < 2^gamma, anything else is rejected with
+// ErrProbabilityNotRepresentable.
+func (frac *Fractional) Extract(p Probability, priv *SecKey) (dsk *SecKey, err error) {
+    if err = validateSecKey(nil, priv); err != nil {
+        return nil, err
+    }
+    if err = checkKeyKind(priv, SchemeFractional, keyKindSecret); err != nil {
+        return nil, err
+    }
     MOD_SIZE := priv.numKeys / 2
+    scaled, err := p.scaleTo(MOD_SIZE)
+    if err != nil {
+        return nil, err
+    }
     // is the numerator bigger than the modulus
-    if numerator < 0 || numerator >= int(math.Pow(float64(2),float64(MOD_SIZE))) {
-        return nil
+    if scaled >= uint64(1) << uint(MOD_SIZE) {
+        return nil, fmt.Errorf("%w: %v is out of range for gamma=%d", ErrProbabilityNotRepresentable, p, MOD_SIZE)
     }
+    numerator := int(scaled)
     dsk = new(SecKey)
+    dsk.scheme, dsk.group, dsk.gamma, dsk.detection = priv.scheme, priv.group, MOD_SIZE, true
     dsk.numKeys = MOD_SIZE
-    dsk.secKeys = make([]*big.Int, MOD_SIZE)
+    dsk.secKeys = make([]Scalar, MOD_SIZE)
     dsk.prob = uint32(numerator)
     // interpret numKeys as a bit string and give up keys
     for i := 0; i < MOD_SIZE; i++ {
-        // WARNING: bit selector here might be flipped so you'll want to check this 
+        // bit i of the numerator goes to modulus input wire i (LSB first),
+        // TestFalsePositiveRateFR catches it if this is the wrong way round
         bitSelector := (numerator >> i) & 1
         if bitSelector == 1 {
             dsk.secKeys[i] = priv.secKeys[2*i+1]
-        } else { 
+        } else {
             dsk.secKeys[i] = priv.secKeys[2*i]
         }
     }
@@ -202,108 +241,122 @@ func (frac *Fractional) Extract(numerator int, priv *SecKey) (dsk *SecKey) {
     return
 }
 
-func decodeCompactDHShare(curve elliptic.Curve, el *GroupElement, buffer *bytes.Buffer) {
-    fieldSize := curve.Params().P.BitLen()
-
-    xCoord := make([]byte, fieldSize)
-    signX, err := buffer.ReadByte()
-    check(err)
-
-    _, err = buffer.Read(xCoord)
-    check(err)
-    el.X = big.NewInt(0).SetBytes(xCoord)
-
-    if signX == 1 {
-        el.X.Neg(el.X)
+//
+// Decode the DH share of a flag, which is the group's canonical encoding (a
+// SEC1 compressed point on the NIST curves). Decode only accepts points in the
+// group, the identity is refused on top of that since a share of it would make
+// every shared key the identity as well.
+func decodeDHShare(group Group, enc []byte) (Element, error) {
+    share, err := group.Decode(enc)
+    if err != nil {
+        return nil, fmt.Errorf("DH share: %v", err)
     }
-
-    yCoord := make([]byte, fieldSize)
-    signY, err := buffer.ReadByte()
-    check(err)
-
-    _, err = buffer.Read(yCoord)
-    check(err)
-    el.Y = big.NewInt(0).SetBytes(yCoord)
-    
-    if signY == 1 {
-        el.Y.Neg(el.Y)
+    if isIdentity(group, share) {
+        return nil, errors.New("DH share is the identity")
     }
+    return share, nil
 }
 
-func (frac *Fractional) Test(curve elliptic.Curve, ctBytes []byte, priv *SecKey) bool {
-    // first, read in the correct bristol circuit
+func (frac *Fractional) Test(group Group, ctBytes []byte, priv *SecKey) (bool, error) {
+    if err := validateSecKey(group, priv); err != nil {
+        return false, err
+    }
+    if err := checkKeyKind(priv, SchemeFractional, keyKindDetection); err != nil {
+        return false, err
+    }
     MOD_SIZE := priv.numKeys
-    if MOD_SIZE != 8 && MOD_SIZE != 24 {
-        return false
+    circuit, err := frac.circuits().Get(MOD_SIZE)
+    if err != nil {
+        return false, err
+    }
+
+    flag, err := parseFractionalFlag(ctBytes)
+    if err != nil {
+        return false, err
     }
-    circuit_idx := 0
-    if MOD_SIZE == 24 {
-        circuit_idx = 1
+    if flag.group.ID() != group.ID() {
+        return false, fmt.Errorf("%w: flag is for group %s", ErrMalformedFlag, flag.group.Name())
     }
-    f, err := os.Open(CIRCUITFILES[circuit_idx]) 
-    check(err)
-    circuit := toygarble.Circuit{}
-    if !toygarble.ParseBRISTOLCircuitFile(&circuit, f) {
-        panic("Unable to parse circuit file")
+    if flag.gamma != MOD_SIZE {
+        return false, fmt.Errorf("%w: flag is for gamma=%d but the key is for gamma=%d", ErrMalformedFlag, flag.gamma, MOD_SIZE)
     }
 
-    // marshal the ciphertext correctly
-    // CT: DH Share || Encrypted Labels || Labels for other input || Garbled Circuit
-    ctBuff := bytes.NewBuffer(ctBytes)
-    var otherShare GroupElement
-    decodeCompactDHShare(curve, &otherShare, ctBuff)
+    otherShare, err := decodeDHShare(group, flag.share)
+    if err != nil {
+        return false, fmt.Errorf("%w: %v", ErrMalformedFlag, err)
+    }
 
-    // decrypt the labels corresponding to the secret key you hold 
+    ctBuff := bytes.NewBuffer(flag.encLabels)
+    // decrypt the labels corresponding to the secret key you hold
     inputLabels := make([]toygarble.Label_t, circuit.NumInputWires)
     allModLabels := make([]toygarble.SimpleWireLabelSet, MOD_SIZE)
     for i := 0; i<MOD_SIZE; i++ {
         for j := 0; j<2; j++ {
             label := make([]byte, toygarble.LABEL_LEN_BYTES)
-            _, err = ctBuff.Read(label)
-            check(err)
+            _, err = io.ReadFull(ctBuff, label)
+            if err != nil {
+                return false, fmt.Errorf("%w: encrypted labels: %v", ErrMalformedFlag, err)
+            }
             allModLabels[i].WireLabelPair[j] = label
         }
     }
     for i := circuit.NumInputWires - MOD_SIZE; i < circuit.NumInputWires; i++ {
-        var sharedKey GroupElement
         idx := i - (circuit.NumInputWires - MOD_SIZE)
-        sharedKey.X, sharedKey.Y = curve.ScalarMult(otherShare.X, otherShare.Y, priv.secKeys[idx].Bytes())
-        byte_stream := computeHashI(curve, &otherShare, &sharedKey)
+        sharedKey := group.Mult(otherShare, priv.secKeys[idx])
+        byte_stream := computeHashI(group, otherShare, sharedKey)
         inputLabels[i] = byte_stream[:toygarble.LABEL_LEN_BYTES]
         wireChoice := (priv.prob >> idx) & 1
         // decrypt the right label
         for j := 0; j < toygarble.LABEL_LEN_BYTES; j++ {
             inputLabels[i][j] = inputLabels[i][j] ^ allModLabels[idx].WireLabelPair[wireChoice][j]
-        } 
+        }
     }
 
+    ctBuff = bytes.NewBuffer(flag.plainLabels)
     for i := 0; i < circuit.NumInputWires - MOD_SIZE; i++ {
         label := make([]byte, toygarble.LABEL_LEN_BYTES)
-        _, err = ctBuff.Read(label)
-        check(err)
+        _, err = io.ReadFull(ctBuff, label)
+        if err != nil {
+            return false, fmt.Errorf("%w: plaintext labels: %v", ErrMalformedFlag, err)
+        }
         inputLabels[i] = label
     }
 
-    garb := new(toygarble.SimpleGarbledCircuit)
-    ctGCBytes := ctBuff.Bytes()
-    err = garb.PackedUnmarshal(ctGCBytes, &circuit)
-    check(err)
-    evalCheck, output := garb.EvaluateCircuit(&circuit, inputLabels)
+    garb, _ := toygarble.NewGarbledCircuit(flag.garbling, flag.cipher)
+    err = garb.PackedUnmarshal(flag.garbled, circuit)
+    if err != nil {
+        return false, fmt.Errorf("%w: garbled circuit: %v", ErrMalformedFlag, err)
+    }
+    evalCheck, output := garb.EvaluateCircuit(circuit, inputLabels)
     if !evalCheck {
-        return false
+        return false, fmt.Errorf("%w: garbled circuit could not be evaluated", ErrMalformedFlag)
     }
     // check if the value is less than it should be
-    output_str := toygarble.DecodePlaintextOutputLabels(output)
+    output_str, err := garb.DecodeOutputLabels(output)
+    if err != nil {
+        return false, fmt.Errorf("%w: circuit output: %v", ErrMalformedFlag, err)
+    }
     numAsInt, err := strconv.ParseUint(output_str,2,MOD_SIZE)
-    check(err)
-    return uint32(numAsInt) < priv.prob 
+    if err != nil {
+        return false, fmt.Errorf("%w: circuit output: %v", ErrMalformedFlag, err)
+    }
+    return uint32(numAsInt) < priv.prob, nil
 }
 
-func (frac *Fractional) JsonifySK(sk *SecKey) []byte {
-    return nil
+//
+// Serialize a secret or detection key as a PEM block (see SecKey.MarshalText)
+func (frac *Fractional) JsonifySK(sk *SecKey) ([]byte, error) {
+    if err := validateSecKey(nil, sk); err != nil {
+        return nil, err
+    }
+    if sk.scheme != SchemeFractional {
+        return nil, fmt.Errorf("%w: not a Fractional key", ErrInvalidKey)
+    }
+    return sk.MarshalText()
 }
 
-func (frac *Fractional) MarshalSK(fname string) *SecKey {
-    return nil
+//
+// Read a key written by JsonifySK
+func (frac *Fractional) MarshalSK(fname string) (*SecKey, error) {
+    return readSKFile(fname, SchemeFractional)
 }
-
@@ -1,10 +1,13 @@
 package fuzzycrypto
 
 import (
+    "bytes"
     "testing"
-    "crypto/elliptic"
     "crypto/rand"
+    "encoding/json"
+    "errors"
     "fmt"
+    "math/big"
 )
 
 const NUM_TOTAL_KEYS = 24
@@ -15,117 +18,482 @@ const NUM_EXTRACT_LARGE = 15
 func BenchmarkKeygenEG(b *testing.B) {
     var testB *ElGamalPower2
     for n := 0; n < b.N; n++ {
-        testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+        _, _, err := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+        if err != nil {
+            b.Fatal(err)
+        }
     }
 }
 
 func BenchmarkEncryptEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = sk
     
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
+        ctext, _ := testB.Flag(P256(), rand.Reader, pk)
         _ = ctext
     }
 }
 
 func BenchmarkExtractSmallEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
     
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        dsk := testB.Extract(NUM_EXTRACT_SMALL, sk)
+        dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), sk)
         _ = dsk
     }
 }
 
 func BenchmarkExtractMedEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
     
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        dsk := testB.Extract(NUM_EXTRACT_MED, sk)
+        dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_MED), sk)
         _ = dsk
     }
 }
 
 func BenchmarkExtractLargeEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
     
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        dsk := testB.Extract(NUM_EXTRACT_LARGE, sk)
+        dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
         _ = dsk
     }
 }
 
 func BenchmarkTestSmallEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testB.Extract(NUM_EXTRACT_SMALL, sk)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), sk)
 
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Test(elliptic.P256(), ctext, dsk)
+        testB.Test(P256(), ctext, dsk)
     }
 }
 
 func BenchmarkTestMedEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testB.Extract(NUM_EXTRACT_MED, sk)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_MED), sk)
 
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Test(elliptic.P256(), ctext, dsk)
+        testB.Test(P256(), ctext, dsk)
     }
 }
 
 func BenchmarkTestLargeEG(b *testing.B) {
     var testB *ElGamalPower2
-    sk, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
     _ = pk
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testB.Extract(NUM_EXTRACT_LARGE, sk)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
 
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Test(elliptic.P256(), ctext, dsk)
+        testB.Test(P256(), ctext, dsk)
     }
 }
 
+// A server's worth of detection keys, only the first of which belongs to the flag's recipient
+const NUM_BATCH_KEYS = 100
+
+func batchSetupEG(tb testing.TB) ([]byte, []*SecKey) {
+    var testB *ElGamalPower2
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    flag, err := testB.Flag(P256(), rand.Reader, pk)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    keys := make([]*SecKey, NUM_BATCH_KEYS)
+    keys[0], _ = testB.Extract(Pow2Probability(NUM_EXTRACT_MED), sk)
+    for i := 1; i < NUM_BATCH_KEYS; i++ {
+        other, _, _ := testB.KeyGen(P256(), NUM_EXTRACT_MED, rand.Reader)
+        keys[i], _ = testB.Extract(Pow2Probability(NUM_EXTRACT_MED), other)
+    }
+    return flag, keys
+}
+
+// The current way of doing things: one Test call per key
+func BenchmarkTestLoopEG(b *testing.B) {
+    var testB *ElGamalPower2
+    flag, keys := batchSetupEG(b)
+
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        for _, dsk := range keys {
+            testB.Test(P256(), flag, dsk)
+        }
+    }
+}
+
+func BenchmarkTestBatchEG(b *testing.B) {
+    var testB *ElGamalPower2
+    flag, keys := batchSetupEG(b)
+
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        testB.TestBatch(P256(), flag, keys)
+    }
+}
+
+// TestBatch must agree with calling Test on every key
+func TestBatchEG(t * testing.T) {
+    var testB *ElGamalPower2
+    flag, keys := batchSetupEG(t)
+
+    results, err := testB.TestBatch(P256(), flag, keys)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != len(keys) {
+        t.Fatalf("got %d results for %d keys", len(results), len(keys))
+    }
+    if !results[0] {
+        t.Errorf("recipient's key rejected its own flag")
+    }
+    pf, err := testB.PrepareFlag(P256(), flag)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, dsk := range keys {
+        single, _ := testB.Test(P256(), flag, dsk)
+        prepared, _ := pf.Test(dsk)
+        if single != results[i] || prepared != results[i] {
+            t.Errorf("key %d: Test=%t PreparedFlag.Test=%t TestBatch=%t", i, single, prepared, results[i])
+        }
+    }
+
+    if _, err := testB.TestBatch(P256(), flag[:10], keys); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("TestBatch on truncated flag: got %v", err)
+    }
+    if _, err := testB.TestBatch(P256(), flag, []*SecKey{keys[0], nil}); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("TestBatch with a nil key: got %v", err)
+    }
+    if results, err := testB.TestBatch(P256(), flag, nil); err != nil || len(results) != 0 {
+        t.Errorf("TestBatch with no keys: got %v, %v", results, err)
+    }
+}
+
+// Both test modes must give the same answers, they only differ in how much work they do
+func TestModesEG(t * testing.T) {
+    fast := &ElGamalPower2{Mode: TestFast}
+    ct := &ElGamalPower2{Mode: TestConstantTime}
+    flag, keys := batchSetupEG(t)
+
+    fastResults, err := fast.TestBatch(P256(), flag, keys)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctResults, err := ct.TestBatch(P256(), flag, keys)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := range keys {
+        single, _ := ct.Test(P256(), flag, keys[i])
+        if fastResults[i] != ctResults[i] || single != ctResults[i] {
+            t.Errorf("key %d: fast=%t constant time=%t", i, fastResults[i], ctResults[i])
+        }
+    }
+    if !ctResults[0] {
+        t.Errorf("constant time mode rejected the recipient's key")
+    }
+
+    unknown := &ElGamalPower2{Mode: TestMode(42)}
+    if _, err := unknown.Test(P256(), flag, keys[0]); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("Test with unknown mode: got %v", err)
+    }
+}
+
+func benchmarkWrongKeyEG(b *testing.B, mode TestMode) {
+    testB := &ElGamalPower2{Mode: mode}
+    _, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk, _, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
+
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        testB.Test(P256(), ctext, dsk)
+    }
+}
+
+// Rejecting a flag that isn't ours, which is what a server does almost all the time
+func BenchmarkTestWrongKeyFastEG(b *testing.B) {
+    benchmarkWrongKeyEG(b, TestFast)
+}
+
+func BenchmarkTestWrongKeyConstantTimeEG(b *testing.B) {
+    benchmarkWrongKeyEG(b, TestConstantTime)
+}
+
 func TestFindTheoreticalCTSize(t * testing.T) {
     var testB *ElGamalPower2
-    _, pk := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
-    
-    ctext := testB.TheoreticalFlag(elliptic.P256(), rand.Reader, pk)
-    len := efficientSerializeMeasure(elliptic.P256(),ctext)
-    fmt.Printf("Length of el gamal text would be: %d\n", len) 
+    _, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+
+    ctext, err := testB.TheoreticalFlag(P256(), rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    len := efficientSerializeMeasure(P256(),ctext)
+    fmt.Printf("Length of el gamal text would be: %d\n", len)
 }
 
 func TestWrongFlagEG(t * testing.T) {
     var testB *ElGamalPower2
-    _, pk0 := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
-    sk1,_ := testB.KeyGen(elliptic.P256(), NUM_TOTAL_KEYS, rand.Reader)
-    dsk1 := testB.Extract(NUM_TOTAL_KEYS-1, sk1)
+    _, pk0, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    sk1, _, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    dsk1, _ := testB.Extract(Pow2Probability(NUM_TOTAL_KEYS-1), sk1)
     // notice this isn't a guarantee but it should work
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk0) 
+    ctext, err := testB.Flag(P256(), rand.Reader, pk0)
+    if err != nil {
+        t.Fatal(err)
+    }
     if len(ctext) == 0 {
         t.Errorf("Something went wrong -- ciphertext length is 0")
     }
-    if testB.Test(elliptic.P256(), ctext, dsk1) {
+    res, err := testB.Test(P256(), ctext, dsk1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if res {
         t.Errorf("Unlikely event occurred -- dsk1 succeeded on ct intended for pk0 where dsk1 had prob. 1/2^%d of passing", NUM_TOTAL_KEYS-1)
     }
 }
+
+func TestCorrectFlagEG(t * testing.T) {
+    var testB *ElGamalPower2
+    sk, pk, _ := testB.KeyGen(P256(), NUM_TOTAL_KEYS, rand.Reader)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    res, err := testB.Test(P256(), ctext, dsk)
+    if err != nil || !res {
+        t.Errorf("dsk rejected a flag addressed to it: %v", err)
+    }
+}
+
+// Same scheme over ristretto255: flags round trip in both encodings and are
+// rejected by unrelated keys
+func TestRistrettoEG(t * testing.T) {
+    group := Ristretto255()
+    for _, scheme := range []*ElGamalPower2{nil, {DebugJSON: true}, {Mode: TestConstantTime}} {
+        sk, pk, err := scheme.KeyGen(group, NUM_TOTAL_KEYS, rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+        other, _, _ := scheme.KeyGen(group, NUM_TOTAL_KEYS, rand.Reader)
+        dsk, _ := scheme.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
+        otherDsk, _ := scheme.Extract(Pow2Probability(NUM_EXTRACT_LARGE), other)
+
+        flag, err := scheme.Flag(group, rand.Reader, pk)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !scheme.debugJSON() && len(flag) != 2+32+32+3 {
+            t.Errorf("expected a %d byte flag, got %d", 2+32+32+3, len(flag))
+        }
+        if res, err := scheme.Test(group, flag, dsk); err != nil || !res {
+            t.Errorf("dsk rejected a flag addressed to it: %v", err)
+        }
+        if res, err := scheme.Test(group, flag, otherDsk); err != nil || res {
+            t.Errorf("Unlikely event occurred -- unrelated dsk with prob. 1/2^%d accepted the flag: %v", NUM_EXTRACT_LARGE, err)
+        }
+        if _, err := scheme.Test(P256(), flag, dsk); err == nil {
+            t.Errorf("ristretto255 flag was tested as a P-256 flag")
+        }
+    }
+}
+
+// Every bad input has to come back as an error instead of a panic
+func TestErrorsEG(t * testing.T) {
+    var testB *ElGamalPower2
+    group := P256()
+
+    if _, _, err := testB.KeyGen(group, 0, rand.Reader); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("KeyGen with 0 keys: got %v", err)
+    }
+    if _, _, err := testB.KeyGen(group, NUM_TOTAL_KEYS, bytes.NewReader(nil)); err == nil {
+        t.Errorf("KeyGen with an empty random source should fail")
+    }
+
+    sk, pk, _ := testB.KeyGen(group, NUM_TOTAL_KEYS, rand.Reader)
+    if _, err := testB.Extract(Pow2Probability(NUM_TOTAL_KEYS+1), sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract more keys than exist: got %v", err)
+    }
+    if _, err := testB.Extract(Probability{3, 4}, sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract a rate that is not a power of 2: got %v", err)
+    }
+    if _, err := testB.Extract(Pow2Probability(1), nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Extract from nil key: got %v", err)
+    }
+    if _, err := testB.Extract(Probability{1, 0}, sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract with zero denominator: got %v", err)
+    }
+    if dsk, err := testB.Extract(Probability{2, 8}, sk); err != nil || dsk.numKeys != 2 {
+        t.Errorf("Extract 2/8 should give the same key as 1/4: got %v", err)
+    }
+
+    if _, err := testB.Flag(group, rand.Reader, nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Flag with nil key: got %v", err)
+    }
+    badPk := &PubKey{NumKeys: 1, PubKeys: []Element{&GroupElement{X: big.NewInt(1), Y: big.NewInt(1)}}}
+    if _, err := testB.Flag(group, rand.Reader, badPk); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Flag with off-curve key: got %v", err)
+    }
+    if _, err := testB.Flag(group, bytes.NewReader(nil), pk); err == nil {
+        t.Errorf("Flag with an empty random source should fail")
+    }
+
+    dsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), sk)
+    ctext, _ := testB.TheoreticalFlag(group, rand.Reader, pk)
+    flag, _ := ctext.MarshalBinary()
+    corrupt := func(idx int, val byte) []byte {
+        bad := append([]byte{}, flag...)
+        bad[idx] = val
+        return bad
+    }
+    if _, err := testB.Test(group, []byte("not a flag"), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on garbage: got %v", err)
+    }
+    if _, err := testB.Test(group, nil, dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on empty flag: got %v", err)
+    }
+    if _, err := testB.Test(group, corrupt(0, FLAG_ENCODING_VERSION+1), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on unknown version: got %v", err)
+    }
+    if _, err := testB.Test(group, corrupt(1, 0xff), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on unknown group: got %v", err)
+    }
+    if _, err := testB.Test(group, corrupt(1, GroupP384), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on flag for the wrong group: got %v", err)
+    }
+    if _, err := testB.Test(Ristretto255(), flag, dsk); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Test with a key from another group: got %v", err)
+    }
+    if _, err := testB.Test(group, corrupt(2, 0x04), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on uncompressed U: got %v", err)
+    }
+    if _, err := testB.Test(group, flag[:2+33+32], dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on flag without a bit vector: got %v", err)
+    }
+    bigY := append([]byte{}, flag...)
+    for i := 2+33; i < 2+33+32; i++ {
+        bigY[i] = 0xff
+    }
+    if _, err := testB.Test(group, bigY, dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on unreduced Y: got %v", err)
+    }
+    largeDsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_LARGE), sk)
+    if _, err := testB.Test(group, flag[:2+33+32+1], largeDsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on short bit vector: got %v", err)
+    }
+    if _, err := testB.Test(group, flag, nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Test with nil key: got %v", err)
+    }
+
+    // The JSON debug encoding has to be just as strict
+    debug := &ElGamalPower2{DebugJSON: true}
+    if _, err := debug.Test(group, flag, dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("JSON Test on a binary flag: got %v", err)
+    }
+    if _, err := debug.Test(group, []byte("{}"), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("JSON Test on empty flag: got %v", err)
+    }
+    good := ciphertextJSON{group.Name(), group.Encode(ctext.U), ctext.BitVec, group.EncodeScalar(ctext.Y)}
+    if _, err := debug.Test(group, mustMarshal(t, good), dsk); err != nil {
+        t.Errorf("JSON Test on a valid flag: got %v", err)
+    }
+    wrongGroup := good
+    wrongGroup.Group = Ristretto255().Name()
+    if _, err := debug.Test(group, mustMarshal(t, wrongGroup), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("JSON Test on flag for the wrong group: got %v", err)
+    }
+    offCurve := good
+    offCurve.U = append([]byte{0x04}, good.U[1:]...)
+    if _, err := debug.Test(group, mustMarshal(t, offCurve), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("JSON Test on invalid U: got %v", err)
+    }
+    unreduced := good
+    unreduced.Y = bigY[2+33:2+33+32]
+    if _, err := debug.Test(group, mustMarshal(t, unreduced), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("JSON Test on unreduced Y: got %v", err)
+    }
+
+    // Y of the wrong length, over ristretto255 too since its scalar decoder
+    // panics on those
+    for _, g := range []Group{group, Ristretto255()} {
+        gsk, gpk, _ := testB.KeyGen(g, NUM_TOTAL_KEYS, rand.Reader)
+        gdsk, _ := testB.Extract(Pow2Probability(NUM_EXTRACT_SMALL), gsk)
+        gctext, _ := testB.TheoreticalFlag(g, rand.Reader, gpk)
+        y := g.EncodeScalar(gctext.Y)
+        for _, badY := range [][]byte{y[:len(y)-1], append(append([]byte{}, y...), 0)} {
+            wrongLen := ciphertextJSON{g.Name(), g.Encode(gctext.U), gctext.BitVec, badY}
+            if _, err := debug.Test(g, mustMarshal(t, wrongLen), gdsk); !errors.Is(err, ErrMalformedFlag) {
+                t.Errorf("JSON Test on %d byte Y over %s: got %v", len(badY), g.Name(), err)
+            }
+        }
+    }
+}
+
+// Flags should be the compact binary encoding by default and survive a round trip
+func TestFlagEncodingEG(t * testing.T) {
+    var testB *ElGamalPower2
+    group := P256()
+    sk, pk, _ := testB.KeyGen(group, NUM_TOTAL_KEYS, rand.Reader)
+    dsk, _ := testB.Extract(Pow2Probability(NUM_TOTAL_KEYS), sk)
+
+    flag, err := testB.Flag(group, rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(flag) != 2 + 33 + 32 + NUM_TOTAL_KEYS / 8 {
+        t.Errorf("binary flag is %d bytes", len(flag))
+    }
+
+    var ctext Ciphertext
+    if err := ctext.UnmarshalBinary(flag); err != nil {
+        t.Fatal(err)
+    }
+    again, err := ctext.MarshalBinary()
+    if err != nil || !bytes.Equal(flag, again) {
+        t.Errorf("binary encoding did not round trip: %v", err)
+    }
+    if res, err := testB.Test(group, flag, dsk); err != nil || !res {
+        t.Errorf("binary flag was rejected: %v", err)
+    }
+
+    debug := &ElGamalPower2{DebugJSON: true}
+    jsonFlag, err := debug.Flag(group, rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if res, err := debug.Test(group, jsonFlag, dsk); err != nil || !res {
+        t.Errorf("JSON flag was rejected: %v", err)
+    }
+    fmt.Printf("FMD2 flag size: binary %d bytes, JSON %d bytes\n", len(flag), len(jsonFlag))
+}
+
+func mustMarshal(t *testing.T, ctext ciphertextJSON) []byte {
+    b, err := json.Marshal(ctext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
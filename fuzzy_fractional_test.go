@@ -1,11 +1,18 @@
 package fuzzycrypto
 
 import (
+    "bytes"
+    "errors"
     "testing"
-    "crypto/elliptic"
     "crypto/rand"
     "fmt"
-    mathRand "math/rand" //gotta be careful with this...
+    "io"
+    "math/big"
+    "os"
+    "strings"
+    mathRand "math/rand"
+
+    "github.com/becgabri/fuzzycrypto/toygarble" //gotta be careful with this...
 )
 
 const SMALL_CONSTANT int = 8 
@@ -20,7 +27,10 @@ func randomProb(mod int) int {
 // Can you keyGen?
 func TestKeyGenFR(t * testing.T) {
     var testT *Fractional
-    _, master_pk := testT.KeyGen(elliptic.P256(),8,rand.Reader) 
+    _, master_pk, err := testT.KeyGen(P256(),8,rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
     for idx, pk := range master_pk.PubKeys {
         if pk == nil {
             t.Errorf("Failure, index %d is a nil pointer", idx)
@@ -31,127 +41,730 @@ func TestKeyGenFR(t * testing.T) {
 // Can you flag?
 func TestFlagSmallFRAC(t *testing.T) {
     var testT *Fractional
-    _, pk := testT.KeyGen(elliptic.P256(), SMALL_CONSTANT, rand.Reader)
-    flag := testT.Flag(elliptic.P256(), rand.Reader, pk)
+    _, pk, _ := testT.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+    flag, err := testT.Flag(P256(), rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
     fmt.Printf("FLAG size for gamma=%d: %d\n",SMALL_CONSTANT, len(flag))
 }
 
 func TestFlagLargeFRAC(t *testing.T) {
     var testT *Fractional
-    _, pk := testT.KeyGen(elliptic.P256(), LARGE_CONSTANT, rand.Reader)
-    flag := testT.Flag(elliptic.P256(), rand.Reader, pk)
+    _, pk, _ := testT.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
+    flag, err := testT.Flag(P256(), rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
     fmt.Printf("FLAG size for gamma=%d: %d\n", LARGE_CONSTANT, len(flag))
 }
- 
+
 // Can you extract?
 func TestExtractFR(t *testing.T) {
     var testT *Fractional
-    sk, _ := testT.KeyGen(elliptic.P256(), 8, rand.Reader)
-    testT.Extract(56, sk)
+    sk, _, _ := testT.KeyGen(P256(), 8, rand.Reader)
+    if _, err := testT.Extract(Probability{56, 1 << 8}, sk); err != nil {
+        t.Fatal(err)
+    }
 }
 
 // Can you detect?
 func TestDetectFR(t *testing.T) {
     var testT *Fractional
-    sk, pk := testT.KeyGen(elliptic.P256(), 8, rand.Reader)
-    flag := testT.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testT.Extract(31, sk)
-    res := testT.Test(elliptic.P256(), flag, dsk)
+    sk, pk, _ := testT.KeyGen(P256(), 8, rand.Reader)
+    flag, _ := testT.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testT.Extract(Probability{31, 1 << 8}, sk)
+    res, err := testT.Test(P256(), flag, dsk)
+    if err != nil {
+        t.Fatal(err)
+    }
     if !res {
         t.Errorf("Incorrect result")
     }
 }
 
+func TestDetectRistrettoFR(t *testing.T) {
+    var testT *Fractional
+    sk, pk, _ := testT.KeyGen(Ristretto255(), 8, rand.Reader)
+    flag, err := testT.Flag(Ristretto255(), rand.Reader, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dsk, _ := testT.Extract(Probability{31, 1 << 8}, sk)
+    res, err := testT.Test(Ristretto255(), flag, dsk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !res {
+        t.Errorf("Incorrect result")
+    }
+}
+
+// Detection works for any gamma, not just the ones there used to be circuit files for
+func TestDetectAnyGammaFR(t *testing.T) {
+    var testT *Fractional
+    for _, gamma := range []int{1, 5, 13, MAX_GAMMA_FR} {
+        sk, pk, err := testT.KeyGen(P256(), gamma, rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+        flag, err := testT.Flag(P256(), rand.Reader, pk)
+        if err != nil {
+            t.Fatal(err)
+        }
+        dsk, _ := testT.Extract(Probability{1, 2}, sk)
+        res, err := testT.Test(P256(), flag, dsk)
+        if err != nil {
+            t.Fatalf("gamma=%d: %v", gamma, err)
+        }
+        if !res {
+            t.Errorf("gamma=%d: Incorrect result", gamma)
+        }
+    }
+}
+
+// The generated circuit computes the random number mod the numerator
+func TestModCircuitFR(t *testing.T) {
+    for _, gamma := range []int{1, 2, 3, SMALL_CONSTANT, LARGE_CONSTANT, MAX_GAMMA_FR} {
+        circuit, err := loadCircuit(gamma)
+        if err != nil {
+            t.Fatal(err)
+        }
+        randBits := gamma + SECURITYPARAM
+        if circuit.NumInputWires != randBits + gamma || circuit.NumOutputWires != gamma {
+            t.Fatalf("gamma=%d: circuit has %d inputs and %d outputs", gamma, circuit.NumInputWires, circuit.NumOutputWires)
+        }
+        for trial := 0; trial < 20; trial++ {
+            a, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), uint(randBits)))
+            b, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), uint(gamma)))
+            if trial == 0 {
+                // the numerator of a rate of 1 - 2^-gamma
+                b.Lsh(big.NewInt(1), uint(gamma)).Sub(b, big.NewInt(1))
+            }
+            if b.Sign() == 0 {
+                b.SetInt64(1)
+            }
+            inputs := make([]bool, 0, randBits + gamma)
+            for i := 0; i < randBits; i++ {
+                inputs = append(inputs, a.Bit(i) == 1)
+            }
+            for i := 0; i < gamma; i++ {
+                inputs = append(inputs, b.Bit(i) == 1)
+            }
+            ok, outputs := circuit.EvaluateCircuit(inputs)
+            if !ok {
+                t.Fatalf("gamma=%d: could not evaluate circuit", gamma)
+            }
+            got := new(big.Int)
+            for i := len(outputs) - 1; i >= 0; i-- {
+                got.Lsh(got, 1)
+                if outputs[i] {
+                    got.SetBit(got, 0, 1)
+                }
+            }
+            if want := new(big.Int).Mod(a, b); got.Cmp(want) != 0 {
+                t.Errorf("gamma=%d: %v mod %v = %v, want %v", gamma, a, b, got, want)
+            }
+        }
+    }
+}
+
 func TestIncorrectFlag(t *testing.T) {
     var testT *Fractional
-    _, pk := testT.KeyGen(elliptic.P256(), 8, rand.Reader)
-    sk,_ := testT.KeyGen(elliptic.P256(), 8, rand.Reader)
-    flag := testT.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testT.Extract(2, sk)
-    res := testT.Test(elliptic.P256(), flag, dsk)
+    _, pk, _ := testT.KeyGen(P256(), 8, rand.Reader)
+    sk, _, _ := testT.KeyGen(P256(), 8, rand.Reader)
+    flag, _ := testT.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testT.Extract(Probability{2, 1 << 8}, sk)
+    res, err := testT.Test(P256(), flag, dsk)
+    if err != nil {
+        t.Fatal(err)
+    }
     if res {
         t.Errorf("Incorrect result -- most likely")
     }
 }
 
+// Every bad input has to come back as an error instead of a panic
+func TestErrorsFR(t *testing.T) {
+    var testT *Fractional
+    group := P256()
+
+    for _, gamma := range []int{0, MAX_GAMMA_FR + 1} {
+        if _, _, err := testT.KeyGen(group, gamma, rand.Reader); !errors.Is(err, ErrUnsupportedParameter) {
+            t.Errorf("KeyGen with unsupported gamma %d: got %v", gamma, err)
+        }
+    }
+    if _, _, err := testT.KeyGen(group, SMALL_CONSTANT, bytes.NewReader(nil)); err == nil {
+        t.Errorf("KeyGen with an empty random source should fail")
+    }
+
+    sk, pk, _ := testT.KeyGen(group, SMALL_CONSTANT, rand.Reader)
+    if _, err := testT.Extract(Probability{1, 1}, sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract numerator too large: got %v", err)
+    }
+    if _, err := testT.Extract(Probability{2, 1}, sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract rate above 1: got %v", err)
+    }
+    if _, err := testT.Extract(Probability{1, 3}, sk); !errors.Is(err, ErrProbabilityNotRepresentable) {
+        t.Errorf("Extract rate that isn't k/2^gamma: got %v", err)
+    }
+    if dsk, err := testT.Extract(Probability{1, 4}, sk); err != nil || dsk.prob != 1 << (SMALL_CONSTANT-2) {
+        t.Errorf("Extract 1/4 should be scaled to 64/256: got %v", err)
+    }
+    if _, err := testT.Extract(Probability{1, 2}, nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Extract from nil key: got %v", err)
+    }
+
+    if _, err := testT.Flag(group, rand.Reader, nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Flag with nil key: got %v", err)
+    }
+    oddPk := &PubKey{NumKeys: 3, PubKeys: pk.PubKeys[:3]}
+    if _, err := testT.Flag(group, rand.Reader, oddPk); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Flag with odd number of subkeys: got %v", err)
+    }
+    var manyKeys []Element
+    for len(manyKeys) <= 2*MAX_GAMMA_FR {
+        manyKeys = append(manyKeys, pk.PubKeys...)
+    }
+    bigPk := &PubKey{NumKeys: 2*MAX_GAMMA_FR + 2, PubKeys: manyKeys[:2*MAX_GAMMA_FR + 2]}
+    if _, err := testT.Flag(group, rand.Reader, bigPk); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("Flag with unsupported gamma: got %v", err)
+    }
+    if _, err := testT.Flag(group, bytes.NewReader(nil), pk); err == nil {
+        t.Errorf("Flag with an empty random source should fail")
+    }
+
+    dsk, _ := testT.Extract(Probability{3, 1 << SMALL_CONSTANT}, sk)
+    flag, _ := testT.Flag(group, rand.Reader, pk)
+    if _, err := testT.Test(group, flag[:10], dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on truncated DH share: got %v", err)
+    }
+    // where the DH share starts, after the header and its length
+    at := fractionalFlagHeaderLen + 4
+    if share, err := group.Decode(flag[at:at + group.ElementLen()]); err != nil || !validElement(group, share) {
+        t.Errorf("flag doesn't hold a compressed point: %v", err)
+    }
+    // x = 2^256 - 1 is bigger than the field
+    offCurve := append([]byte{}, flag...)
+    for i := at + 1; i < at + group.ElementLen(); i++ {
+        offCurve[i] = 0xff
+    }
+    if _, err := testT.Test(group, offCurve, dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on off-curve DH share: got %v", err)
+    }
+    badPrefix := append([]byte{}, flag...)
+    badPrefix[at] = 0x04
+    if _, err := testT.Test(group, badPrefix, dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on DH share that isn't compressed: got %v", err)
+    }
+    rsk, rpk, _ := testT.KeyGen(Ristretto255(), SMALL_CONSTANT, rand.Reader)
+    rdsk, _ := testT.Extract(Probability{3, 1 << SMALL_CONSTANT}, rsk)
+    identity, _ := testT.Flag(Ristretto255(), rand.Reader, rpk)
+    copy(identity[at:], make([]byte, 32))
+    if _, err := testT.Test(Ristretto255(), identity, rdsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on identity DH share: got %v", err)
+    }
+    if _, err := testT.Test(group, flag[:len(flag)-1], dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on truncated garbled circuit: got %v", err)
+    }
+    if _, err := testT.Test(group, append(flag, 0), dsk); !errors.Is(err, ErrMalformedFlag) {
+        t.Errorf("Test on flag with trailing bytes: got %v", err)
+    }
+    if _, err := testT.Test(group, flag, nil); !errors.Is(err, ErrInvalidKey) {
+        t.Errorf("Test with nil key: got %v", err)
+    }
+    var manySecKeys []Scalar
+    for len(manySecKeys) <= MAX_GAMMA_FR {
+        manySecKeys = append(manySecKeys, sk.secKeys...)
+    }
+    bigDsk := &SecKey{numKeys: MAX_GAMMA_FR + 1, secKeys: manySecKeys[:MAX_GAMMA_FR + 1], scheme: SchemeFractional, gamma: MAX_GAMMA_FR + 1, detection: true}
+    if _, err := testT.Test(group, flag, bigDsk); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("Test with unsupported gamma: got %v", err)
+    }
+}
+
+// Keys of the other scheme, of the wrong kind or with the wrong number of
+// subkeys are ErrInvalidKey, not a result or a complaint about the flag
+func TestWrongKeysFR(t *testing.T) {
+    var testT *Fractional
+    var testB *ElGamalPower2
+    group := P256()
+
+    frSk, frPk, _ := testT.KeyGen(group, SMALL_CONSTANT, rand.Reader)
+    frDsk, _ := testT.Extract(Probability{1, 2}, frSk)
+    frFlag, _ := testT.Flag(group, rand.Reader, frPk)
+    egSk, egPk, _ := testB.KeyGen(group, SMALL_CONSTANT, rand.Reader)
+    egDsk, _ := testB.Extract(Pow2Probability(2), egSk)
+    egFlag, _ := testB.Flag(group, rand.Reader, egPk)
+    // half a Fractional secret key claims gamma but has gamma/2 pairs
+    frShort := *frSk
+    frShort.numKeys, frShort.secKeys = SMALL_CONSTANT, frSk.secKeys[:SMALL_CONSTANT]
+
+    cases := []struct {
+        name    string
+        run     func() error
+    }{
+        {"Fractional Extract from a detection key", func() error { _, err := testT.Extract(Probability{1, 2}, frDsk); return err }},
+        {"Fractional Extract from an ElGamalPower2 key", func() error { _, err := testT.Extract(Probability{1, 2}, egSk); return err }},
+        {"Fractional Extract from a key short of subkeys", func() error { _, err := testT.Extract(Probability{1, 2}, &frShort); return err }},
+        {"ElGamalPower2 Extract from a Fractional key", func() error { _, err := testB.Extract(Pow2Probability(1), frSk); return err }},
+        {"ElGamalPower2 Extract from a detection key", func() error { _, err := testB.Extract(Pow2Probability(1), egDsk); return err }},
+        {"Fractional Test with an ElGamalPower2 secret key", func() error { _, err := testT.Test(group, frFlag, egSk); return err }},
+        {"Fractional Test with an ElGamalPower2 detection key", func() error { _, err := testT.Test(group, frFlag, egDsk); return err }},
+        {"Fractional Test with a secret key", func() error { _, err := testT.Test(group, frFlag, frSk); return err }},
+        {"ElGamalPower2 Test with a Fractional detection key", func() error { _, err := testB.Test(group, egFlag, frDsk); return err }},
+        {"ElGamalPower2 TestBatch with a Fractional detection key", func() error { _, err := testB.TestBatch(group, egFlag, []*SecKey{egDsk, frDsk}); return err }},
+    }
+    for _, c := range cases {
+        if err := c.run(); !errors.Is(err, ErrInvalidKey) {
+            t.Errorf("%s: got %v", c.name, err)
+        }
+    }
+
+    // and the right keys still work
+    if _, err := testT.Test(group, frFlag, frDsk); err != nil {
+        t.Errorf("Fractional Test: %v", err)
+    }
+    if _, err := testB.Test(group, egFlag, egSk); err != nil {
+        t.Errorf("ElGamalPower2 Test with a secret key: %v", err)
+    }
+}
+
+var garblingSchemes = []toygarble.GarblingScheme{toygarble.GarblingSimple, toygarble.GarblingHalfGates}
+
+var gateCiphers = []toygarble.GateCipherID{toygarble.CipherBLAKE2b, toygarble.CipherFixedKeyAES}
+
+//
+// Garble circuit with scheme and cipher and check it evaluates to what it
+// computes in the clear on random inputs
+func checkGarbling(t *testing.T, name string, circuit *toygarble.Circuit, scheme toygarble.GarblingScheme, cipher toygarble.GateCipherID, trials int) {
+    t.Helper()
+    name = fmt.Sprintf("%s, %v", name, cipher)
+    for trial := 0; trial < trials; trial++ {
+        garbler, _ := toygarble.NewGarbledCircuit(scheme, cipher)
+        if !garbler.GarbleCircuit(circuit, rand.Reader) {
+            t.Fatalf("%s, %v: could not garble", name, scheme)
+        }
+        inputs := make([]bool, circuit.NumInputWires)
+        inputLabels := make([]toygarble.Label_t, circuit.NumInputWires)
+        for i, labels := range garbler.GetInputWireLabels() {
+            inputs[i] = randomProb(2) == 1
+            if inputs[i] {
+                inputLabels[i] = labels.WireLabelPair[1]
+            } else {
+                inputLabels[i] = labels.WireLabelPair[0]
+            }
+        }
+
+        evaluator, _ := toygarble.NewGarbledCircuit(scheme, cipher)
+        if err := evaluator.PackedUnmarshal(garbler.PackedMarshal(), circuit); err != nil {
+            t.Fatalf("%s, %v: %v", name, scheme, err)
+        }
+        ok, outLabels := evaluator.EvaluateCircuit(circuit, inputLabels)
+        if !ok {
+            t.Fatalf("%s, %v: could not evaluate", name, scheme)
+        }
+        got, err := evaluator.DecodeOutputLabels(outLabels)
+        if err != nil {
+            t.Fatalf("%s, %v: %v", name, scheme, err)
+        }
+        _, outputs := circuit.EvaluateCircuit(inputs)
+        want := ""
+        for _, bit := range outputs {
+            if bit {
+                want = "1" + want
+            } else {
+                want = "0" + want
+            }
+        }
+        if got != want {
+            t.Errorf("%s, %v: garbled output %s, plaintext output %s", name, scheme, got, want)
+        }
+    }
+}
+
+// Both garbling schemes evaluate the mod circuit to what it computes in the
+// clear, whichever cipher their tables are encrypted with
+func TestGarblingSchemesFR(t *testing.T) {
+    circuit, _ := loadCircuit(SMALL_CONSTANT)
+    for _, scheme := range garblingSchemes {
+        for _, cipher := range gateCiphers {
+            checkGarbling(t, "generated", circuit, scheme, cipher, 5)
+        }
+    }
+
+    // a detector doesn't need to know how the flag was garbled
+    var testT *Fractional
+    sk, pk, _ := testT.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+    dsk, _ := testT.Extract(Probability{1, 2}, sk)
+    for _, scheme := range garblingSchemes {
+        for _, cipher := range gateCiphers {
+            flag, err := (&Fractional{Garbling: scheme, GateCipher: cipher}).Flag(P256(), rand.Reader, pk)
+            if err != nil {
+                t.Fatalf("%v, %v: %v", scheme, cipher, err)
+            }
+            if res, err := testT.Test(P256(), flag, dsk); err != nil || !res {
+                t.Errorf("%v, %v: Test = %t, %v", scheme, cipher, res, err)
+            }
+        }
+    }
+    if _, err := (&Fractional{Garbling: 0xff}).Flag(P256(), rand.Reader, pk); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("unknown garbling scheme: got %v", err)
+    }
+    if _, err := (&Fractional{GateCipher: 0xff}).Flag(P256(), rand.Reader, pk); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("unknown gate cipher: got %v", err)
+    }
+}
+
+// The two ciphers, and different tweaks, give unrelated hashes of the same labels
+func TestGateCiphersFR(t *testing.T) {
+    a := make(toygarble.Label_t, toygarble.LABEL_LEN_BYTES)
+    b := make(toygarble.Label_t, toygarble.LABEL_LEN_BYTES)
+    rand.Read(a)
+    rand.Read(b)
+    seen := make(map[string]string)
+    for _, id := range gateCiphers {
+        cipher, err := toygarble.NewGateCipher(id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for tweak := uint64(0); tweak < 4; tweak++ {
+            for _, in2 := range []toygarble.Label_t{nil, b} {
+                h := cipher.Hash(a, in2, tweak)
+                if len(h) != toygarble.LABEL_LEN_BYTES {
+                    t.Fatalf("%v: %d byte hash", id, len(h))
+                }
+                if !bytes.Equal(h, cipher.Hash(a, in2, tweak)) {
+                    t.Errorf("%v: hash is not deterministic", id)
+                }
+                name := fmt.Sprintf("%v, tweak %d, two inputs %t", id, tweak, in2 != nil)
+                if other, ok := seen[string(h)]; ok {
+                    t.Errorf("%s and %s hash alike", name, other)
+                }
+                seen[string(h)] = name
+            }
+        }
+    }
+    if _, err := toygarble.NewGateCipher(0); err == nil {
+        t.Errorf("gate cipher 0 is not a cipher")
+    }
+}
+
+var legacyCircuitFiles = []string{"48Num8Mod.circ", "64Num24Mod.circ"}
+
+func parseLegacyCircuit(tb testing.TB, fname string) *toygarble.Circuit {
+    f, err := os.Open(fname)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    defer f.Close()
+    circuit, err := toygarble.ParseCircuit(f)
+    if err != nil {
+        tb.Fatalf("%s: %v", fname, err)
+    }
+    return circuit
+}
+
+// The CBMC-GC circuits the scheme used before the generated ones, full of INV
+// gates, still garble correctly
+func TestLegacyCircuitsFR(t *testing.T) {
+    for _, fname := range legacyCircuitFiles {
+        circuit := parseLegacyCircuit(t, fname)
+        for _, scheme := range garblingSchemes {
+            checkGarbling(t, fname, circuit, scheme, toygarble.CipherFixedKeyAES, 2)
+        }
+    }
+}
+
+// All of Flag's randomness comes from the reader it is given, garbling included
+func TestFlagReproducibleFR(t *testing.T) {
+    var testT *Fractional
+    _, pk, _ := testT.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+    first, err := testT.Flag(P256(), newSeededReader("reproducible flag"), pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, _ := testT.Flag(P256(), newSeededReader("reproducible flag"), pk)
+    if !bytes.Equal(first, second) {
+        t.Errorf("same randomness gave two different flags")
+    }
+    other, _ := testT.Flag(P256(), newSeededReader("another flag"), pk)
+    if bytes.Equal(first, other) {
+        t.Errorf("different randomness gave the same flag")
+    }
+
+    // a reader that runs dry while garbling is an error, not a crash
+    short := io.LimitReader(newSeededReader("short"), int64(P256().ScalarLen() + 64))
+    if _, err := testT.Flag(P256(), short, pk); err == nil {
+        t.Errorf("Flag with a reader that runs out should fail")
+    }
+}
+
+// The flag says what it is, anything that doesn't fit the key or doesn't add
+// up is a descriptive error
+func TestFlagContainerFR(t *testing.T) {
+    var testT *Fractional
+    group := P256()
+    sk, pk, _ := testT.KeyGen(group, SMALL_CONSTANT, rand.Reader)
+    dsk, _ := testT.Extract(Probability{3, 1 << SMALL_CONSTANT}, sk)
+    flag, _ := testT.Flag(group, rand.Reader, pk)
+
+    parsed, err := parseFractionalFlag(flag)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parsed.group.ID() != group.ID() || parsed.gamma != SMALL_CONSTANT || parsed.circuitID != CIRCUIT_GENERATED_MOD {
+        t.Errorf("header doesn't describe the flag: %s, gamma=%d, circuit %d", parsed.group.Name(), parsed.gamma, parsed.circuitID)
+    }
+    if !bytes.Equal(parsed.marshal(), flag) {
+        t.Errorf("flag did not round trip")
+    }
+
+    modified := func(f func(b []byte)) []byte {
+        b := append([]byte{}, flag...)
+        f(b)
+        return b
+    }
+    // the length of the encrypted labels
+    encLen := fractionalFlagHeaderLen + 4 + group.ElementLen()
+    cases := []struct {
+        name    string
+        flag    []byte
+    }{
+        {"empty flag", nil},
+        {"truncated header", flag[:fractionalFlagHeaderLen - 1]},
+        {"no sections", flag[:fractionalFlagHeaderLen]},
+        {"unknown version", modified(func(b []byte) { b[0] = FRACTIONAL_FLAG_VERSION + 1 })},
+        {"ElGamalPower2 flag", modified(func(b []byte) { b[1] = byte(SchemeElGamalPower2) })},
+        {"unknown group", modified(func(b []byte) { b[2] = 0xff })},
+        {"other group", modified(func(b []byte) { b[2] = GroupP384 })},
+        {"unsupported gamma", modified(func(b []byte) { b[3] = byte(MAX_GAMMA_FR + 1) })},
+        {"other gamma", modified(func(b []byte) { b[3] = byte(SMALL_CONSTANT + 1) })},
+        {"unknown circuit", modified(func(b []byte) { b[4] = 0xff })},
+        {"unknown garbling scheme", modified(func(b []byte) { b[5] = 0xff })},
+        {"other garbling scheme", modified(func(b []byte) { b[5] = byte(toygarble.GarblingSimple) })},
+        {"unknown gate cipher", modified(func(b []byte) { b[6] = 0xff })},
+        {"section longer than the flag", modified(func(b []byte) { b[encLen] = 0xff })},
+        {"short section", modified(func(b []byte) { b[encLen + 3]-- })},
+        {"truncated garbled circuit", flag[:len(flag) - 1]},
+        {"trailing bytes", append(append([]byte{}, flag...), 0)},
+    }
+    for _, c := range cases {
+        if _, err := testT.Test(group, c.flag, dsk); !errors.Is(err, ErrMalformedFlag) {
+            t.Errorf("%s: got %v", c.name, err)
+        }
+    }
+
+    // a detector for another gamma is told so rather than misreading the flag
+    sk16, _, _ := testT.KeyGen(group, 16, rand.Reader)
+    dsk16, _ := testT.Extract(Probability{3, 1 << 16}, sk16)
+    if _, err := testT.Test(group, flag, dsk16); !errors.Is(err, ErrMalformedFlag) || !strings.Contains(err.Error(), "gamma=8") {
+        t.Errorf("key for another gamma: got %v", err)
+    }
+}
+
+// A circuit is built once per gamma and shared, also between goroutines
+func TestCircuitCacheFR(t *testing.T) {
+    cache := NewCircuitCache()
+    first, err := cache.Get(SMALL_CONSTANT)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again, _ := cache.Get(SMALL_CONSTANT); again != first {
+        t.Errorf("circuit for gamma=%d was built twice", SMALL_CONSTANT)
+    }
+    if _, err := cache.Get(MAX_GAMMA_FR + 1); !errors.Is(err, ErrUnsupportedParameter) {
+        t.Errorf("unsupported gamma: got %v", err)
+    }
+    if len(cache.circuits) != 1 {
+        t.Errorf("cache holds %d circuits, expected 1", len(cache.circuits))
+    }
+
+    scheme := &Fractional{Circuits: NewCircuitCache()}
+    sk, pk, _ := scheme.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+    dsk, _ := scheme.Extract(Probability{1, 2}, sk)
+    errs := make(chan error, 4)
+    for i := 0; i < cap(errs); i++ {
+        go func() {
+            flag, err := scheme.Flag(P256(), rand.Reader, pk)
+            if err == nil {
+                var res bool
+                if res, err = scheme.Test(P256(), flag, dsk); err == nil && !res {
+                    err = errors.New("flag was not detected")
+                }
+            }
+            errs <- err
+        }()
+    }
+    for i := 0; i < cap(errs); i++ {
+        if err := <-errs; err != nil {
+            t.Error(err)
+        }
+    }
+}
+
 
 // All the benchmarks .....
 
+// What Flag and Test used to pay for the circuit every call, the cache hit
+// below is all they pay now
+func BenchmarkBuildCircuitLargeFRAC(b *testing.B) {
+    for n := 0; n < b.N; n++ {
+        loadCircuit(LARGE_CONSTANT)
+    }
+}
+
+func BenchmarkCachedCircuitLargeFRAC(b *testing.B) {
+    cache := NewCircuitCache()
+    cache.Get(LARGE_CONSTANT)
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        cache.Get(LARGE_CONSTANT)
+    }
+}
+
 
 func BenchmarkKeygenSmallFRAC(b *testing.B) {
     var testB *Fractional
     for n := 0; n < b.N; n++ {
-        testB.KeyGen(elliptic.P256(), SMALL_CONSTANT, rand.Reader)
+        testB.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
     }
 }
 
 func BenchmarkKeygenLargeFRAC(b *testing.B) {
     var testB *Fractional
     for n := 0; n < b.N; n++ {
-        testB.KeyGen(elliptic.P256(), LARGE_CONSTANT, rand.Reader)
+        testB.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
     }
 }
 
 func BenchmarkFlagSmallFRAC(b *testing.B) {
     var testB *Fractional
-    _, pk := testB.KeyGen(elliptic.P256(), SMALL_CONSTANT, rand.Reader)
+    _, pk, _ := testB.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Flag(elliptic.P256(), rand.Reader, pk)
+        testB.Flag(P256(), rand.Reader, pk)
     }
 }
 
 func BenchmarkFlagLargeFRAC(b *testing.B) {
     var testB *Fractional
-    _, pk := testB.KeyGen(elliptic.P256(), LARGE_CONSTANT, rand.Reader)
+    _, pk, _ := testB.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Flag(elliptic.P256(), rand.Reader, pk)
+        testB.Flag(P256(), rand.Reader, pk)
     } 
 }
 
 func BenchmarkExtractSmallFRAC(b *testing.B) {
     var testB *Fractional
-    sk, _ := testB.KeyGen(elliptic.P256(), SMALL_CONSTANT, rand.Reader)
+    sk, _, _ := testB.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
     MOD_SIZE := 1 << SMALL_CONSTANT
     b.ResetTimer()
     for n:= 0; n < b.N; n++ {
         // everything will be the same, value here does not matter for time
-        testB.Extract(randomProb(MOD_SIZE),sk)
+        testB.Extract(Probability{uint64(randomProb(MOD_SIZE)), uint64(MOD_SIZE)},sk)
     }
 }
 
 func BenchmarkExtractLargeFRAC(b *testing.B) {
     var testB *Fractional
-    sk, _ := testB.KeyGen(elliptic.P256(), LARGE_CONSTANT, rand.Reader)
+    sk, _, _ := testB.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
     MOD_SIZE := 1 << LARGE_CONSTANT
     b.ResetTimer()
     for n:= 0; n < b.N; n++ {
         // everything will be the same, value here does not matter for time
-        testB.Extract(randomProb(MOD_SIZE),sk)
+        testB.Extract(Probability{uint64(randomProb(MOD_SIZE)), uint64(MOD_SIZE)},sk)
     }
 }
 
 func BenchmarkTestSmallFRAC(b *testing.B) {
     var testB *Fractional
-    sk, pk := testB.KeyGen(elliptic.P256(), SMALL_CONSTANT, rand.Reader)
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testB.Extract(randomProb(1 << SMALL_CONSTANT), sk)
+    sk, pk, _ := testB.KeyGen(P256(), SMALL_CONSTANT, rand.Reader)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Probability{uint64(randomProb(1 << SMALL_CONSTANT)), 1 << SMALL_CONSTANT}, sk)
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Test(elliptic.P256(), ctext, dsk)
+        testB.Test(P256(), ctext, dsk)
+    }
+}
+
+// Garbled size of the CBMC-GC circuits. With NOT and OUTPUT gates free the
+// simple scheme packs 48Num8Mod.circ in 263233 bytes and 64Num24Mod.circ in
+// 1049667, down from 316992 and 1228608 when they took two rows each.
+func BenchmarkGarbleLegacyCircuits(b *testing.B) {
+    for _, fname := range legacyCircuitFiles {
+        circuit := parseLegacyCircuit(b, fname)
+        for _, scheme := range garblingSchemes {
+            b.Run(fname + "/" + scheme.String(), func(b *testing.B) {
+                var size int
+                for n := 0; n < b.N; n++ {
+                    garb, _ := toygarble.NewGarbledCircuit(scheme, toygarble.CipherFixedKeyAES)
+                    garb.GarbleCircuit(circuit, rand.Reader)
+                    size = len(garb.PackedMarshal())
+                }
+                b.ReportMetric(float64(size), "gc-bytes")
+            })
+        }
+    }
+}
+
+// Flag size and Flag and Test time for gamma=24 with each garbling scheme and
+// gate cipher
+func BenchmarkGarblingLargeFRAC(b *testing.B) {
+    var testB *Fractional
+    sk, pk, _ := testB.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
+    dsk, _ := testB.Extract(Probability{uint64(randomProb(1 << LARGE_CONSTANT)), 1 << LARGE_CONSTANT}, sk)
+    for _, scheme := range garblingSchemes {
+        for _, cipher := range gateCiphers {
+            frac := &Fractional{Garbling: scheme, GateCipher: cipher}
+            ctext, _ := frac.Flag(P256(), rand.Reader, pk)
+            name := scheme.String() + "/" + cipher.String()
+            b.Run(name + "/Flag", func(b *testing.B) {
+                b.ReportMetric(float64(len(ctext)), "flag-bytes")
+                for n := 0; n < b.N; n++ {
+                    frac.Flag(P256(), rand.Reader, pk)
+                }
+            })
+            b.Run(name + "/Test", func(b *testing.B) {
+                for n := 0; n < b.N; n++ {
+                    frac.Test(P256(), ctext, dsk)
+                }
+            })
+        }
+    }
+}
+
+// One hash of one and two labels with each gate cipher
+func BenchmarkGateCiphers(b *testing.B) {
+    a := make(toygarble.Label_t, toygarble.LABEL_LEN_BYTES)
+    c := make(toygarble.Label_t, toygarble.LABEL_LEN_BYTES)
+    rand.Read(a)
+    rand.Read(c)
+    for _, id := range gateCiphers {
+        cipher, _ := toygarble.NewGateCipher(id)
+        b.Run(id.String() + "/one", func(b *testing.B) {
+            for n := 0; n < b.N; n++ {
+                cipher.Hash(a, nil, uint64(n))
+            }
+        })
+        b.Run(id.String() + "/two", func(b *testing.B) {
+            for n := 0; n < b.N; n++ {
+                cipher.Hash(a, c, uint64(n))
+            }
+        })
     }
 }
 
 func BenchmarkTestLargeFRAC(b *testing.B) {
     var testB *Fractional
-    sk, pk := testB.KeyGen(elliptic.P256(), LARGE_CONSTANT, rand.Reader)
-    ctext := testB.Flag(elliptic.P256(), rand.Reader, pk)
-    dsk := testB.Extract(randomProb(1 << LARGE_CONSTANT), sk)
+    sk, pk, _ := testB.KeyGen(P256(), LARGE_CONSTANT, rand.Reader)
+    ctext, _ := testB.Flag(P256(), rand.Reader, pk)
+    dsk, _ := testB.Extract(Probability{uint64(randomProb(1 << LARGE_CONSTANT)), 1 << LARGE_CONSTANT}, sk)
     
     b.ResetTimer()
     for n := 0; n < b.N; n++ {
-        testB.Test(elliptic.P256(), ctext, dsk)
+        testB.Test(P256(), ctext, dsk)
     }
 }
 
@@ -2,4 +2,7 @@ module github.com/becgabri/fuzzycrypto
 
 go 1.16
 
-require golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+require (
+	github.com/gtank/ristretto255 v0.1.2
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+)
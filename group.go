@@ -0,0 +1,369 @@
+package fuzzycrypto
+
+import (
+    "bytes"
+    "crypto/elliptic"
+    "crypto/sha256"
+    "crypto/sha512"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+
+    "github.com/gtank/ristretto255"
+)
+
+//
+// The prime order group the schemes do their Diffie-Hellman in. Everything in
+// elGamal.go and fractional.go only talks to the group through this interface,
+// so a new group is just a new implementation.
+//
+// Scalars and Elements are opaque: they can only be handed back to the Group
+// that produced them.
+type Group interface {
+    // name used in errors and PEM headers, e.g. "P-256"
+    Name() string
+    // identifier used in the binary encodings
+    ID() byte
+
+    // A uniformly random scalar in [1, order)
+    RandomScalar(io.Reader) (Scalar, error)
+    // Hash the concatenation of msg into a scalar
+    HashToScalar(msg ...[]byte) Scalar
+    ScalarSub(a Scalar, b Scalar) Scalar
+    ScalarMul(a Scalar, b Scalar) Scalar
+    // 1/a, a must not be 0
+    ScalarInvert(a Scalar) Scalar
+    ScalarLen() int
+    EncodeScalar(Scalar) []byte
+    // Decode a canonical (fully reduced) scalar of exactly ScalarLen() bytes
+    DecodeScalar([]byte) (Scalar, error)
+
+    // s * generator
+    BaseMult(s Scalar) Element
+    // s * e
+    Mult(e Element, s Scalar) Element
+    Add(a Element, b Element) Element
+    ElementLen() int
+    // Canonical encoding of an element, also what gets fed to the hashes
+    Encode(Element) []byte
+    // Decode a canonical encoding of exactly ElementLen() bytes
+    Decode([]byte) (Element, error)
+}
+
+type Scalar interface{}
+type Element interface{}
+
+// Identifiers for the groups we know how to encode
+const (
+    GroupP224           byte = 1
+    GroupP256           byte = 2
+    GroupP384           byte = 3
+    GroupP521           byte = 4
+    GroupRistretto255   byte = 5
+)
+
+var (
+    p224Group = &nistGroup{elliptic.P224(), GroupP224}
+    p256Group = &nistGroup{elliptic.P256(), GroupP256}
+    p384Group = &nistGroup{elliptic.P384(), GroupP384}
+    p521Group = &nistGroup{elliptic.P521(), GroupP521}
+    r255Group = &ristrettoGroup{}
+)
+
+func P224() Group           { return p224Group }
+func P256() Group           { return p256Group }
+func P384() Group           { return p384Group }
+func P521() Group           { return p521Group }
+func Ristretto255() Group   { return r255Group }
+
+func GroupFromID(id byte) (Group, error) {
+    for _, g := range []Group{p224Group, p256Group, p384Group, p521Group, r255Group} {
+        if g.ID() == id {
+            return g, nil
+        }
+    }
+    return nil, fmt.Errorf("unknown group ID %d", id)
+}
+
+//
+// Whether e is an element the group can work with. Elements handed to a Group
+// by callers (e.g. in a hand-built PubKey or a decoded one) go through this
+// before any arithmetic, since the implementations assume their own types. The
+// identity is refused in every group: as a public subkey it would make every
+// flag bit for it readable without the secret key.
+func validElement(group Group, e Element) bool {
+    switch g := group.(type) {
+    case *nistGroup:
+        p, ok := e.(*GroupElement)
+        if !ok || p == nil || p.X == nil || p.Y == nil || !g.curve.IsOnCurve(p.X, p.Y) {
+            return false
+        }
+    case *ristrettoGroup:
+        p, ok := e.(*ristretto255.Element)
+        if !ok || p == nil {
+            return false
+        }
+    default:
+        if e == nil {
+            return false
+        }
+    }
+    return !isIdentity(group, e)
+}
+
+//
+// Whether e is the identity (the point at infinity on the NIST curves, which
+// the Go elliptic package writes as (0, 0))
+func isIdentity(group Group, e Element) bool {
+    switch e := e.(type) {
+    case *GroupElement:
+        return e.X.Sign() == 0 && e.Y.Sign() == 0
+    case *ristretto255.Element:
+        return e.Equal(ristretto255.NewElement().Zero()) == 1
+    }
+    return false
+}
+
+//
+// Same for nonzero scalars
+func validScalar(group Group, s Scalar) bool {
+    switch g := group.(type) {
+    case *nistGroup:
+        x, ok := s.(*big.Int)
+        return ok && x != nil && x.Sign() > 0 && x.Cmp(g.curve.Params().N) < 0
+    case *ristrettoGroup:
+        x, ok := s.(*ristretto255.Scalar)
+        return ok && x != nil && x.Equal(ristretto255.NewScalar()) == 0
+    }
+    return s != nil
+}
+
+//
+// NIST curves through crypto/elliptic. Elements are affine *GroupElements,
+// scalars are reduced *big.Ints.
+type nistGroup struct {
+    curve       elliptic.Curve
+    id          byte
+}
+
+func (g *nistGroup) Name() string { return g.curve.Params().Name }
+func (g *nistGroup) ID() byte     { return g.id }
+
+var mask = []byte{0xff, 0x1, 0x3, 0x7, 0xf, 0x1f, 0x3f, 0x7f}
+
+//
+// Sample a random scalar
+// lots of this code duplicated from https://golang.org/src/crypto/elliptic/elliptic.go, GenerateKey()
+func (g *nistGroup) RandomScalar(random io.Reader) (Scalar, error) {
+
+    // Get the group order from the curve parameters
+    N := g.curve.Params().N
+    bitSize := N.BitLen()
+    byteLen := (bitSize + 7) >> 3
+    priv := make([]byte, byteLen)
+
+    // Sample a private scalar
+    for {
+        _, err := io.ReadFull(random, priv)
+        if err != nil {
+            return nil, err
+        }
+
+        // We have to mask off any excess bits in the case that the size of the
+        // underlying field is not a whole number of bytes.
+        priv[0] &= mask[bitSize%8]
+
+        // This is because, in tests, rand will return all zeros and we don't
+        // want to get the point at infinity and loop forever.
+        priv[1] ^= 0x42
+
+        // If the scalar is out of range, sample another random number.
+        x := new(big.Int).SetBytes(priv)
+        if x.Sign() == 0 || x.Cmp(N) >= 0 {
+            continue
+        }
+        return x, nil
+    }
+}
+
+//
+// Hash into an integer at least 64 bits longer than the group order and reduce it,
+// stretching SHA-256 by appending an "X" to the input for every extra block.
+func (g *nistGroup) HashToScalar(msg ...[]byte) Scalar {
+    serialized := bytes.Join(msg, nil)
+
+    N := g.curve.Params().N
+    bitSize := N.BitLen() + 64
+    h := make([]byte, 0)
+
+    // Now repeatedly hash until we've filled the buffer
+    for len(h) * 8 < bitSize {
+        hash := sha256.Sum256(serialized)
+        h = append(h, hash[:]...)
+        serialized = append(serialized, 'X')
+    }
+
+    result := new(big.Int).SetBytes(h)
+    return result.Mod(result, N)
+}
+
+func (g *nistGroup) ScalarSub(a Scalar, b Scalar) Scalar {
+    r := new(big.Int).Sub(a.(*big.Int), b.(*big.Int))
+    return r.Mod(r, g.curve.Params().N)
+}
+
+func (g *nistGroup) ScalarMul(a Scalar, b Scalar) Scalar {
+    r := new(big.Int).Mul(a.(*big.Int), b.(*big.Int))
+    return r.Mod(r, g.curve.Params().N)
+}
+
+func (g *nistGroup) ScalarInvert(a Scalar) Scalar {
+    return new(big.Int).ModInverse(a.(*big.Int), g.curve.Params().N)
+}
+
+func (g *nistGroup) ScalarLen() int {
+    return (g.curve.Params().N.BitLen() + 7) / 8
+}
+
+func (g *nistGroup) EncodeScalar(s Scalar) []byte {
+    return s.(*big.Int).FillBytes(make([]byte, g.ScalarLen()))
+}
+
+func (g *nistGroup) DecodeScalar(b []byte) (Scalar, error) {
+    if len(b) != g.ScalarLen() {
+        return nil, errors.New("scalar has the wrong length")
+    }
+    s := new(big.Int).SetBytes(b)
+    if s.Cmp(g.curve.Params().N) >= 0 {
+        return nil, errors.New("scalar is not reduced")
+    }
+    return s, nil
+}
+
+// Scalars are always passed to crypto/elliptic at full width, so the time a
+// multiplication takes doesn't depend on how many leading zero bytes it has.
+func (g *nistGroup) BaseMult(s Scalar) Element {
+    el := new(GroupElement)
+    el.X, el.Y = g.curve.ScalarBaseMult(g.EncodeScalar(s))
+    return el
+}
+
+func (g *nistGroup) Mult(e Element, s Scalar) Element {
+    p := e.(*GroupElement)
+    el := new(GroupElement)
+    el.X, el.Y = g.curve.ScalarMult(p.X, p.Y, g.EncodeScalar(s))
+    return el
+}
+
+func (g *nistGroup) Add(a Element, b Element) Element {
+    p, q := a.(*GroupElement), b.(*GroupElement)
+    el := new(GroupElement)
+    el.X, el.Y = g.curve.Add(p.X, p.Y, q.X, q.Y)
+    return el
+}
+
+// SEC1 compressed points
+func (g *nistGroup) ElementLen() int {
+    return 1 + (g.curve.Params().BitSize + 7) / 8
+}
+
+func (g *nistGroup) Encode(e Element) []byte {
+    p := e.(*GroupElement)
+    return elliptic.MarshalCompressed(g.curve, p.X, p.Y)
+}
+
+func (g *nistGroup) Decode(b []byte) (Element, error) {
+    X, Y := elliptic.UnmarshalCompressed(g.curve, b)
+    if X == nil {
+        return nil, errors.New("not a compressed point on the curve")
+    }
+    return &GroupElement{X, Y}, nil
+}
+
+//
+// ristretto255 (RFC 9496), the prime order group built on Curve25519 that the
+// Rust fuzzytags crate uses.
+type ristrettoGroup struct{}
+
+func (g *ristrettoGroup) Name() string { return "ristretto255" }
+func (g *ristrettoGroup) ID() byte     { return GroupRistretto255 }
+
+func (g *ristrettoGroup) RandomScalar(random io.Reader) (Scalar, error) {
+    buf := make([]byte, 64)
+    zero := ristretto255.NewScalar()
+    for {
+        if _, err := io.ReadFull(random, buf); err != nil {
+            return nil, err
+        }
+        s := ristretto255.NewScalar().FromUniformBytes(buf)
+        if s.Equal(zero) == 0 {
+            return s, nil
+        }
+    }
+}
+
+// SHA-512 of the input, reduced mod the group order
+func (g *ristrettoGroup) HashToScalar(msg ...[]byte) Scalar {
+    h := sha512.New()
+    for _, m := range msg {
+        h.Write(m)
+    }
+    return ristretto255.NewScalar().FromUniformBytes(h.Sum(nil))
+}
+
+func (g *ristrettoGroup) ScalarSub(a Scalar, b Scalar) Scalar {
+    return ristretto255.NewScalar().Subtract(a.(*ristretto255.Scalar), b.(*ristretto255.Scalar))
+}
+
+func (g *ristrettoGroup) ScalarMul(a Scalar, b Scalar) Scalar {
+    return ristretto255.NewScalar().Multiply(a.(*ristretto255.Scalar), b.(*ristretto255.Scalar))
+}
+
+func (g *ristrettoGroup) ScalarInvert(a Scalar) Scalar {
+    return ristretto255.NewScalar().Invert(a.(*ristretto255.Scalar))
+}
+
+func (g *ristrettoGroup) ScalarLen() int { return 32 }
+
+func (g *ristrettoGroup) EncodeScalar(s Scalar) []byte {
+    return s.(*ristretto255.Scalar).Encode(nil)
+}
+
+func (g *ristrettoGroup) DecodeScalar(b []byte) (Scalar, error) {
+    // ristretto255 panics on anything but 32 bytes
+    if len(b) != g.ScalarLen() {
+        return nil, errors.New("scalar has the wrong length")
+    }
+    s := ristretto255.NewScalar()
+    if err := s.Decode(b); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (g *ristrettoGroup) BaseMult(s Scalar) Element {
+    return ristretto255.NewElement().ScalarBaseMult(s.(*ristretto255.Scalar))
+}
+
+func (g *ristrettoGroup) Mult(e Element, s Scalar) Element {
+    return ristretto255.NewElement().ScalarMult(s.(*ristretto255.Scalar), e.(*ristretto255.Element))
+}
+
+func (g *ristrettoGroup) Add(a Element, b Element) Element {
+    return ristretto255.NewElement().Add(a.(*ristretto255.Element), b.(*ristretto255.Element))
+}
+
+func (g *ristrettoGroup) ElementLen() int { return 32 }
+
+func (g *ristrettoGroup) Encode(e Element) []byte {
+    return e.(*ristretto255.Element).Encode(nil)
+}
+
+func (g *ristrettoGroup) Decode(b []byte) (Element, error) {
+    el := ristretto255.NewElement()
+    if err := el.Decode(b); err != nil {
+        return nil, err
+    }
+    return el, nil
+}
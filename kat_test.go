@@ -0,0 +1,246 @@
+package fuzzycrypto
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var updateVectors = flag.Bool("update", false, "regenerate the known answer vectors in testdata instead of checking them")
+
+//
+// Deterministic randomness for the vectors: SHA-256(seed || counter) for
+// counter = 0, 1, ...
+type seededReader struct {
+    seed    []byte
+    counter uint64
+    buf     []byte
+}
+
+func newSeededReader(seed string) *seededReader {
+    return &seededReader{seed: []byte(seed)}
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+    for n := 0; n < len(p); {
+        if len(r.buf) == 0 {
+            var ctr [8]byte
+            binary.BigEndian.PutUint64(ctr[:], r.counter)
+            r.counter++
+            block := sha256.Sum256(append(append([]byte{}, r.seed...), ctr[:]...))
+            r.buf = block[:]
+        }
+        c := copy(p[n:], r.buf)
+        r.buf = r.buf[c:]
+        n += c
+    }
+    return len(p), nil
+}
+
+func readN(t testing.TB, r io.Reader, n int) []byte {
+    b := make([]byte, n)
+    if _, err := io.ReadFull(r, b); err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+    return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+    b, err := hex.DecodeString(string(text))
+    *h = b
+    return err
+}
+
+//
+// Write v to path as indented JSON when -update is given, then read it back into v
+func syncVectorFile(t *testing.T, path string, v interface{}) {
+    t.Helper()
+    if *updateVectors {
+        out, err := json.MarshalIndent(v, "", "  ")
+        if err != nil {
+            t.Fatal(err)
+        }
+        os.MkdirAll(filepath.Dir(path), 0755)
+        if err := os.WriteFile(path, append(out, '\n'), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal(raw, v); err != nil {
+        t.Fatal(err)
+    }
+}
+
+const katVectorPath = "testdata/kat_vectors.json"
+
+//
+// One KeyGen -> Extract -> Flag -> Test run. Everything is drawn from
+// newSeededReader(Seed) in this order: KeyGen of the key, KeyGen of an unrelated
+// key, Flag to the key, Flag to the unrelated key. The flags are recorded whole,
+// tens of kilobytes for Fractional, so Test can be run on the recorded bytes.
+type katVector struct {
+    Scheme          string
+    Group           string
+    Seed            string
+    Gamma           int
+    SecretKey       hexBytes
+    PublicKey       hexBytes
+    Flag            hexBytes
+    UnrelatedFlag   hexBytes
+    Detection       []katDetection
+}
+
+type katDetection struct {
+    // rate Numerator / 2^Bits
+    Numerator       uint64
+    Bits            int
+    DetectionKey    hexBytes
+    Matches         bool
+    MatchesUnrelated bool
+}
+
+type katVectorFile struct {
+    Comment     string
+    Vectors     []katVector
+}
+
+func katScheme(name string) FuzzyScheme {
+    if name == SchemeFractional.String() {
+        return new(Fractional)
+    }
+    return new(ElGamalPower2)
+}
+
+func katGroup(t *testing.T, name string) Group {
+    for _, g := range []Group{P224(), P256(), P384(), P521(), Ristretto255()} {
+        if g.Name() == name {
+            return g
+        }
+    }
+    t.Fatalf("unknown group %q", name)
+    return nil
+}
+
+//
+// Run the vector's KeyGen and Flag calls and fill in everything but Detection
+func runKAT(t *testing.T, v *katVector) *SecKey {
+    scheme := katScheme(v.Scheme)
+    group := katGroup(t, v.Group)
+    rnd := newSeededReader(v.Seed)
+    sk, pk, err := scheme.KeyGen(group, v.Gamma, rnd)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, otherPk, err := scheme.KeyGen(group, v.Gamma, rnd)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flag, err := scheme.Flag(group, rnd, pk)
+    if err != nil {
+        t.Fatal(err)
+    }
+    unrelated, err := scheme.Flag(group, rnd, otherPk)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    v.SecretKey, _ = sk.MarshalBinary()
+    v.PublicKey, _ = pk.MarshalBinary()
+    v.Flag, v.UnrelatedFlag = flag, unrelated
+    return sk
+}
+
+func generateKATs(t *testing.T) katVectorFile {
+    file := katVectorFile{
+        Comment: "Known answer vectors for both schemes, see katVector in kat_test.go. " +
+            "Regenerate with go test -run TestKnownAnswers -update, but only when the change to the flags is intended.",
+    }
+    add := func(scheme SchemeID, group Group, seed string, gamma int, rates [][2]uint64) {
+        v := katVector{Scheme: scheme.String(), Group: group.Name(), Seed: seed, Gamma: gamma}
+        sk := runKAT(t, &v)
+        s := katScheme(v.Scheme)
+        for _, r := range rates {
+            d := katDetection{Numerator: r[0], Bits: int(r[1])}
+            dsk, err := s.Extract(Probability{d.Numerator, 1 << uint(d.Bits)}, sk)
+            if err != nil {
+                t.Fatal(err)
+            }
+            d.DetectionKey, _ = dsk.MarshalBinary()
+            d.Matches, _ = s.Test(group, v.Flag, dsk)
+            d.MatchesUnrelated, _ = s.Test(group, v.UnrelatedFlag, dsk)
+            v.Detection = append(v.Detection, d)
+        }
+        file.Vectors = append(file.Vectors, v)
+    }
+    egRates := [][2]uint64{{1, 0}, {1, 1}, {1, NUM_EXTRACT_SMALL}, {1, NUM_TOTAL_KEYS}}
+    add(SchemeElGamalPower2, P256(), "kat ElGamalPower2 P-256", NUM_TOTAL_KEYS, egRates)
+    add(SchemeElGamalPower2, Ristretto255(), "kat ElGamalPower2 ristretto255", NUM_TOTAL_KEYS, egRates)
+    frRates := [][2]uint64{{0, 8}, {1, 8}, {128, 8}, {255, 8}}
+    add(SchemeFractional, P256(), "kat Fractional P-256", SMALL_CONSTANT, frRates)
+    add(SchemeFractional, Ristretto255(), "kat Fractional ristretto255", SMALL_CONSTANT, frRates)
+    return file
+}
+
+// Replaying the checked in vectors has to give the same keys and flags, and
+// testing the checked in flags the same results, so a change to the hashes or
+// the flag format shows up as a Test mismatch and not only as a changed flag
+func TestKnownAnswers(t *testing.T) {
+    var file katVectorFile
+    if *updateVectors {
+        file = generateKATs(t)
+    }
+    syncVectorFile(t, katVectorPath, &file)
+    if len(file.Vectors) == 0 {
+        t.Fatal("no vectors")
+    }
+
+    for _, want := range file.Vectors {
+        got := katVector{Scheme: want.Scheme, Group: want.Group, Seed: want.Seed, Gamma: want.Gamma}
+        runKAT(t, &got)
+        if !bytes.Equal(got.SecretKey, want.SecretKey) || !bytes.Equal(got.PublicKey, want.PublicKey) {
+            t.Errorf("%s: KeyGen changed", want.Seed)
+        }
+        if !bytes.Equal(got.Flag, want.Flag) || !bytes.Equal(got.UnrelatedFlag, want.UnrelatedFlag) {
+            t.Errorf("%s: Flag changed", want.Seed)
+        }
+
+        // the recorded keys and flags have to decode and give the recorded answers
+        var sk SecKey
+        if err := sk.UnmarshalBinary(want.SecretKey); err != nil {
+            t.Fatalf("%s: %v", want.Seed, err)
+        }
+        scheme := katScheme(want.Scheme)
+        group := katGroup(t, want.Group)
+        for _, d := range want.Detection {
+            dsk, err := scheme.Extract(Probability{d.Numerator, 1 << uint(d.Bits)}, &sk)
+            if err != nil {
+                t.Fatalf("%s: %v", want.Seed, err)
+            }
+            if enc, _ := dsk.MarshalBinary(); !bytes.Equal(enc, d.DetectionKey) {
+                t.Errorf("%s: Extract(%d/2^%d) changed", want.Seed, d.Numerator, d.Bits)
+            }
+            if res, err := scheme.Test(group, want.Flag, dsk); err != nil || res != d.Matches {
+                t.Errorf("%s: Test with %d/2^%d = %t, %v, want %t", want.Seed, d.Numerator, d.Bits, res, err, d.Matches)
+            }
+            if res, err := scheme.Test(group, want.UnrelatedFlag, dsk); err != nil || res != d.MatchesUnrelated {
+                t.Errorf("%s: Test of unrelated flag with %d/2^%d = %t, %v, want %t", want.Seed, d.Numerator, d.Bits, res, err, d.MatchesUnrelated)
+            }
+        }
+    }
+}
@@ -1,41 +1,204 @@
 package fuzzycrypto
 
 import (
+    "errors"
+    "fmt"
     "math/big"
-    "crypto/elliptic"
     "io"
 )
 
 
 // this is a file containing the interface that must be implemented by any fuzzy crypto scheme
 
+//
+// A point on one of the NIST curves, the Element type of P224() ... P521()
 type GroupElement struct {
     X          *big.Int
     Y          *big.Int
 }
 
+// Identifies which scheme a key belongs to in its serialized form
+type SchemeID byte
+
+const (
+    SchemeElGamalPower2     SchemeID = 1
+    SchemeFractional        SchemeID = 2
+)
+
+func (id SchemeID) String() string {
+    switch id {
+    case SchemeElGamalPower2:
+        return "ElGamalPower2"
+    case SchemeFractional:
+        return "Fractional"
+    }
+    return fmt.Sprintf("SchemeID(%d)", byte(id))
+}
+
 type PubKey struct {
     NumKeys int
-    PubKeys []*GroupElement
+    PubKeys []Element
+
+    // filled in by KeyGen, needed to serialize the key
+    scheme      SchemeID
+    group       Group
+    gamma       int
 }
 
 type SecKey struct {
     numKeys     int
-    secKeys     []*big.Int 
+    secKeys     []Scalar
     prob        uint32
+
+    // filled in by KeyGen/Extract, needed to serialize the key
+    scheme      SchemeID
+    group       Group
+    gamma       int
+    // true for keys that came out of Extract
+    detection   bool
+}
+
+//
+// Errors returned by the schemes. Callers should compare against these with
+// errors.Is, since most of them get wrapped with a more specific reason.
+var (
+    // the flag could not be decoded, is truncated, or contains invalid group elements
+    ErrMalformedFlag = errors.New("fuzzycrypto: malformed flag")
+    // the scheme has no support for the requested parameter (e.g. gamma)
+    ErrUnsupportedParameter = errors.New("fuzzycrypto: unsupported parameter")
+    // the requested false positive rate can't be produced from the given secret key
+    ErrProbabilityNotRepresentable = errors.New("fuzzycrypto: probability not representable")
+    // a public, secret or detection key is missing or doesn't fit the operation
+    ErrInvalidKey = errors.New("fuzzycrypto: invalid key")
+)
+
+//
+// A false positive rate p = Numerator / Denominator. Each scheme can only produce
+// some rates exactly (ElGamalPower2 only 2^-n, Fractional only k / 2^gamma); Extract
+// rejects anything else with ErrProbabilityNotRepresentable rather than rounding it,
+// so a detection key never flags more (or less) than the caller asked for.
+type Probability struct {
+    Numerator       uint64
+    Denominator     uint64
+}
+
+//
+// The rate 2^-n, the only kind ElGamalPower2 can extract
+func Pow2Probability(n int) Probability {
+    return Probability{1, 1 << uint(n)}
+}
+
+func (p Probability) String() string {
+    return fmt.Sprintf("%d/%d", p.Numerator, p.Denominator)
+}
+
+//
+// Rewrite the fraction with a denominator of 2^bits. Fails if that can't be done
+// exactly or if the rate is not in [0, 1].
+func (p Probability) scaleTo(bits int) (uint64, error) {
+    if p.Denominator == 0 || p.Numerator > p.Denominator || bits < 0 || bits > 63 {
+        return 0, fmt.Errorf("%w: %v", ErrProbabilityNotRepresentable, p)
+    }
+    // numerator * 2^bits / denominator has to be an integer
+    scaled := new(big.Int).SetUint64(p.Numerator)
+    scaled.Lsh(scaled, uint(bits))
+    rem := new(big.Int)
+    scaled.QuoRem(scaled, new(big.Int).SetUint64(p.Denominator), rem)
+    if rem.Sign() != 0 {
+        return 0, fmt.Errorf("%w: %v is not a multiple of 1/2^%d", ErrProbabilityNotRepresentable, p, bits)
+    }
+    return scaled.Uint64(), nil
 }
 
 type FuzzyScheme interface {
     // a public key algorithm that takes in an int representing  the constant param gamma,
     // outputs a public and private key pair
-    KeyGen(elliptic.Curve, int, io.Reader) (*SecKey, *PubKey)
-    // an algorithm that takes in a secret key and produces detection key with 
-    // probability p / q if possible, nil otherwise
-    Extract(int, int, *SecKey) *SecKey
+    KeyGen(Group, int, io.Reader) (*SecKey, *PubKey, error)
+    // an algorithm that takes in a secret key and produces detection key with
+    // false positive rate p if possible, ErrProbabilityNotRepresentable otherwise
+    Extract(Probability, *SecKey) (*SecKey, error)
     // self-explanatory, flagging alg.
-    // io.Reader is the source you're using for randomness so MAKE SURE IT's GOOD 
-    Flag(elliptic.Curve, io.Reader, *PubKey) []byte
-    // tests whether or not a ciphertext was addressed to a particular individ. 
-    Test(elliptic.Curve, []byte, *SecKey) bool
+    // io.Reader is the source you're using for randomness so MAKE SURE IT's GOOD
+    Flag(Group, io.Reader, *PubKey) ([]byte, error)
+    // tests whether or not a ciphertext was addressed to a particular individ.
+    // A malformed ciphertext is reported as ErrMalformedFlag rather than a "false".
+    Test(Group, []byte, *SecKey) (bool, error)
+}
+
+// Both schemes have to stay usable through the interface
+var (
+    _ FuzzyScheme = (*ElGamalPower2)(nil)
+    _ FuzzyScheme = (*Fractional)(nil)
+)
+
+//
+// Make sure a public key is usable for flagging in group: every subkey must be
+// present and a valid element of the group
+func validatePubKey(group Group, pk *PubKey) error {
+    if pk == nil || pk.NumKeys < 1 || len(pk.PubKeys) != pk.NumKeys {
+        return ErrInvalidKey
+    }
+    if pk.group != nil && pk.group.ID() != group.ID() {
+        return fmt.Errorf("%w: public key is for %s, not %s", ErrInvalidKey, pk.group.Name(), group.Name())
+    }
+    for i := range pk.PubKeys {
+        if !validElement(group, pk.PubKeys[i]) {
+            return fmt.Errorf("%w: public subkey %d is not an element of %s", ErrInvalidKey, i, group.Name())
+        }
+    }
+    return nil
 }
 
+//
+// Make sure a secret (or detection) key has all of its subkeys, and if group is
+// not nil that they are scalars of that group
+func validateSecKey(group Group, sk *SecKey) error {
+    if sk == nil || sk.numKeys < 0 || len(sk.secKeys) != sk.numKeys {
+        return ErrInvalidKey
+    }
+    if group != nil && sk.group != nil && sk.group.ID() != group.ID() {
+        return fmt.Errorf("%w: secret key is for %s, not %s", ErrInvalidKey, sk.group.Name(), group.Name())
+    }
+    if group == nil {
+        group = sk.group
+    }
+    for i := range sk.secKeys {
+        if sk.secKeys[i] == nil {
+            return fmt.Errorf("%w: secret subkey %d is missing", ErrInvalidKey, i)
+        }
+        if group != nil && !validScalar(group, sk.secKeys[i]) {
+            return fmt.Errorf("%w: secret subkey %d is not a scalar of %s", ErrInvalidKey, i, group.Name())
+        }
+    }
+    return nil
+}
+
+//
+// Make sure a key is one scheme can use where it is given: a secret key for
+// Extract (kind keyKindSecret), a detection key for Fractional's Test
+// (keyKindDetection), or either (0). Its number of subkeys has to be what its
+// gamma says: 2*gamma for a Fractional secret key, gamma for a Fractional
+// detection key or an ElGamalPower2 secret key, and at most gamma for an
+// ElGamalPower2 detection key.
+func checkKeyKind(sk *SecKey, scheme SchemeID, kind byte) error {
+    if sk.scheme != scheme {
+        return fmt.Errorf("%w: %v key given to %v", ErrInvalidKey, sk.scheme, scheme)
+    }
+    if kind == keyKindSecret && sk.detection {
+        return fmt.Errorf("%w: detection key where a secret key is needed", ErrInvalidKey)
+    }
+    if kind == keyKindDetection && !sk.detection {
+        return fmt.Errorf("%w: secret key where a detection key is needed", ErrInvalidKey)
+    }
+    expected := sk.gamma
+    switch {
+    case scheme == SchemeFractional && !sk.detection:
+        expected = 2*sk.gamma
+    case scheme == SchemeElGamalPower2 && sk.detection && sk.numKeys <= sk.gamma:
+        expected = sk.numKeys
+    }
+    if sk.numKeys != expected {
+        return fmt.Errorf("%w: %v key for gamma=%d has %d subkeys", ErrInvalidKey, scheme, sk.gamma, sk.numKeys)
+    }
+    return nil
+}
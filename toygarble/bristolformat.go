@@ -0,0 +1,99 @@
+package toygarble
+
+import (
+    "io"
+    "strconv"
+)
+
+//
+// The older Bristol Format, which many published circuits and older CBMC-GC
+// outputs still use. It only differs from Bristol Fashion in its header, which
+// is written for two parties:
+//
+//   <numGates> <numWires>
+//   <numInputWires1> <numInputWires2> <numOutputWires>
+//
+// The first numInputWires1 wires are the first party's input and the next
+// numInputWires2 the second's, and the last numOutputWires wires are the output.
+// They are read as two input values and one output value.
+//
+
+func ParseBristolFormatFile(circ *Circuit, inReader io.Reader) error {
+    r := newBristolReader(inReader)
+    numGates, numWires, err := r.readSize()
+    if err != nil {
+        return err
+    }
+    record, err := r.mustNext("the input and output wire counts")
+    if err != nil {
+        return err
+    }
+    return r.readFormat(circ, numGates, numWires, record)
+}
+
+//
+// The rest of a Bristol Format file after the size, starting with the fields
+// of the wire counts line
+func (r *bristolReader) readFormat(circ *Circuit, numGates int, numWires int, counts []string) error {
+    if len(counts) != 3 {
+        return r.errorf("expected <numInputWires1> <numInputWires2> <numOutputWires>, found %d fields", len(counts))
+    }
+    numWiresPerIV := make([]int, 2)
+    numWiresPerOV := make([]int, 1)
+    var err error
+    for i, n := range []*int{&numWiresPerIV[0], &numWiresPerIV[1], &numWiresPerOV[0]} {
+        if *n, err = r.atoi(counts[i], "wire count"); err != nil {
+            return err
+        }
+    }
+    return r.readGates(circ, numGates, numWiresPerIV, numWiresPerOV, numWires)
+}
+
+//
+// Parse a circuit in either Bristol Fashion or Bristol Format, telling them
+// apart by their second line. In Bristol Fashion it is a count of input values
+// followed by that many wire counts, in Bristol Format it is always three wire
+// counts. "2 <n1> <n2>" could be either, so then the line after it decides:
+// Bristol Fashion has its output values there and Bristol Format its first gate.
+func ParseCircuit(inReader io.Reader) (*Circuit, error) {
+    r := newBristolReader(inReader)
+    numGates, numWires, err := r.readSize()
+    if err != nil {
+        return nil, err
+    }
+    record, err := r.mustNext("the input values")
+    if err != nil {
+        return nil, err
+    }
+
+    fashion := len(record) != 3
+    if len(record) == 3 && record[0] == "2" {
+        // read ahead one line and put it back
+        before := r.line
+        next, err := r.next()
+        if err != nil {
+            return nil, err
+        }
+        fashion = next != nil && !isGateLine(next)
+        if next != nil {
+            r.unread(next, before)
+        }
+    }
+
+    circ := new(Circuit)
+    if fashion {
+        err = r.readFashion(circ, numGates, numWires, record)
+    } else {
+        err = r.readFormat(circ, numGates, numWires, record)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return circ, nil
+}
+
+// Gate lines end in the name of the gate, header lines in a number
+func isGateLine(fields []string) bool {
+    _, err := strconv.Atoi(fields[len(fields) - 1])
+    return err != nil
+}
@@ -0,0 +1,108 @@
+package toygarble
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+)
+
+// A two input circuit written in Bristol Format instead of Bristol Fashion
+func toBristolFormat(t *testing.T, circ *Circuit) string {
+    t.Helper()
+    var written bytes.Buffer
+    if err := circ.WriteBristol(&written); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.SplitN(written.String(), "\n", 4)
+    header := fmt.Sprintf("%d %d %d", circ.NumWiresIV[0], circ.NumWiresIV[1], circ.NumOutputWires)
+    return lines[0] + "\n" + header + "\n" + lines[3]
+}
+
+func TestParseBristolFormat(t *testing.T) {
+    for _, file := range []string{"adder64.txt", "aes_128.txt"} {
+        circ := parseTestCircuit(t, file)
+        format := toBristolFormat(t, circ)
+
+        parsed := new(Circuit)
+        if err := ParseBristolFormatFile(parsed, strings.NewReader(format)); err != nil {
+            t.Fatalf("%s: %v", file, err)
+        }
+        checkEquivalent(t, file, circ, parsed, 4)
+
+        detected, err := ParseCircuit(strings.NewReader(format))
+        if err != nil {
+            t.Fatalf("%s: %v", file, err)
+        }
+        checkEquivalent(t, file, circ, detected, 4)
+    }
+}
+
+func TestParseCircuitDetectsFormat(t *testing.T) {
+    // Bristol Fashion with two input values starts out like Bristol Format
+    for _, file := range []string{"adder64.txt", "neg64.txt", "zero_equal.txt"} {
+        circ := parseTestCircuit(t, file)
+        var written bytes.Buffer
+        circ.WriteBristol(&written)
+        detected, err := ParseCircuit(&written)
+        if err != nil {
+            t.Fatalf("%s: %v", file, err)
+        }
+        checkEquivalent(t, file, circ, detected, 4)
+    }
+
+    cases := []struct {
+        name        string
+        file        string
+        inputs      []int
+        outputs     []int
+    }{
+        {"Format, first party has 2 wires", "1 5\n2 2 1\n\n2 1 0 2 4 AND\n", []int{2, 2}, []int{1}},
+        {"Fashion, two values", "1 5\n2 2 2\n1 1\n\n2 1 0 2 4 AND\n", []int{2, 2}, []int{1}},
+        {"Fashion, three values", "1 4\n3 1 1 1\n1 1\n2 1 0 2 3 AND\n", []int{1, 1, 1}, []int{1}},
+        {"Format", "1 4\n1 2 1\n2 1 0 2 3 AND\n", []int{1, 2}, []int{1}},
+    }
+    for _, c := range cases {
+        circ, err := ParseCircuit(strings.NewReader(c.file))
+        if err != nil {
+            t.Errorf("%s: %v", c.name, err)
+            continue
+        }
+        if !equalInts(circ.NumWiresIV, c.inputs) || !equalInts(circ.NumWiresOV, c.outputs) {
+            t.Errorf("%s: values %v %v, want %v %v", c.name, circ.NumWiresIV, circ.NumWiresOV, c.inputs, c.outputs)
+        }
+    }
+}
+
+func TestParseBristolFormatErrors(t *testing.T) {
+    cases := []struct {
+        name    string
+        detect  bool
+        file    string
+        line    int
+        reason  string
+    }{
+        {"missing counts", false, "1 5\n", 0, "before the input and output wire counts"},
+        {"two counts", false, "1 5\n2 1\n", 2, "found 2 fields"},
+        {"bad count", false, "1 5\n2 x 1\n", 2, "not a number"},
+        {"huge wire count", false, "1 9223372036854775807\n1 1 1\n2 1 0 0 5 AND\n", 1, "more than the"},
+        {"huge wire count detected", true, "1 9223372036854775807\n1 1\n1 1\n2 1 0 0 5 AND\n", 1, "more than the"},
+        {"huge input wire count", false, "1 3\n9223372036854775807 9223372036854775807 1\n", 2, "don't fit in 3 wires"},
+        // the line read ahead to tell the formats apart keeps its number
+        {"bad gate after read ahead", true, "1 5\n2 2 1\n\n2 1 0 9 4 AND\n", 4, "wire 9 is out of range"},
+        {"bad count before read ahead", true, "1 5\n2 2 x\n\n2 1 0 2 4 AND\n", 2, "not a number"},
+    }
+    for _, c := range cases {
+        var err error
+        if c.detect {
+            _, err = ParseCircuit(strings.NewReader(c.file))
+        } else {
+            err = ParseBristolFormatFile(new(Circuit), strings.NewReader(c.file))
+        }
+        var perr *ParseError
+        if !errors.As(err, &perr) || perr.Line != c.line || !strings.Contains(perr.Reason, c.reason) {
+            t.Errorf("%s: got %v, want line %d: ...%s...", c.name, err, c.line, c.reason)
+        }
+    }
+}
@@ -1,206 +1,381 @@
 package toygarble
 
 import (
-    "io"
+    "bufio"
     "fmt"
-    "encoding/csv"
+    "io"
     "strconv"
+    "strings"
 )
 
 //
 // Constants and types
 //
 
+// The most wires a circuit file can have, so a header can't make the parser
+// allocate more than a few hundred megabytes before a single gate is read
+const MAX_BRISTOL_WIRES int = 1 << 24
+
+//
+// What is wrong with a circuit file, and the line (counting from 1) it was
+// found on. Line is 0 for problems with the file as a whole.
+type ParseError struct {
+    Line    int
+    Reason  string
+}
+
+func (e *ParseError) Error() string {
+    if e.Line == 0 {
+        return "bristol: " + e.Reason
+    }
+    return fmt.Sprintf("bristol: line %d: %s", e.Line, e.Reason)
+}
+
+// Gates that map onto a single toygarble gate, by their operation name
+var bristolGates = map[string]struct {
+    gateType    GateType_t
+    numIn       int
+}{
+    "AND":  {GateAND, 2},
+    "XOR":  {GateXOR, 2},
+    "OR":   {GateOR, 2},
+    "INV":  {GateNOT, 1},
+    "NOT":  {GateNOT, 1},
+    "EQW":  {GateCOPY, 1},
+}
+
+// Reads a circuit file a line at a time, skipping blank lines and # comments
+type bristolReader struct {
+    scanner     *bufio.Scanner
+    line        int
+    // a line given back with unread, and its line number
+    pending     []string
+    pendingLine int
+}
+
+func newBristolReader(inReader io.Reader) *bristolReader {
+    return &bristolReader{scanner: bufio.NewScanner(inReader)}
+}
+
+// The fields of the next line, or nil at the end of the file
+func (r *bristolReader) next() ([]string, error) {
+    if r.pending != nil {
+        fields := r.pending
+        r.pending = nil
+        r.line, r.pendingLine = r.pendingLine, 0
+        return fields, nil
+    }
+    for r.scanner.Scan() {
+        r.line++
+        text := r.scanner.Text()
+        if i := strings.IndexByte(text, '#'); i >= 0 {
+            text = text[:i]
+        }
+        if fields := strings.Fields(text); len(fields) != 0 {
+            return fields, nil
+        }
+    }
+    if err := r.scanner.Err(); err != nil {
+        return nil, &ParseError{r.line + 1, err.Error()}
+    }
+    return nil, nil
+}
+
+// Give back the line next just returned, going back to the line number before
+// it was read
+func (r *bristolReader) unread(fields []string, before int) {
+    r.pending, r.pendingLine = fields, r.line
+    r.line = before
+}
+
+func (r *bristolReader) errorf(format string, args ...interface{}) error {
+    return &ParseError{r.line, fmt.Sprintf(format, args...)}
+}
+
+// The next line, which has to be there
+func (r *bristolReader) mustNext(what string) ([]string, error) {
+    fields, err := r.next()
+    if err == nil && fields == nil {
+        err = &ParseError{0, "file ends before " + what}
+    }
+    return fields, err
+}
+
+func (r *bristolReader) atoi(field string, what string) (int, error) {
+    n, err := strconv.Atoi(field)
+    if err != nil || n < 0 {
+        return 0, r.errorf("%s %q is not a number", what, field)
+    }
+    return n, nil
+}
+
+// <count> <n1> ... <ncount>, returning n1 ... ncount
+func (r *bristolReader) readCounts(fields []string, what string) ([]int, error) {
+    count, err := r.atoi(fields[0], "number of " + what + " values")
+    if err != nil {
+        return nil, err
+    }
+    if len(fields) != count + 1 {
+        return nil, r.errorf("%d %s values need %d wire counts, found %d", count, what, count, len(fields) - 1)
+    }
+    counts := make([]int, count)
+    for i := range counts {
+        if counts[i], err = r.atoi(fields[i + 1], what + " wire count"); err != nil {
+            return nil, err
+        }
+    }
+    return counts, nil
+}
+
+//
+// Main parsing function, for circuits in Bristol Fashion:
+//
+//   <numGates> <numWires>
+//   <numInputValues> <numWiresValue1> ... <numWiresValueN>
+//   <numOutputValues> <numWiresValue1> ... <numWiresValueN>
+//
+// followed by one gate per line, in topological order:
+//
+//   <numInputWires> <numOutputWires> <inWire1> .. <inWireN> <outWire1> .. <outWireM> <GateType>
+//
+// where <GateType> is one of
+//
+//   AND, XOR, OR           two inputs, one output
+//   INV, NOT               one input, one output
+//   EQW                    one input, one output: the output wire equals the input
+//   EQ                     "1 1 <ConstantBit> <outWire> EQ" sets the output wire to a constant
+//   MAND                   "2k k <a1..ak> <b1..bk> <c1..ck> MAND", k ANDs ci = ai & bi
+//
+// The first wires are the inputs, in order of the input values, and the last
+// wires are the outputs. Every wire has to be written exactly once, before it
+// is read, and no gate may write an input wire. There can be at most
+// MAX_BRISTOL_WIRES wires. Anything wrong comes back as a *ParseError and
+// leaves circ unusable.
+func ParseBRISTOLCircuitFile(circ *Circuit, inReader io.Reader) error {
+    r := newBristolReader(inReader)
+    numGates, numWires, err := r.readSize()
+    if err != nil {
+        return err
+    }
+    record, err := r.mustNext("the input values")
+    if err != nil {
+        return err
+    }
+    return r.readFashion(circ, numGates, numWires, record)
+}
+
+// First line:
+// <numGates> <numWires>
+func (r *bristolReader) readSize() (int, int, error) {
+    record, err := r.mustNext("the circuit size")
+    if err != nil {
+        return 0, 0, err
+    }
+    if len(record) != 2 {
+        return 0, 0, r.errorf("expected <numGates> <numWires>, found %d fields", len(record))
+    }
+    numGates, err := r.atoi(record[0], "number of gates")
+    if err != nil {
+        return 0, 0, err
+    }
+    numWires, err := r.atoi(record[1], "number of wires")
+    if err != nil {
+        return 0, 0, err
+    }
+    if numWires > MAX_BRISTOL_WIRES {
+        return 0, 0, r.errorf("%d wires is more than the %d a circuit can have", numWires, MAX_BRISTOL_WIRES)
+    }
+    // every gate writes at least one wire of its own
+    if numGates > numWires {
+        return 0, 0, r.errorf("%d gates can't each write one of %d wires", numGates, numWires)
+    }
+    return numGates, numWires, nil
+}
+
 //
-// Main parsing function
-func ParseBRISTOLCircuitFile(circ *Circuit, inReader io.Reader) bool {
-    //fmt.Print("Parsing bristol file...")
-    totalNumInputWires := 0
-    totalNumOutputWires := 0
-    
-    // Create a new CSV reader
-    r := csv.NewReader(inReader)
-    r.Comma = ' '               // records are space delimited
-    r.Comment = '#'             // no comments in the BRISTOL files, but there should be
-    r.FieldsPerRecord = -1      // variable number of fields per record
-    
-    // First line:
-    // <numGates> <numWires>\n
-    record, err := r.Read()
-    check(err)
-    numGates, _ := strconv.Atoi(record[0])
-    numWires, _ := strconv.Atoi(record[1])
-    
-    // Second line:
+// The rest of a Bristol Fashion file after the size, starting with the fields
+// of the input values line
+func (r *bristolReader) readFashion(circ *Circuit, numGates int, numWires int, inputs []string) error {
+    // Second and third lines:
     // <numInputVariables> <numWiresVar1> ... <numWiresVarN>
-    record, err = r.Read()
-    check(err)
-    numInputVars, _ := strconv.Atoi(record[0])
-    numWiresPerIV := make([]int, numInputVars)
-    for i := 0; i < numInputVars; i++ {
-        numWiresPerIV[i], _ = strconv.Atoi(record[i + 1])
-        totalNumInputWires += numWiresPerIV[i]
-    }
-    
-    // Third line:
     // <numOutputVariables> <numWiresVar1> ... <numWiresVarN>
-    record, err = r.Read()
-    check(err)
-    numOutputVars, _ := strconv.Atoi(record[0])
-    numWiresPerOV := make([]int, numOutputVars)
-    for i := 0; i < numOutputVars; i++ {
-        numWiresPerOV[i], _ = strconv.Atoi(record[i + 1])
-        totalNumOutputWires += numWiresPerOV[i]
-    }
-    
-    //fmt.Printf("Numgates = %d, NumWires = %d\n", numGates, numWires)
-    //fmt.Printf("Input vars=%d, wires = ", numInputVars)
-    //fmt.Println(numWiresPerIV)
-    //fmt.Printf("Output vars=%d, wires = ", numOutputVars)
-    //fmt.Println(numWiresPerOV)
-    
+    numWiresPerIV, err := r.readCounts(inputs, "input")
+    if err != nil {
+        return err
+    }
+    record, err := r.mustNext("the output values")
+    if err != nil {
+        return err
+    }
+    numWiresPerOV, err := r.readCounts(record, "output")
+    if err != nil {
+        return err
+    }
+    return r.readGates(circ, numGates, numWiresPerIV, numWiresPerOV, numWires)
+}
+
+//
+// Everything after the header, which is the same in both formats: gates until
+// there are numGates of them, then the end of the file
+func (r *bristolReader) readGates(circ *Circuit, numGates int, numWiresPerIV []int, numWiresPerOV []int, numWires int) error {
+    // checked against numWires as they're added up, so huge counts can't overflow
+    totalNumInputWires, totalNumOutputWires := 0, 0
+    for _, n := range numWiresPerIV {
+        if n > numWires - totalNumInputWires {
+            return r.errorf("the input wires don't fit in %d wires", numWires)
+        }
+        totalNumInputWires += n
+    }
+    for _, n := range numWiresPerOV {
+        if n > numWires - totalNumInputWires - totalNumOutputWires {
+            return r.errorf("the input and output wires don't fit in %d wires", numWires)
+        }
+        totalNumOutputWires += n
+    }
+    if totalNumOutputWires == 0 {
+        return r.errorf("the circuit has no outputs")
+    }
+
     // Initialize the circuit
-    (*circ).initializeCircuit(totalNumInputWires, totalNumOutputWires, numInputVars, numOutputVars, numWiresPerIV, numWiresPerOV)
-
-    // Fourth line should be empty, but CSV parser will ignore it
-    //
-    // Everything after this defines a gate (or wire connection):
-    //
-    // For gates, the format is:
-    //   <numInputWires> <numOutputWires> <inWire1> .. <inWireN> <outWire> <GateType>
-    // where <GateType> is one of [AND, XOR, INV]
-    //
-    // For AND, XOR the number of input gates is always 2, output is 1
-    // For INV the number of input gates is always 1, output is 1
-    //
-    // For wire connections, the format is either:
-    //   1 1 <ConstantBit> <outWire> EQ
-    //   (this assigns the constant ConstantBit to wire <outWire>
-    // or
-    //   1 1 <inWire> <outWire> EQW   --- TODO THE DOCS SAY DIFFERENTLY AW HELL
-    //   (this connects wire inWire to outWire)
-
-    // Allocate all the new gates
-    (*circ).Gates = append((*circ).Gates, make([]Gate, numGates)...)
+    (*circ).initializeCircuit(totalNumInputWires, totalNumOutputWires, len(numWiresPerIV), len(numWiresPerOV), numWiresPerIV, numWiresPerOV)
+
+    // The gate that drives each wire, -1 until something does
     wires := make([]int, numWires)
-    
-    for i := (totalNumInputWires + totalNumOutputWires); i < (totalNumInputWires + totalNumOutputWires) + numGates; i++ {
-        // Read in one line of the file
-        record, err = r.Read()
-        check(err)
-        
-        // Switch based on the last opcode in the line
-        switch record[len(record) - 1] {
-        case "AND":
-            (*circ).Gates[i].GateType = GateAND
-            (*circ).Gates[i].InFrom = make([]int, 2)
-            inWire1, _ := strconv.Atoi(record[2])
-            inWire2, _ := strconv.Atoi(record[3])
-            (*circ).Gates[i].InFrom[0] = wireToGate(wires, inWire1, circ, totalNumInputWires)
-            (*circ).Gates[i].InFrom[1] = wireToGate(wires, inWire2, circ, totalNumInputWires)
-            if (*circ).Gates[i].InFrom[0] == -1 || (*circ).Gates[i].InFrom[1] == -1 {
-                return false
+    for i := range wires {
+        wires[i] = -1
+    }
+    for i := 0; i < totalNumInputWires; i++ {
+        wires[i] = circ.getInputGate(i)
+    }
+
+    readWire := func(field string) (int, error) {
+        wire, err := r.atoi(field, "wire")
+        if err != nil {
+            return -1, err
+        }
+        if wire >= numWires {
+            return -1, r.errorf("wire %d is out of range, the circuit has %d", wire, numWires)
+        }
+        if wires[wire] == -1 {
+            return -1, r.errorf("wire %d is read before it is written", wire)
+        }
+        return wires[wire], nil
+    }
+    writeWire := func(field string, gateID int) error {
+        wire, err := r.atoi(field, "wire")
+        if err != nil {
+            return err
+        }
+        if wire >= numWires {
+            return r.errorf("wire %d is out of range, the circuit has %d", wire, numWires)
+        }
+        if wire < totalNumInputWires {
+            return r.errorf("wire %d is an input wire", wire)
+        }
+        if wires[wire] != -1 {
+            return r.errorf("wire %d is written twice", wire)
+        }
+        wires[wire] = gateID
+        return nil
+    }
+
+    for gateNum := 0; gateNum < numGates; gateNum++ {
+        record, err := r.mustNext(fmt.Sprintf("gate %d of %d", gateNum + 1, numGates))
+        if err != nil {
+            return err
+        }
+        if len(record) < 3 {
+            return r.errorf("expected a gate, found %d fields", len(record))
+        }
+        numIn, err := r.atoi(record[0], "number of input wires")
+        if err != nil {
+            return err
+        }
+        numOut, err := r.atoi(record[1], "number of output wires")
+        if err != nil {
+            return err
+        }
+        op := record[len(record) - 1]
+        if len(record) != numIn + numOut + 3 {
+            return r.errorf("%s with %d inputs and %d outputs needs %d fields, found %d", op, numIn, numOut, numIn + numOut + 3, len(record))
+        }
+        in, out := record[2:2+numIn], record[2+numIn:2+numIn+numOut]
+
+        switch op {
+        case "EQ":
+            if numIn != 1 || numOut != 1 {
+                return r.errorf("EQ needs 1 input and 1 output, found %d and %d", numIn, numOut)
             }
-            outWire, _ := strconv.Atoi(record[4])
-            wires[outWire] = i
-            //fmt.Printf("Added AND gate %d, wired to input gates (%d,%d)\n", i, (*circ).Gates[i].InFrom[0], (*circ).Gates[i].InFrom[1])
-
-
-        case "XOR":
-            (*circ).Gates[i].GateType = GateXOR
-            (*circ).Gates[i].InFrom = make([]int, 2)
-            inWire1, _ := strconv.Atoi(record[2])
-            inWire2, _ := strconv.Atoi(record[3])
-            (*circ).Gates[i].InFrom[0] = wireToGate(wires, inWire1, circ, totalNumInputWires)
-            (*circ).Gates[i].InFrom[1] = wireToGate(wires, inWire2, circ, totalNumInputWires)
-            if (*circ).Gates[i].InFrom[0] == -1 || (*circ).Gates[i].InFrom[1] == -1 {
-                return false
+            if in[0] != "0" && in[0] != "1" {
+                return r.errorf("EQ constant %q is not 0 or 1", in[0])
             }
-            outWire, _ := strconv.Atoi(record[4])
-            wires[outWire] = i
-        case "OR":
-            (*circ).Gates[i].GateType = GateOR
-            (*circ).Gates[i].InFrom = make([]int, 2)
-            inWire1, _ := strconv.Atoi(record[2])
-            inWire2, _ := strconv.Atoi(record[3])
-            (*circ).Gates[i].InFrom[0] = wireToGate(wires, inWire1, circ, totalNumInputWires)
-            (*circ).Gates[i].InFrom[1] = wireToGate(wires, inWire2, circ, totalNumInputWires)
-            if (*circ).Gates[i].InFrom[0] == -1 || (*circ).Gates[i].InFrom[1] == -1 {
-                return false
+            gateID := circ.addGate(GateCONST, in[0] == "1", nil)
+            if err := writeWire(out[0], gateID); err != nil {
+                return err
             }
-            outWire, _ := strconv.Atoi(record[4])
-            wires[outWire] = i
-    
-        case "INV":
-            (*circ).Gates[i].GateType = GateNOT
-            (*circ).Gates[i].InFrom = make([]int, 1)
-            inWire1, _ := strconv.Atoi(record[2])
-            (*circ).Gates[i].InFrom[0] = wireToGate(wires, inWire1, circ, totalNumInputWires)
-            if (*circ).Gates[i].InFrom[0] == -1 {
-                return false
+
+        case "MAND":
+            if numIn != 2 * numOut || numOut == 0 {
+                return r.errorf("MAND needs 2k inputs and k outputs, found %d and %d", numIn, numOut)
             }
-            outWire, _ := strconv.Atoi(record[3])
-            wires[outWire] = i
-            //fmt.Printf("Added NOT gate %d, wired to input gate %d\n", i, (*circ).Gates[i].InFrom[0])
-            
-        case "EQ":
-            (*circ).Gates[i].GateType = GateCONST
-            (*circ).Gates[i].InFrom = make([]int, 1)
-            (*circ).Gates[i].InFrom[0], _ = strconv.Atoi(record[2])
-            outWire, _ := strconv.Atoi(record[4])
-            wires[outWire] = i
-            
-        case "EQW":
-            // not sure what we're doing here so I'm just filling this out
-            (*circ).Gates[i].GateType = GateCOPY
-            (*circ).Gates[i].InFrom = make([]int, 1)
-            inWire, _ := strconv.Atoi(record[2])
-            (*circ).Gates[i].InFrom[0] = wireToGate(wires, inWire, circ, totalNumInputWires)
-            if (*circ).Gates[i].InFrom[0] == -1 {
-                return false
+            // read every input before writing any output
+            gates := make([][]int, numOut)
+            for k := range gates {
+                a, err := readWire(in[k])
+                if err != nil {
+                    return err
+                }
+                b, err := readWire(in[numOut + k])
+                if err != nil {
+                    return err
+                }
+                gates[k] = []int{a, b}
+            }
+            for k, inFrom := range gates {
+                if err := writeWire(out[k], circ.addGate(GateAND, false, inFrom)); err != nil {
+                    return err
+                }
             }
-            outWire, _ := strconv.Atoi(record[3])
-            wires[outWire] = i
-            
+
         default:
-            fmt.Printf("Unknown gate type or instruction\n")
-            return false
+            gate, ok := bristolGates[op]
+            if !ok {
+                return r.errorf("unknown gate type %q", op)
+            }
+            if numIn != gate.numIn || numOut != 1 {
+                return r.errorf("%s needs %d inputs and 1 output, found %d and %d", op, gate.numIn, numIn, numOut)
+            }
+            inFrom := make([]int, numIn)
+            for k := range inFrom {
+                if inFrom[k], err = readWire(in[k]); err != nil {
+                    return err
+                }
+            }
+            if err := writeWire(out[0], circ.addGate(gate.gateType, false, inFrom)); err != nil {
+                return err
+            }
         }
     }
-    
+    if record, err := r.next(); err != nil {
+        return err
+    } else if record != nil {
+        return r.errorf("more than the %d gates the header gives", numGates)
+    }
+
     // Now go through and connect all of the output gates
     for i := 0; i < totalNumOutputWires; i++ {
-        if (*circ).connectOutputWire(wires[i + (numWires - totalNumOutputWires)], i) == false {
-            return false
+        wire := numWires - totalNumOutputWires + i
+        if wires[wire] == -1 {
+            return &ParseError{0, fmt.Sprintf("output wire %d is never written", wire)}
         }
+        circ.connectOutputWire(wires[wire], i)
     }
-    
-    // Success
-    return true
-}
 
-//
-// Convert a wire number into a gate number
-func wireToGate(wires []int, wireNum int, circ *Circuit, totalWires int) int {
-
-    // Any wire that's in 0...numInputWires-1 is an input wire
-    if wireNum < (*circ).NumInputWires {
-        return wireNum
-    }
-    
-    // Any wire that's in the final numOutputWires should be recast into
-    // the range numInputWires...(numInputWires+numOutputWires)-1
-    if wireNum >= (totalWires-(*circ).NumOutputWires) && wireNum < totalWires {
-        // return the number of the output gate
-        return (*circ).getOutputGate(wireNum - (totalWires-(*circ).NumOutputWires))
-    }
-    
-    
-    // Any other wire should be in the wires[] array, which will give us
-    // a mapping to a gate
-    if wires[wireNum] != 0 {
-        return wires[wireNum]
-    } else {
-        return -1
+    // Gates are listed in topological order, but the output gates come
+    // before the gates that feed them, so work out the evaluation order once
+    // here
+    if !circ.validCircuit() || !circ.finalize() {
+        return &ParseError{0, "the circuit is not well formed"}
     }
+    return nil
 }
@@ -0,0 +1,160 @@
+package toygarble
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func parseTestCircuit(tb testing.TB, name string) *Circuit {
+    tb.Helper()
+    f, err := os.Open(filepath.Join("test-circuits", name))
+    if err != nil {
+        tb.Fatal(err)
+    }
+    defer f.Close()
+    circ := new(Circuit)
+    if err := ParseBRISTOLCircuitFile(circ, f); err != nil {
+        tb.Fatalf("%s: %v", name, err)
+    }
+    return circ
+}
+
+// Every bundled circuit parses, into the gates INSTRUCTIONS.txt says it has
+func TestParseTestCircuits(t *testing.T) {
+    counts := map[string][3]int{
+        // AND, XOR, INV
+        "adder64.txt":      {187, 127, 218},
+        "sub64.txt":        {187, 127, 249},
+        "neg64.txt":        {62, 63, 64},
+        "mult64.txt":       {7875, 3946, 5039},
+        "mult2_64.txt":     {14171, 4401, 9636},
+        "divide64.txt":     {8660, 6099, 4738},
+        "zero_equal.txt":   {63, 0, 64},
+        "aes_128.txt":      {6400, 28176, 2087},
+        "aes_192.txt":      {7168, 32080, 2317},
+        "aes_256.txt":      {8832, 39008, 2826},
+        "sha256.txt":       {22573, 110644, 1856},
+    }
+    files, _ := filepath.Glob(filepath.Join("test-circuits", "*.txt"))
+    parsed := 0
+    for _, file := range files {
+        name := filepath.Base(file)
+        want, ok := counts[name]
+        if !ok {
+            // CREDITS.txt and INSTRUCTIONS.txt
+            continue
+        }
+        circ := parseTestCircuit(t, name)
+        parsed++
+        var got [3]int
+        for _, gate := range circ.Gates {
+            switch gate.GateType {
+            case GateAND:
+                got[0]++
+            case GateXOR:
+                got[1]++
+            case GateNOT:
+                got[2]++
+            }
+        }
+        if got != want {
+            t.Errorf("%s: %v AND, XOR and INV gates, want %v", name, got, want)
+        }
+    }
+    if parsed != len(counts) {
+        t.Errorf("parsed %d of the %d circuits", parsed, len(counts))
+    }
+}
+
+// Every kind of line there is, on two 2 bit inputs a and b
+const allGatesCircuit = `11 16
+2 2 2
+1 4
+# constants
+1 1 1 4 EQ
+1 1 0 5 EQ
+
+4 2 0 1 2 3 6 7 MAND
+1 1 6 8 NOT
+2 1 7 4 9 OR
+2 1 8 5 10 XOR
+1 1 2 11 EQW
+1 1 10 12 EQW
+1 1 7 13 EQW
+1 1 9 14 INV
+1 1 11 15 EQW
+`
+
+func TestParseAllGates(t *testing.T) {
+    circ := new(Circuit)
+    if err := ParseBRISTOLCircuitFile(circ, strings.NewReader(allGatesCircuit)); err != nil {
+        t.Fatal(err)
+    }
+    if circ.NumInputWires != 4 || circ.NumOutputWires != 4 || circ.NumInputVars != 2 || circ.NumOutputVars != 1 {
+        t.Fatalf("got %d input wires in %d values and %d output wires in %d values", circ.NumInputWires, circ.NumInputVars, circ.NumOutputWires, circ.NumOutputVars)
+    }
+    for x := 0; x < 16; x++ {
+        a0, a1, b0, b1 := x & 1 != 0, x & 2 != 0, x & 4 != 0, x & 8 != 0
+        want := []bool{!(a0 && b0), a1 && b1, false, b0}
+        ok, got := circ.EvaluateCircuit([]bool{a0, a1, b0, b1})
+        if !ok {
+            t.Fatalf("could not evaluate")
+        }
+        for i := range want {
+            if got[i] != want[i] {
+                t.Errorf("input %04b: output %d is %t", x, i, got[i])
+            }
+        }
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    const header = "1 3\n1 2\n1 1\n"
+    cases := []struct {
+        name    string
+        file    string
+        line    int
+        reason  string
+    }{
+        {"empty", "", 0, "before the circuit size"},
+        {"short size line", "1\n", 1, "<numGates> <numWires>"},
+        {"bad gate count", "x 3\n", 1, "not a number"},
+        {"negative wire count", "1 -3\n", 1, "not a number"},
+        {"no input line", "1 3\n", 0, "before the input values"},
+        {"missing wire count", "1 3\n2 1\n", 2, "2 input values need 2 wire counts, found 1"},
+        {"no outputs", "1 3\n1 2\n0\n", 3, "no outputs"},
+        {"too few wires", "1 3\n1 2\n1 2\n", 3, "don't fit in 3 wires"},
+        {"huge wire count", "1 9223372036854775807\n1 1\n1 1\n2 1 0 0 5 AND\n", 1, "more than the"},
+        {"more gates than wires", "9223372036854775807 3\n1 2\n1 1\n2 1 0 1 2 AND\n", 1, "can't each write one of 3 wires"},
+        {"huge value wire counts", "1 3\n2 9223372036854775807 9223372036854775807\n1 1\n", 3, "don't fit in 3 wires"},
+        {"missing gate", header, 0, "before gate 1 of 1"},
+        {"unknown gate", header + "2 1 0 1 2 NAND\n", 4, `unknown gate type "NAND"`},
+        {"wrong field count", header + "2 1 0 2 AND\n", 4, "needs 6 fields, found 5"},
+        {"wrong arity", header + "1 1 0 2 AND\n", 4, "AND needs 2 inputs"},
+        {"reads its own output", header + "2 1 0 2 2 AND\n", 4, "wire 2 is read before it is written"},
+        {"wire out of range", header + "2 1 0 7 2 AND\n", 4, "wire 7 is out of range"},
+        {"writes an input", header + "2 1 0 1 1 AND\n", 4, "wire 1 is an input wire"},
+        {"bad wire", header + "2 1 0 one 2 AND\n", 4, `wire "one" is not a number`},
+        {"written twice", "2 3\n1 2\n1 1\n2 1 0 1 2 AND\n2 1 0 1 2 XOR\n", 5, "wire 2 is written twice"},
+        {"EQ constant", header + "1 1 2 2 EQ\n", 4, "not 0 or 1"},
+        {"EQ arity", header + "2 1 0 1 2 EQ\n", 4, "EQ needs 1 input"},
+        {"MAND arity", header + "3 1 0 1 0 2 MAND\n", 4, "MAND needs 2k inputs"},
+        {"extra gate", header + "2 1 0 1 2 AND\n2 1 0 1 2 AND\n", 5, "more than the 1 gates"},
+        {"output never written", "1 4\n1 2\n1 1\n2 1 0 1 2 AND\n", 0, "output wire 3 is never written"},
+        {"comments count as lines", "1 3\n# the inputs\n1 2\n1 1\n\n2 1 0 5 2 AND\n", 6, "wire 5 is out of range"},
+    }
+    for _, c := range cases {
+        err := ParseBRISTOLCircuitFile(new(Circuit), strings.NewReader(c.file))
+        var perr *ParseError
+        if !errors.As(err, &perr) {
+            t.Errorf("%s: got %v", c.name, err)
+            continue
+        }
+        if perr.Line != c.line || !strings.Contains(perr.Reason, c.reason) {
+            t.Errorf("%s: got %v, want line %d: ...%s...", c.name, err, c.line, c.reason)
+        }
+    }
+}
@@ -0,0 +1,139 @@
+package toygarble
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+)
+
+//
+// Writing circuits back out in Bristol Fashion, for anything else that reads
+// it (SCALE-MAMBA, MP-SPDZ, EMP) or for ParseBRISTOLCircuitFile to read back in.
+//
+
+var bristolGateNames = map[GateType_t]string{
+    GateAND:    "AND",
+    GateXOR:    "XOR",
+    GateOR:     "OR",
+    GateNOT:    "INV",
+    GateCOPY:   "EQW",
+}
+
+// The wire counts of the input or output values add up to the wires there are
+func checkValueWires(numVars int, numWires []int, total int, what string) error {
+    if numVars != len(numWires) {
+        return fmt.Errorf("toygarble: %d %s values but %d wire counts", numVars, what, len(numWires))
+    }
+    sum := 0
+    for _, n := range numWires {
+        sum += n
+    }
+    if sum != total {
+        return fmt.Errorf("toygarble: %s values have %d wires, the circuit has %d", what, sum, total)
+    }
+    return nil
+}
+
+//
+// Write the circuit in Bristol Fashion. Wires are numbered canonically: the
+// inputs first, then the output of every other gate in evaluation order, with
+// the last wires the outputs. A gate that drives an output writes the output
+// wire directly, outputs wired straight to an input or to a gate that already
+// drives an earlier output get an EQW. Every other gate is written one per
+// line, so parsing the result gives the same circuit back, gate for gate.
+func (circ *Circuit) WriteBristol(w io.Writer) error {
+    if !circ.validCircuit() {
+        return fmt.Errorf("toygarble: cannot write an invalid circuit")
+    }
+    if err := checkValueWires(circ.NumInputVars, circ.NumWiresIV, circ.NumInputWires, "input"); err != nil {
+        return err
+    }
+    if err := checkValueWires(circ.NumOutputVars, circ.NumWiresOV, circ.NumOutputWires, "output"); err != nil {
+        return err
+    }
+    order, ok := circ.evaluationOrder()
+    if !ok {
+        return fmt.Errorf("toygarble: cannot write a circuit with a cycle")
+    }
+
+    // The output, if any, each gate writes directly
+    drives := make([]int, len(circ.Gates))
+    for i := range drives {
+        drives[i] = -1
+    }
+    numGates := 0
+    for i := 0; i < circ.NumOutputWires; i++ {
+        from := circ.Gates[circ.getOutputGate(i)].InFrom[0]
+        switch circ.Gates[from].GateType {
+        case GateINPUT, GateOUTPUT:
+            numGates++
+        default:
+            if drives[from] == -1 {
+                drives[from] = i
+            } else {
+                numGates++
+            }
+        }
+    }
+    numInternal := 0
+    for gateID, gate := range circ.Gates {
+        if gate.GateType != GateINPUT && gate.GateType != GateOUTPUT {
+            numGates++
+            if drives[gateID] == -1 {
+                numInternal++
+            }
+        }
+    }
+    numWires := circ.NumInputWires + numInternal + circ.NumOutputWires
+    firstOutput := numWires - circ.NumOutputWires
+
+    bw := bufio.NewWriter(w)
+    fmt.Fprintf(bw, "%d %d\n", numGates, numWires)
+    fmt.Fprintf(bw, "%d", circ.NumInputVars)
+    for _, n := range circ.NumWiresIV {
+        fmt.Fprintf(bw, " %d", n)
+    }
+    fmt.Fprintf(bw, "\n%d", circ.NumOutputVars)
+    for _, n := range circ.NumWiresOV {
+        fmt.Fprintf(bw, " %d", n)
+    }
+    fmt.Fprintf(bw, "\n\n")
+
+    wires := make([]int, len(circ.Gates))
+    next := circ.NumInputWires
+    for _, gateID := range order {
+        gate := circ.Gates[gateID]
+        switch {
+        case gate.GateType == GateINPUT:
+            wires[gateID] = gateID
+            continue
+        case gate.GateType == GateOUTPUT:
+            wires[gateID] = firstOutput + (gateID - circ.NumInputWires)
+            if from := gate.InFrom[0]; drives[from] != gateID - circ.NumInputWires {
+                fmt.Fprintf(bw, "1 1 %d %d EQW\n", wires[from], wires[gateID])
+            }
+            continue
+        case drives[gateID] != -1:
+            wires[gateID] = firstOutput + drives[gateID]
+        default:
+            wires[gateID] = next
+            next++
+        }
+
+        switch gate.GateType {
+        case GateCONST:
+            value := 0
+            if gate.ConstVal {
+                value = 1
+            }
+            fmt.Fprintf(bw, "1 1 %d %d EQ\n", value, wires[gateID])
+        case GateAND, GateXOR, GateOR:
+            fmt.Fprintf(bw, "2 1 %d %d %d %s\n", wires[gate.InFrom[0]], wires[gate.InFrom[1]], wires[gateID], bristolGateNames[gate.GateType])
+        case GateNOT, GateCOPY:
+            fmt.Fprintf(bw, "1 1 %d %d %s\n", wires[gate.InFrom[0]], wires[gateID], bristolGateNames[gate.GateType])
+        default:
+            return fmt.Errorf("toygarble: gate %d has unknown type %d", gateID, gate.GateType)
+        }
+    }
+    return bw.Flush()
+}
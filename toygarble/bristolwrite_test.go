@@ -0,0 +1,117 @@
+package toygarble
+
+import (
+    "bytes"
+    mathRand "math/rand"
+    "strings"
+    "testing"
+)
+
+// Parse what WriteBristol writes for circ
+func roundTrip(t *testing.T, name string, circ *Circuit) (*Circuit, []byte) {
+    t.Helper()
+    var written bytes.Buffer
+    if err := circ.WriteBristol(&written); err != nil {
+        t.Fatalf("%s: %v", name, err)
+    }
+    parsed := new(Circuit)
+    if err := ParseBRISTOLCircuitFile(parsed, bytes.NewReader(written.Bytes())); err != nil {
+        t.Fatalf("%s: written circuit doesn't parse: %v", name, err)
+    }
+    return parsed, written.Bytes()
+}
+
+// Two circuits have the same inputs and outputs and agree on random inputs
+func checkEquivalent(t *testing.T, name string, a *Circuit, b *Circuit, trials int) {
+    t.Helper()
+    if a.NumInputWires != b.NumInputWires || a.NumOutputWires != b.NumOutputWires {
+        t.Fatalf("%s: %d inputs and %d outputs became %d and %d", name, a.NumInputWires, a.NumOutputWires, b.NumInputWires, b.NumOutputWires)
+    }
+    if !equalInts(a.NumWiresIV, b.NumWiresIV) || !equalInts(a.NumWiresOV, b.NumWiresOV) {
+        t.Fatalf("%s: values %v %v became %v %v", name, a.NumWiresIV, a.NumWiresOV, b.NumWiresIV, b.NumWiresOV)
+    }
+    r := mathRand.New(mathRand.NewSource(1))
+    for trial := 0; trial < trials; trial++ {
+        inputs := make([]bool, a.NumInputWires)
+        for i := range inputs {
+            inputs[i] = r.Intn(2) == 1
+        }
+        _, outA := a.EvaluateCircuit(inputs)
+        _, outB := b.EvaluateCircuit(inputs)
+        for i := range outA {
+            if outA[i] != outB[i] {
+                t.Fatalf("%s: output %d differs", name, i)
+            }
+        }
+    }
+}
+
+func equalInts(a []int, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func gateCounts(circ *Circuit) map[GateType_t]int {
+    counts := make(map[GateType_t]int)
+    for _, gate := range circ.Gates {
+        counts[gate.GateType]++
+    }
+    return counts
+}
+
+func TestWriteBristolRoundTrip(t *testing.T) {
+    files := []string{"adder64.txt", "sub64.txt", "neg64.txt", "mult64.txt", "mult2_64.txt", "divide64.txt", "zero_equal.txt", "aes_128.txt", "aes_192.txt", "aes_256.txt", "sha256.txt"}
+    for _, file := range files {
+        circ := parseTestCircuit(t, file)
+        parsed, written := roundTrip(t, file, circ)
+        checkEquivalent(t, file, circ, parsed, 4)
+        want, got := gateCounts(circ), gateCounts(parsed)
+        for gateType, n := range want {
+            if got[gateType] != n {
+                t.Errorf("%s: %d gates of type %d became %d", file, n, gateType, got[gateType])
+            }
+        }
+        // the numbering is canonical, writing it again changes nothing
+        if _, again := roundTrip(t, file, parsed); !bytes.Equal(written, again) {
+            t.Errorf("%s: writing the parsed circuit gives a different file", file)
+        }
+    }
+}
+
+// Outputs wired to inputs, to constants and to the same gate as another output
+func TestWriteBristolOutputs(t *testing.T) {
+    circ, err := GenerateModCircuit(12, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    parsed, _ := roundTrip(t, "generated", circ)
+    checkEquivalent(t, "generated", circ, parsed, 64)
+
+    circ = new(Circuit)
+    circ.initializeCircuit(2, 5, 1, 1, []int{2}, []int{5})
+    and := circ.addGate2(GateAND, 0, 1)
+    one := circ.addGate(GateCONST, true, nil)
+    circ.connectOutputWire(1, 0)
+    circ.connectOutputWire(and, 1)
+    circ.connectOutputWire(and, 2)
+    circ.connectOutputWire(one, 3)
+    circ.connectOutputWire(circ.getOutputGate(1), 4)
+    parsed, written := roundTrip(t, "hand built", circ)
+    checkEquivalent(t, "hand built", circ, parsed, 16)
+    want := "5 7\n1 2\n1 5\n\n1 1 1 2 EQW\n2 1 0 1 3 AND\n1 1 3 4 EQW\n1 1 1 5 EQ\n1 1 3 6 EQW\n"
+    if string(written) != want {
+        t.Errorf("got\n%s\nwant\n%s", written, want)
+    }
+
+    circ.NumWiresOV = []int{4}
+    if err := circ.WriteBristol(new(strings.Builder)); err == nil {
+        t.Errorf("wrote a circuit whose output values don't add up")
+    }
+}
@@ -0,0 +1,421 @@
+package toygarble
+
+import (
+    "fmt"
+)
+
+//
+// Writing circuits in Go instead of compiling them to Bristol files:
+//
+//   b := NewBuilder()
+//   r, n := b.Input(64), b.Input(24)
+//   b.Output(b.Mod(r, n))
+//   circ, err := b.Build()
+//
+// A Bit is one wire and a Word a little endian vector of them. Gates on
+// constants are folded away as they are built, so a constant only becomes a
+// gate if it is an output, and Build leaves out gates no output needs.
+//
+
+type Bit int
+
+const (
+    Zero    Bit = -1
+    One     Bit = -2
+)
+
+// Least significant bit first
+type Word []Bit
+
+type Builder struct {
+    // the gates so far, whose InFrom are the Bits they read
+    nodes       []Gate
+    inputs      []int
+    inputSizes  []int
+    outputs     []Bit
+    outputSizes []int
+    // the first thing that went wrong, returned by Build
+    err         error
+}
+
+func NewBuilder() *Builder {
+    return new(Builder)
+}
+
+func (b *Builder) fail(format string, args ...interface{}) {
+    if b.err == nil {
+        b.err = fmt.Errorf("toygarble: " + format, args...)
+    }
+}
+
+func (b *Builder) valid(x Bit) bool {
+    if x == Zero || x == One || (x >= 0 && int(x) < len(b.nodes)) {
+        return true
+    }
+    b.fail("bit %d is not from this builder", int(x))
+    return false
+}
+
+func (b *Builder) gate(gateType GateType_t, inFrom ...Bit) Bit {
+    in := make([]int, len(inFrom))
+    for i, x := range inFrom {
+        if !b.valid(x) {
+            return Zero
+        }
+        in[i] = int(x)
+    }
+    b.nodes = append(b.nodes, Gate{GateType: gateType, InFrom: in})
+    return Bit(len(b.nodes) - 1)
+}
+
+// Words of the same width, or the builder fails
+func (b *Builder) sameWidth(op string, x Word, y Word) bool {
+    if len(x) != len(y) {
+        b.fail("%s of a %d bit and a %d bit word", op, len(x), len(y))
+        return false
+    }
+    return true
+}
+
+//
+// Inputs and outputs
+//
+
+// The next input value, n wires wide
+func (b *Builder) Input(n int) Word {
+    if n < 1 {
+        b.fail("input of %d bits", n)
+        return nil
+    }
+    w := make(Word, n)
+    for i := range w {
+        b.nodes = append(b.nodes, Gate{GateType: GateINPUT})
+        b.inputs = append(b.inputs, len(b.nodes) - 1)
+        w[i] = Bit(len(b.nodes) - 1)
+    }
+    b.inputSizes = append(b.inputSizes, n)
+    return w
+}
+
+// The next output value
+func (b *Builder) Output(w Word) {
+    if len(w) == 0 {
+        b.fail("output of no bits")
+        return
+    }
+    for _, x := range w {
+        b.valid(x)
+    }
+    b.outputs = append(b.outputs, w...)
+    b.outputSizes = append(b.outputSizes, len(w))
+}
+
+// The low n bits of v
+func (b *Builder) Constant(v uint64, n int) Word {
+    w := make(Word, n)
+    for i := range w {
+        w[i] = Zero
+        if i < 64 && v >> uint(i) & 1 == 1 {
+            w[i] = One
+        }
+    }
+    return w
+}
+
+//
+// The circuit built so far: the inputs in the order they were added, then the
+// outputs, then every gate
+func (b *Builder) Build() (*Circuit, error) {
+    if b.err != nil {
+        return nil, b.err
+    }
+    if len(b.outputs) == 0 {
+        return nil, fmt.Errorf("toygarble: the circuit has no outputs")
+    }
+    circ := new(Circuit)
+    circ.initializeCircuit(len(b.inputs), len(b.outputs), len(b.inputSizes), len(b.outputSizes),
+        append([]int{}, b.inputSizes...), append([]int{}, b.outputSizes...))
+
+    // nodes only ever read earlier nodes, so going backwards sees every
+    // reader of a node before the node itself
+    live := make([]bool, len(b.nodes))
+    for _, x := range b.outputs {
+        if x >= 0 {
+            live[x] = true
+        }
+    }
+    for id := len(b.nodes) - 1; id >= 0; id-- {
+        if live[id] {
+            for _, in := range b.nodes[id].InFrom {
+                live[in] = true
+            }
+        }
+    }
+
+    gateOf := make([]int, len(b.nodes))
+    for i, id := range b.inputs {
+        gateOf[id] = circ.getInputGate(i)
+    }
+    for id, node := range b.nodes {
+        if node.GateType == GateINPUT || !live[id] {
+            continue
+        }
+        // every node reads nodes before it, which already have gates
+        inFrom := make([]int, len(node.InFrom))
+        for i, in := range node.InFrom {
+            inFrom[i] = gateOf[in]
+        }
+        gateOf[id] = circ.addGate(node.GateType, false, inFrom)
+    }
+
+    constGates := map[Bit]int{}
+    for i, x := range b.outputs {
+        var from int
+        switch x {
+        case Zero, One:
+            if _, ok := constGates[x]; !ok {
+                constGates[x] = circ.addGate(GateCONST, x == One, nil)
+            }
+            from = constGates[x]
+        default:
+            from = gateOf[x]
+        }
+        circ.connectOutputWire(from, i)
+    }
+    if !circ.validCircuit() || !circ.finalize() {
+        return nil, fmt.Errorf("toygarble: built an invalid circuit")
+    }
+    return circ, nil
+}
+
+//
+// Bits
+//
+
+func (b *Builder) And(x Bit, y Bit) Bit {
+    switch {
+    case x == Zero || y == Zero:
+        return Zero
+    case x == One:
+        return y
+    case y == One || x == y:
+        return x
+    }
+    return b.gate(GateAND, x, y)
+}
+
+func (b *Builder) Xor(x Bit, y Bit) Bit {
+    switch {
+    case x == Zero:
+        return y
+    case y == Zero:
+        return x
+    case x == y:
+        return Zero
+    case x == One:
+        return b.Not(y)
+    case y == One:
+        return b.Not(x)
+    }
+    return b.gate(GateXOR, x, y)
+}
+
+func (b *Builder) Not(x Bit) Bit {
+    switch {
+    case x == Zero:
+        return One
+    case x == One:
+        return Zero
+    case b.valid(x) && b.nodes[x].GateType == GateNOT:
+        return Bit(b.nodes[x].InFrom[0])
+    }
+    return b.gate(GateNOT, x)
+}
+
+func (b *Builder) Or(x Bit, y Bit) Bit {
+    switch {
+    case x == One || y == One:
+        return One
+    case x == Zero:
+        return y
+    case y == Zero || x == y:
+        return x
+    }
+    return b.gate(GateOR, x, y)
+}
+
+// x if sel is 1, otherwise y, for one AND
+func (b *Builder) Mux(sel Bit, x Bit, y Bit) Bit {
+    return b.Xor(y, b.And(sel, b.Xor(x, y)))
+}
+
+//
+// Words
+//
+
+func (b *Builder) AndWord(x Word, y Word) Word {
+    if !b.sameWidth("AND", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w := make(Word, len(x))
+    for i := range w {
+        w[i] = b.And(x[i], y[i])
+    }
+    return w
+}
+
+func (b *Builder) XorWord(x Word, y Word) Word {
+    if !b.sameWidth("XOR", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w := make(Word, len(x))
+    for i := range w {
+        w[i] = b.Xor(x[i], y[i])
+    }
+    return w
+}
+
+func (b *Builder) OrWord(x Word, y Word) Word {
+    if !b.sameWidth("OR", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w := make(Word, len(x))
+    for i := range w {
+        w[i] = b.Or(x[i], y[i])
+    }
+    return w
+}
+
+func (b *Builder) NotWord(x Word) Word {
+    w := make(Word, len(x))
+    for i := range w {
+        w[i] = b.Not(x[i])
+    }
+    return w
+}
+
+// x if sel is 1, otherwise y
+func (b *Builder) MuxWord(sel Bit, x Word, y Word) Word {
+    if !b.sameWidth("multiplex", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w := make(Word, len(x))
+    for i := range w {
+        w[i] = b.Mux(sel, x[i], y[i])
+    }
+    return w
+}
+
+// x + y mod 2^n, one AND per bit:
+//   sum   = x ^ y ^ c
+//   carry = c ^ ((x ^ c) & (y ^ c))
+func (b *Builder) Add(x Word, y Word) Word {
+    if !b.sameWidth("add", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w := make(Word, len(x))
+    carry := Zero
+    for i := range w {
+        w[i] = b.Xor(b.Xor(x[i], y[i]), carry)
+        if i < len(w) - 1 {
+            carry = b.Xor(carry, b.And(b.Xor(x[i], carry), b.Xor(y[i], carry)))
+        }
+    }
+    return w
+}
+
+// x - y mod 2^n and whether it borrowed, that is whether x < y unsigned:
+//   diff   = x ^ y ^ c
+//   borrow = c ^ ((y ^ c) & (x ^ y))
+// Also returns the y ^ c of every bit, which XORed back onto diff gives x.
+func (b *Builder) subBorrow(x Word, y Word) (Word, Word, Bit) {
+    w := make(Word, len(x))
+    back := make(Word, len(x))
+    borrow := Zero
+    for i := range w {
+        back[i] = b.Xor(y[i], borrow)
+        w[i] = b.Xor(x[i], back[i])
+        borrow = b.Xor(borrow, b.And(back[i], b.Xor(x[i], y[i])))
+    }
+    return w, back, borrow
+}
+
+// x - y mod 2^n
+func (b *Builder) Sub(x Word, y Word) Word {
+    if !b.sameWidth("subtract", x, y) {
+        return b.Constant(0, len(x))
+    }
+    w, _, _ := b.subBorrow(x, y)
+    return w
+}
+
+// x < y, unsigned
+func (b *Builder) LessThan(x Word, y Word) Bit {
+    if !b.sameWidth("compare", x, y) {
+        return Zero
+    }
+    _, _, borrow := b.subBorrow(x, y)
+    return borrow
+}
+
+func (b *Builder) Equal(x Word, y Word) Bit {
+    if !b.sameWidth("compare", x, y) {
+        return Zero
+    }
+    eq := One
+    for i := range x {
+        eq = b.And(eq, b.Not(b.Xor(x[i], y[i])))
+    }
+    return eq
+}
+
+// x << n, keeping the width of x
+func (b *Builder) ShiftLeft(x Word, n int) Word {
+    w := b.Constant(0, len(x))
+    if n < 0 {
+        b.fail("shift by %d", n)
+        return w
+    }
+    for i := n; i < len(x); i++ {
+        w[i] = x[i - n]
+    }
+    return w
+}
+
+// x >> n, unsigned, keeping the width of x
+func (b *Builder) ShiftRight(x Word, n int) Word {
+    w := b.Constant(0, len(x))
+    if n < 0 {
+        b.fail("shift by %d", n)
+        return w
+    }
+    for i := 0; i + n < len(x); i++ {
+        w[i] = x[i + n]
+    }
+    return w
+}
+
+//
+// x mod m for a modulus only known when the circuit is evaluated, as wide as m.
+// m = 0 gives x mod 2^len(m). Schoolbook restoring division: shift the next bit
+// of x into the remainder, subtract m and keep the difference unless that
+// borrowed. One AND per bit for the subtraction and one for the choice.
+func (b *Builder) Mod(x Word, m Word) Word {
+    if len(m) == 0 {
+        b.fail("mod by a word of no bits")
+        return nil
+    }
+    rem := b.Constant(0, len(m))
+    mWide := append(append(Word{}, m...), Zero)
+    for i := len(x) - 1; i >= 0; i-- {
+        // shifted = 2*rem + x_i, one bit wider than the remainder
+        shifted := append(Word{x[i]}, rem...)
+        diff, back, borrow := b.subBorrow(shifted, mWide)
+        // shifted if that borrowed, otherwise diff
+        rem = make(Word, len(m))
+        for j := range rem {
+            rem[j] = b.Xor(diff[j], b.And(borrow, back[j]))
+        }
+    }
+    return rem
+}
@@ -0,0 +1,223 @@
+package toygarble
+
+import (
+    mathRand "math/rand"
+    "strings"
+    "testing"
+)
+
+// Little endian bits of the values, each width bits wide
+func wordBits(width int, values ...uint64) []bool {
+    bits := make([]bool, 0, width * len(values))
+    for _, v := range values {
+        for i := 0; i < width; i++ {
+            bits = append(bits, v >> uint(i) & 1 == 1)
+        }
+    }
+    return bits
+}
+
+func bitsValue(bits []bool) uint64 {
+    v := uint64(0)
+    for i, bit := range bits {
+        if bit {
+            v |= 1 << uint(i)
+        }
+    }
+    return v
+}
+
+func buildCircuit(t *testing.T, b *Builder) *Circuit {
+    t.Helper()
+    circ, err := b.Build()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return circ
+}
+
+func countGates(circ *Circuit, gateType GateType_t) int {
+    n := 0
+    for _, gate := range circ.Gates {
+        if gate.GateType == gateType {
+            n++
+        }
+    }
+    return n
+}
+
+// Every operation on every pair of 4 bit words
+func TestBuilderWordOps(t *testing.T) {
+    const width = 4
+    const mask = 1 << width - 1
+    ops := []struct {
+        name    string
+        build   func(b *Builder, x Word, y Word) Word
+        want    func(x uint64, y uint64) uint64
+    }{
+        {"and", (*Builder).AndWord, func(x, y uint64) uint64 { return x & y }},
+        {"xor", (*Builder).XorWord, func(x, y uint64) uint64 { return x ^ y }},
+        {"or", (*Builder).OrWord, func(x, y uint64) uint64 { return x | y }},
+        {"not", func(b *Builder, x, y Word) Word { return b.NotWord(x) }, func(x, y uint64) uint64 { return ^x & mask }},
+        {"add", (*Builder).Add, func(x, y uint64) uint64 { return (x + y) & mask }},
+        {"sub", (*Builder).Sub, func(x, y uint64) uint64 { return (x - y) & mask }},
+        {"less than", func(b *Builder, x, y Word) Word { return Word{b.LessThan(x, y)} }, func(x, y uint64) uint64 {
+            if x < y {
+                return 1
+            }
+            return 0
+        }},
+        {"equal", func(b *Builder, x, y Word) Word { return Word{b.Equal(x, y)} }, func(x, y uint64) uint64 {
+            if x == y {
+                return 1
+            }
+            return 0
+        }},
+        {"mux", func(b *Builder, x, y Word) Word { return b.MuxWord(x[0], y, b.NotWord(y)) }, func(x, y uint64) uint64 {
+            if x & 1 == 1 {
+                return y
+            }
+            return ^y & mask
+        }},
+        {"shift left", func(b *Builder, x, y Word) Word { return b.ShiftLeft(x, 1) }, func(x, y uint64) uint64 { return x << 1 & mask }},
+        {"shift right", func(b *Builder, x, y Word) Word { return b.ShiftRight(x, 3) }, func(x, y uint64) uint64 { return x >> 3 }},
+        {"shift out", func(b *Builder, x, y Word) Word { return b.ShiftRight(x, width) }, func(x, y uint64) uint64 { return 0 }},
+        {"mod", (*Builder).Mod, func(x, y uint64) uint64 {
+            if y == 0 {
+                return x
+            }
+            return x % y
+        }},
+    }
+    for _, op := range ops {
+        b := NewBuilder()
+        x, y := b.Input(width), b.Input(width)
+        b.Output(op.build(b, x, y))
+        circ := buildCircuit(t, b)
+        for xv := uint64(0); xv <= mask; xv++ {
+            for yv := uint64(0); yv <= mask; yv++ {
+                ok, out := circ.EvaluateCircuit(wordBits(width, xv, yv))
+                if !ok {
+                    t.Fatalf("%s: could not evaluate", op.name)
+                }
+                if got, want := bitsValue(out), op.want(xv, yv); got != want {
+                    t.Errorf("%s(%d, %d) = %d, want %d", op.name, xv, yv, got, want)
+                }
+            }
+        }
+    }
+}
+
+//
+// GenerateModCircuit computes a mod b, and has exactly the gates it had when it
+// did its own restoring division instead of using Builder.Mod
+func TestGenerateModCircuit(t *testing.T) {
+    cases := []struct {
+        numBits int
+        modBits int
+        and     int
+        xor     int
+    }{
+        {20, 6, 259, 569},
+        {48, 8, 815, 1857},
+        {64, 24, 3135, 7569},
+    }
+    r := mathRand.New(mathRand.NewSource(1))
+    for _, c := range cases {
+        circ, err := GenerateModCircuit(c.numBits, c.modBits)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if and, xor := countGates(circ, GateAND), countGates(circ, GateXOR); and != c.and || xor != c.xor || len(circ.Gates) != c.numBits + 2 * c.modBits + and + xor {
+            t.Errorf("%d mod %d bits: %d gates, %d AND and %d XOR, want %d AND and %d XOR", c.numBits, c.modBits, len(circ.Gates), and, xor, c.and, c.xor)
+        }
+        for trial := 0; trial < 200; trial++ {
+            a := r.Uint64() & (1 << uint(c.numBits) - 1)
+            m := r.Uint64() & (1 << uint(c.modBits) - 1)
+            if trial == 0 {
+                m = 0
+            }
+            want := a & (1 << uint(c.modBits) - 1)
+            if m != 0 {
+                want = a % m
+            }
+            _, out := circ.EvaluateCircuit(append(wordBits(c.numBits, a), wordBits(c.modBits, m)...))
+            if got := bitsValue(out); got != want {
+                t.Errorf("%d mod %d = %d, want %d", a, m, got, want)
+            }
+        }
+    }
+}
+
+// The whole Fractional predicate, random mod n < p, in one circuit
+func TestBuilderFractionalPredicate(t *testing.T) {
+    const randBits, gamma = 24, 8
+    b := NewBuilder()
+    random, n, p := b.Input(randBits), b.Input(gamma), b.Input(gamma)
+    b.Output(Word{b.LessThan(b.Mod(random, n), p)})
+    circ := buildCircuit(t, b)
+
+    r := mathRand.New(mathRand.NewSource(1))
+    for trial := 0; trial < 200; trial++ {
+        rv := r.Uint64() & (1 << randBits - 1)
+        nv := r.Uint64() & (1 << gamma - 1) | 1
+        pv := r.Uint64() & (1 << gamma - 1)
+        inputs := append(wordBits(randBits, rv), wordBits(gamma, nv, pv)...)
+        _, out := circ.EvaluateCircuit(inputs)
+        if out[0] != (rv % nv < pv) {
+            t.Errorf("%d mod %d < %d gave %t", rv, nv, pv, out[0])
+        }
+    }
+
+    // and garbles like any other circuit
+    for _, scheme := range []GarblingScheme{GarblingSimple, GarblingHalfGates} {
+        checkGarbledMatches(t, "fractional predicate", circ, scheme)
+    }
+}
+
+func TestBuilderConstants(t *testing.T) {
+    b := NewBuilder()
+    x := b.Input(4)
+    zero := b.Constant(0, 4)
+    // all of these fold away
+    b.Output(b.AndWord(x, zero))
+    b.Output(b.XorWord(x, zero))
+    b.Output(b.NotWord(b.NotWord(x)))
+    b.Output(b.Add(x, zero))
+    b.Output(b.Constant(0xa, 4))
+    circ := buildCircuit(t, b)
+    // the NOTs under the double NOT aren't needed by any output either
+    if n := len(circ.Gates) - circ.NumInputWires - circ.NumOutputWires; n != 2 || countGates(circ, GateCONST) != 2 {
+        t.Errorf("%d gates, want just the two constants", n)
+    }
+    for xv := uint64(0); xv < 16; xv++ {
+        _, out := circ.EvaluateCircuit(wordBits(4, xv))
+        if got := bitsValue(out); got != 0xa << 16 | xv << 12 | xv << 8 | xv << 4 {
+            t.Errorf("x = %d: got %#x", xv, got)
+        }
+    }
+    for _, scheme := range []GarblingScheme{GarblingSimple, GarblingHalfGates} {
+        checkGarbledMatches(t, "constants", circ, scheme)
+    }
+}
+
+func TestBuilderErrors(t *testing.T) {
+    cases := []struct {
+        name    string
+        build   func(b *Builder)
+        reason  string
+    }{
+        {"no outputs", func(b *Builder) { b.Input(2) }, "no outputs"},
+        {"widths", func(b *Builder) { b.Output(b.Add(b.Input(2), b.Input(3))) }, "add of a 2 bit and a 3 bit word"},
+        {"empty input", func(b *Builder) { b.Output(b.Input(0)) }, "input of 0 bits"},
+        {"foreign bit", func(b *Builder) { b.Output(Word{b.Not(Bit(7))}) }, "bit 7 is not from this builder"},
+        {"negative shift", func(b *Builder) { b.Output(b.ShiftLeft(b.Input(2), -1)) }, "shift by -1"},
+    }
+    for _, c := range cases {
+        b := NewBuilder()
+        c.build(b)
+        if _, err := b.Build(); err == nil || !strings.Contains(err.Error(), c.reason) {
+            t.Errorf("%s: got %v", c.name, err)
+        }
+    }
+}
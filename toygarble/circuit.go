@@ -1,7 +1,6 @@
 package toygarble
 
 import (
-    "os"
     "fmt"
 )
 
@@ -43,7 +42,13 @@ type Circuit struct {
     NumOutputVars    int
     NumWiresOV       []int
     
+    // Not to be edited once the circuit has come out of NewCircuit, a parser or
+    // a Builder: the evaluation order is worked out then and kept. Build a new
+    // circuit instead (see toygarble/opt).
     Gates           []Gate
+
+    // every gate after the gates it reads from, see finalize
+    order           []int
 }
 
 type Gate struct {
@@ -78,6 +83,50 @@ func (circ *Circuit) initializeCircuit(numInputWires int, numOutputWires int, nu
     }
 }
 
+//
+// A circuit from its gates, laid out the way the parsers lay them out: one
+// INPUT gate per input wire, then one OUTPUT gate per output wire, whose InFrom
+// is the gate driving it, then everything else in any order. For building
+// circuits outside this package; the gates are used as they are, not copied.
+func NewCircuit(numWiresPerIV []int, numWiresPerOV []int, gates []Gate) (*Circuit, error) {
+    numInputWires, numOutputWires := 0, 0
+    for _, n := range numWiresPerIV {
+        numInputWires += n
+    }
+    for _, n := range numWiresPerOV {
+        numOutputWires += n
+    }
+    if numOutputWires < 1 || len(gates) < numInputWires + numOutputWires {
+        return nil, fmt.Errorf("toygarble: %d gates for %d input and %d output wires", len(gates), numInputWires, numOutputWires)
+    }
+    for i, gate := range gates {
+        switch {
+        case gate.GateType < 0 || int(gate.GateType) >= len(min_input_wires):
+            return nil, fmt.Errorf("toygarble: gate %d has unknown type %d", i, gate.GateType)
+        case i < numInputWires && gate.GateType != GateINPUT:
+            return nil, fmt.Errorf("toygarble: gate %d is for an input wire but not an INPUT gate", i)
+        case i >= numInputWires && i < numInputWires + numOutputWires && (gate.GateType != GateOUTPUT || len(gate.InFrom) != 1):
+            return nil, fmt.Errorf("toygarble: gate %d is for an output wire but not a connected OUTPUT gate", i)
+        case i >= numInputWires + numOutputWires && (gate.GateType == GateINPUT || gate.GateType == GateOUTPUT):
+            return nil, fmt.Errorf("toygarble: gate %d is an extra input or output", i)
+        }
+    }
+
+    circ := &Circuit{
+        NumInputWires:  numInputWires,
+        NumOutputWires: numOutputWires,
+        NumInputVars:   len(numWiresPerIV),
+        NumWiresIV:     append([]int{}, numWiresPerIV...),
+        NumOutputVars:  len(numWiresPerOV),
+        NumWiresOV:     append([]int{}, numWiresPerOV...),
+        Gates:          gates,
+    }
+    if !circ.validCircuit() || !circ.finalize() {
+        return nil, fmt.Errorf("toygarble: the gates have the wrong number of inputs, read gates that don't exist or form a cycle")
+    }
+    return circ, nil
+}
+
 // Adds a new gate. Returns -1 if the gate is invalid.
 func (circ *Circuit) addGate(gateType GateType_t, constVal bool, inFrom []int) int {
     // Make sure the gate has the correct number of input wires
@@ -88,6 +137,7 @@ func (circ *Circuit) addGate(gateType GateType_t, constVal bool, inFrom []int) i
     
     newGate := Gate{gateType, constVal, inFrom}
     circ.Gates = append(circ.Gates, newGate)
+    circ.order = nil
     return len(circ.Gates) - 1
 }
 
@@ -104,6 +154,7 @@ func (circ *Circuit) connectOutputWire(gateNum int, outputNum int) bool {
     //fmt.Printf("connectOutputWire(%d, %d)\n", gateNum, circ.getOutputGate(outputNum))
     if len((circ.Gates[circ.getOutputGate(outputNum)].InFrom)) == 0 {
         circ.Gates[circ.getOutputGate(outputNum)].InFrom = append(circ.Gates[circ.getOutputGate(outputNum)].InFrom, gateNum)
+        circ.order = nil
         return true
     } else {
         return false
@@ -131,183 +182,132 @@ func (circ *Circuit) validCircuit() bool {
 }
 
 // Circuit evaluation on concrete inputs. Returns success/failure and a list of output bits.
-// Inefficient algorithm used for testing.
+// One pass over the gates in evaluation order.
 func (circ *Circuit) EvaluateCircuit(inputBits []bool) (bool, []bool) {
     // Make sure the number of input and output gates is correct
-    if len(inputBits) != circ.NumInputWires || circ.NumOutputWires < 1 {
+    if len(inputBits) != circ.NumInputWires || circ.NumOutputWires < 1 || !circ.validCircuit() {
+        return false, nil
+    }
+    order, ok := circ.evaluationOrder()
+    if !ok {
         return false, nil
     }
     
-    // Allocate return var and scratch variables to hold onto intermediate values
-    visited := make([]bool, len(circ.Gates))    // defaults to all false
-    calculated := make([]bool, len(circ.Gates)) // defaults to all false
-    values := make([]bool, len(circ.Gates)) // defaults to all false
-    result := make([]bool, circ.NumOutputWires)    // defaults to all false
-    
-    // For each output gate, recursively evaluate the entire circuit
-    // using the scratch variables
-    for i := 0; i < circ.NumOutputWires; i++ {
-        // Initialize the visited array to all zero, except for this output gate
-        for j := range visited {
-            visited[j] = false
-        }
-        
-        // Evaluate the output gate to get a result, error out if it fails
-        success, resultBit := circ.evaluateGate(circ.getOutputGate(i), &visited, &calculated, &values, &inputBits)
-        result[i] = resultBit
-        if success == false {
-            fmt.Printf("Failed\n")
+    values := make([]bool, len(circ.Gates))
+    for _, gateID := range order {
+        gate := circ.Gates[gateID]
+        switch gate.GateType {
+        case GateINPUT:
+            if gateID >= len(inputBits) {
+                return false, nil
+            }
+            values[gateID] = inputBits[gateID]
+        case GateOUTPUT, GateCOPY:
+            values[gateID] = values[gate.InFrom[0]]
+        case GateNOT:
+            values[gateID] = !values[gate.InFrom[0]]
+        case GateAND:
+            values[gateID] = values[gate.InFrom[0]] && values[gate.InFrom[1]]
+        case GateOR:
+            values[gateID] = values[gate.InFrom[0]] || values[gate.InFrom[1]]
+        case GateXOR:
+            values[gateID] = values[gate.InFrom[0]] != values[gate.InFrom[1]]
+        case GateCONST:
+            values[gateID] = gate.ConstVal
+        default:
             return false, nil
         }
     }
     
-    // Success
+    result := make([]bool, circ.NumOutputWires)
+    for i := range result {
+        result[i] = values[circ.getOutputGate(i)]
+    }
     return true, result
 }
-        
-// Gate evaluation for concrete inputs, recursive subroutine
-func (circ *Circuit) evaluateGate(gateID int, visited *[]bool, calculated *[]bool, values *[]bool, inputs *[]bool) (bool, bool) {
-
-    var success1    bool
-    var success2    bool
-    var result1     bool
-    var result2     bool
 
-    // If the gate has already been visited, but not calculated, we're in a loop -- return an error
-    if (*visited)[gateID] == true && (*calculated)[gateID] == false {
-        return false, false
-    }
-    
-    // If the gate has been calculated, we're done (but in a good way). Return the cached value.
-    if (*calculated)[gateID] == true {
-        return true, (*values)[gateID]
-    }
-    
-    // Evaluate the gate
-    (*visited)[gateID] = true
-    result := false
-    success := true
-    
-    // If this is not an input "gate", recurse on any inputs
-    if circ.Gates[gateID].GateType != GateINPUT {
-        success1, result1 = circ.evaluateGate(circ.Gates[gateID].InFrom[0], visited, calculated, values, inputs)
-        
-        if len(circ.Gates[gateID].InFrom) == 2 {
-            success2, result2 = circ.evaluateGate(circ.Gates[gateID].InFrom[1], visited, calculated, values, inputs)
-        }
+//
+// Work out the order the gates are evaluated in once the circuit is built, so
+// evaluating and garbling don't have to. Returns false if the circuit has a
+// cycle or reads from a gate that doesn't exist.
+func (circ *Circuit) finalize() bool {
+    order, ok := circ.topologicalOrder()
+    if !ok {
+        return false
     }
-    
-    switch circ.Gates[gateID].GateType {
-    case GateINPUT:
-        //fmt.Printf("Evaluating IN  gate %d\n", gateID)
-        result = (*inputs)[gateID] // TODO: change this in case input gates aren't 0-aligned
-        
-    case GateOUTPUT:
-        // Output "gates" are equal to whatever (solitary) predecessor gate they're wired to,
-        // so we recurse on that
-        if len(circ.Gates[gateID].InFrom) == 1 {
-            //fmt.Printf("Evaluating OUT gate %d\n", gateID)
-            success = success1
-            result = result1
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating output 'gate', wrong number of input wires")
-        }
-        
-        //fmt.Printf("Success\n")
-    case GateCOPY:
-        if len(circ.Gates[gateID].InFrom) == 1 {
-            success = success1
-            result = result1
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating copy gate, there should only be one input")
-        }
-        
-    case GateAND:
-        // AND gates must have two inputs, which we recurse on
-        if len(circ.Gates[gateID].InFrom) == 2 {
-            //fmt.Printf("Evaluating AND gate %d\n", gateID)
+    circ.order = order
+    return true
+}
 
-            if (success1 && success2) == true {
-                result = result1 && result2
-            } else {
-                fmt.Printf("AND error\n")
-                success = false
-            }
-            
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating AND 'gate', wrong number of input wires")
-        }
-    
-    case GateXOR:
-        // XOR gates must have two inputs, which we recurse on
-        if len(circ.Gates[gateID].InFrom) == 2 {
-            //fmt.Printf("Evaluating XOR gate %d\n", gateID)
+//
+// The order from finalize, or worked out now for a Circuit put together by hand
+// or still being built in this package (addGate and connectOutputWire drop the
+// saved order). Edits to Gates from outside aren't noticed, see Circuit.
+func (circ *Circuit) evaluationOrder() ([]int, bool) {
+    if circ.order != nil {
+        return circ.order, true
+    }
+    return circ.topologicalOrder()
+}
 
-            if (success1 && success2) == true {
-                result = result1 != result2
-            } else {
-                fmt.Printf("XOR error\n")
-                success = false
-            }
-            
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating XOR 'gate', wrong number of input wires")
-        }
-        
-    case GateCONST:
-        // CONST gates have no inputs, only a constant, which we encode in
-        // the wire number as a hack
-        if len(circ.Gates[gateID].InFrom) == 0 {
-            //fmt.Printf("Evaluating CONST gate %d\n", gateID)
-            result = circ.Gates[gateID].ConstVal
-        }
-        
-    case GateOR:
-        // OR gates must have two inputs, which we recurse on
-        if len(circ.Gates[gateID].InFrom) == 2 {
-            //fmt.Printf("Evaluating OR gate %d\n", gateID)
+// A copy of the order the gates are evaluated and garbled in, see topologicalOrder
+func (circ *Circuit) EvaluationOrder() ([]int, bool) {
+    order, ok := circ.evaluationOrder()
+    if !ok {
+        return nil, false
+    }
+    return append([]int{}, order...), true
+}
 
-            if success1 && success2 == true {
-                result = result1 || result2
-            } else {
-                success = false
-            }
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating AND 'gate', wrong number of input wires")
+//
+// The gates in an order where every gate comes after the gates it reads from,
+// or false if the circuit has a cycle or reads from a gate that doesn't exist.
+// Depth first but without recursion, so long carry chains can't exhaust the stack.
+// A gate's first input is placed before its second, as a recursive walk would.
+func (circ *Circuit) topologicalOrder() ([]int, bool) {
+    const (
+        unvisited   byte = 0
+        onPath      byte = 1
+        done        byte = 2
+    )
+    state := make([]byte, len(circ.Gates))
+    order := make([]int, 0, len(circ.Gates))
+    stack := make([]int, 0)
+    for root := range circ.Gates {
+        if state[root] != unvisited {
+            continue
         }
-            
-    case GateNOT:
-        // NOT gates must have one input, which we recurse on
-        if len(circ.Gates[gateID].InFrom) == 1 {
-            if success1 == true {
-                result = !result1
-            } else {
-                success = false
+        stack = append(stack, root)
+        for len(stack) > 0 {
+            gateID := stack[len(stack)-1]
+            switch state[gateID] {
+            case unvisited:
+                // leave it on the stack until everything it reads is done
+                state[gateID] = onPath
+                if circ.Gates[gateID].GateType == GateINPUT {
+                    continue
+                }
+                inFrom := circ.Gates[gateID].InFrom
+                for i := len(inFrom) - 1; i >= 0; i-- {
+                    in := inFrom[i]
+                    if in < 0 || in >= len(circ.Gates) || state[in] == onPath {
+                        return nil, false
+                    }
+                    if state[in] == unvisited {
+                        stack = append(stack, in)
+                    }
+                }
+            case onPath:
+                state[gateID] = done
+                order = append(order, gateID)
+                stack = stack[:len(stack)-1]
+            default:
+                // pushed twice, already placed
+                stack = stack[:len(stack)-1]
             }
-        } else {
-            success = false
-            os.Stderr.WriteString("Error evaluating NOT 'gate', wrong number of input wires")
         }
-            
-        default:
-            fmt.Printf("Unknown gate type %d for %d\n", circ.Gates[gateID].GateType, gateID)
-            success = false
-
     }
-    
-    if success == false {
-        fmt.Printf("Error in gate %d\n", gateID)
-    } else {
-        (*calculated)[gateID] = true
-        (*values)[gateID] = result
-    }
-
-    return success, result
+    return order, true
 }
 
 // Get the gate identities corresponding to specific input wires
@@ -0,0 +1,66 @@
+package toygarble
+
+import (
+    "testing"
+)
+
+func TestNewCircuit(t *testing.T) {
+    input, output := Gate{GateType: GateINPUT}, func(from int) Gate { return Gate{GateType: GateOUTPUT, InFrom: []int{from}} }
+    and := Gate{GateType: GateAND, InFrom: []int{0, 1}}
+
+    circ, err := NewCircuit([]int{1, 1}, []int{1}, []Gate{input, input, output(3), and})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if circ.NumInputWires != 2 || circ.NumInputVars != 2 || circ.NumOutputWires != 1 || circ.NumOutputVars != 1 {
+        t.Errorf("got %d input wires in %d values and %d output wires in %d", circ.NumInputWires, circ.NumInputVars, circ.NumOutputWires, circ.NumOutputVars)
+    }
+    for _, x := range []int{0, 1} {
+        for _, y := range []int{0, 1} {
+            if _, out := circ.EvaluateCircuit([]bool{x == 1, y == 1}); out[0] != (x & y == 1) {
+                t.Errorf("%d AND %d gave %t", x, y, out[0])
+            }
+        }
+    }
+
+    cases := []struct {
+        name    string
+        gates   []Gate
+    }{
+        {"too few gates", []Gate{input, input}},
+        {"input not an INPUT", []Gate{input, and, output(1)}},
+        {"output not connected", []Gate{input, input, {GateType: GateOUTPUT}, and}},
+        {"extra input", []Gate{input, input, output(3), and, input}},
+        {"unknown type", []Gate{input, input, output(3), {GateType: 42}}},
+        {"wrong inputs", []Gate{input, input, output(3), {GateType: GateAND, InFrom: []int{0}}}},
+        {"missing gate", []Gate{input, input, output(4), and}},
+        {"cycle", []Gate{input, input, output(3), {GateType: GateAND, InFrom: []int{0, 4}}, {GateType: GateNOT, InFrom: []int{3}}}},
+    }
+    for _, c := range cases {
+        if _, err := NewCircuit([]int{1, 1}, []int{1}, c.gates); err == nil {
+            t.Errorf("%s: no error", c.name)
+        }
+    }
+}
+
+// Adding a gate drops the order finalize worked out, so the new gate gets one
+func TestEvaluationOrderAfterAddGate(t *testing.T) {
+    input, and := Gate{GateType: GateINPUT}, Gate{GateType: GateAND, InFrom: []int{0, 1}}
+    circ, err := NewCircuit([]int{1, 1}, []int{1}, []Gate{input, input, {GateType: GateOUTPUT, InFrom: []int{3}}, and})
+    if err != nil {
+        t.Fatal(err)
+    }
+    not := circ.addGate(GateNOT, false, []int{3})
+    order, ok := circ.evaluationOrder()
+    if !ok || len(order) != len(circ.Gates) {
+        t.Fatalf("order has %d of %d gates", len(order), len(circ.Gates))
+    }
+    for _, gateID := range order {
+        if gateID == 3 {
+            break
+        }
+        if gateID == not {
+            t.Errorf("NOT of gate 3 comes before it")
+        }
+    }
+}
@@ -0,0 +1,45 @@
+package toygarble
+
+import (
+    "crypto/rand"
+    "testing"
+)
+
+var benchmarkCircuits = []string{"sha256.txt", "aes_128.txt"}
+
+func BenchmarkEvaluateCircuit(b *testing.B) {
+    for _, name := range benchmarkCircuits {
+        circ := parseTestCircuit(b, name)
+        inputs := make([]bool, circ.NumInputWires)
+        b.Run(name, func(b *testing.B) {
+            for n := 0; n < b.N; n++ {
+                if ok, _ := circ.EvaluateCircuit(inputs); !ok {
+                    b.Fatal("could not evaluate")
+                }
+            }
+        })
+    }
+}
+
+func BenchmarkEvaluateGarbledCircuit(b *testing.B) {
+    for _, name := range benchmarkCircuits {
+        circ := parseTestCircuit(b, name)
+        for _, scheme := range []GarblingScheme{GarblingSimple, GarblingHalfGates} {
+            garb, _ := NewGarbledCircuit(scheme, CipherFixedKeyAES)
+            if !garb.GarbleCircuit(circ, rand.Reader) {
+                b.Fatalf("could not garble %s", name)
+            }
+            inputLabels := make([]Label_t, circ.NumInputWires)
+            for i, labels := range garb.GetInputWireLabels() {
+                inputLabels[i] = labels.WireLabelPair[0]
+            }
+            b.Run(name + "/" + scheme.String(), func(b *testing.B) {
+                for n := 0; n < b.N; n++ {
+                    if ok, _ := garb.EvaluateCircuit(circ, inputLabels); !ok {
+                        b.Fatal("could not evaluate")
+                    }
+                }
+            })
+        }
+    }
+}
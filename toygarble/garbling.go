@@ -0,0 +1,65 @@
+package toygarble
+
+import (
+    "fmt"
+    "io"
+)
+
+//
+// The garbling schemes a circuit can be garbled with
+//
+
+type GarblingScheme byte
+
+const (
+    // SimpleGarbledCircuit: point-and-permute with 4-row tables for AND/OR
+    // and 2-row tables for NOT and OUTPUT
+    GarblingSimple      GarblingScheme = 1
+    // HalfGatesGarbledCircuit: two ciphertexts per AND, free XOR and NOT
+    GarblingHalfGates   GarblingScheme = 2
+)
+
+func (s GarblingScheme) String() string {
+    switch s {
+    case GarblingSimple:
+        return "simple"
+    case GarblingHalfGates:
+        return "half-gates"
+    }
+    return fmt.Sprintf("GarblingScheme(%d)", byte(s))
+}
+
+//
+// What every garbling scheme provides. The garbler calls GarbleCircuit and hands
+// out input labels from GetInputWireLabels along with PackedMarshal, the
+// evaluator calls PackedUnmarshal, EvaluateCircuit and DecodeOutputLabels.
+type GarbledCircuit interface {
+    GarbleCircuit(circ *Circuit, random io.Reader) bool
+    GetInputWireLabels() []SimpleWireLabelSet
+    PackedMarshal() []byte
+    PackedUnmarshal(b []byte, c *Circuit) error
+    EvaluateCircuit(circ *Circuit, inputLabels []Label_t) (bool, []Label_t)
+    // the output bits of an evaluation as a binary string, most significant
+    // (last output wire) first
+    DecodeOutputLabels(outLabels []Label_t) (string, error)
+}
+
+//
+// An empty garbled circuit of the given scheme, encrypting with the given cipher
+func NewGarbledCircuit(scheme GarblingScheme, cipherID GateCipherID) (GarbledCircuit, error) {
+    gateCipher, err := NewGateCipher(cipherID)
+    if err != nil {
+        return nil, err
+    }
+    switch scheme {
+    case GarblingSimple:
+        return &SimpleGarbledCircuit{Cipher: gateCipher}, nil
+    case GarblingHalfGates:
+        return &HalfGatesGarbledCircuit{Cipher: gateCipher}, nil
+    }
+    return nil, fmt.Errorf("unknown garbling scheme %d", byte(scheme))
+}
+
+func (garb *SimpleGarbledCircuit) DecodeOutputLabels(outLabels []Label_t) (string, error) {
+    return decodeOutputLabels(outLabels, garb.OutputDecoding)
+}
@@ -0,0 +1,127 @@
+package toygarble
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/binary"
+    "fmt"
+    "golang.org/x/crypto/blake2b"
+)
+
+//
+// The hash garbled tables are encrypted with
+//
+
+type GateCipher interface {
+    // H(a, b, tweak) for a gate reading labels a and b, b is nil for gates
+    // with one input. Labels are at most LABEL_LEN_BYTES long.
+    Hash(a Label_t, b Label_t, tweak uint64) Label_t
+}
+
+type GateCipherID byte
+
+const (
+    // BLAKE2b-128(tweak || a || b)
+    CipherBLAKE2b       GateCipherID = 1
+    // fixed-key AES, see FixedKeyAESCipher
+    CipherFixedKeyAES   GateCipherID = 2
+)
+
+func (id GateCipherID) String() string {
+    switch id {
+    case CipherBLAKE2b:
+        return "BLAKE2b"
+    case CipherFixedKeyAES:
+        return "fixed-key AES"
+    }
+    return fmt.Sprintf("GateCipherID(%d)", byte(id))
+}
+
+func NewGateCipher(id GateCipherID) (GateCipher, error) {
+    switch id {
+    case CipherBLAKE2b:
+        return BLAKE2bCipher{}, nil
+    case CipherFixedKeyAES:
+        return FixedKeyAESCipher{}, nil
+    }
+    return nil, fmt.Errorf("unknown gate cipher %d", byte(id))
+}
+
+// What the garbled circuits use when their Cipher is nil
+var defaultGateCipher GateCipher = FixedKeyAESCipher{}
+
+type BLAKE2bCipher struct{}
+
+func (BLAKE2bCipher) Hash(a Label_t, b Label_t, tweak uint64) Label_t {
+    h, _ := blake2b.New(LABEL_LEN_BYTES, nil)
+    var t [8]byte
+    binary.BigEndian.PutUint64(t[:], tweak)
+    h.Write(t[:])
+    h.Write(a)
+    if b != nil {
+        h.Write(b)
+    }
+    return h.Sum(nil)
+}
+
+//
+// Fixed-key AES in the style of JustGarble (Bellare, Hoang, Keelveedhi, Rogaway,
+// "Efficient Garbling from a Fixed-Key Blockcipher"):
+//
+//   K = 2a ^ 4b ^ tweak,  H(a, b, tweak) = AES_k(K) ^ K
+//
+// with doubling in GF(2^128) and k a public constant, so the key schedule is
+// done once and every hash is a single block encryption (AES-NI where the CPU
+// has it). Labels shorter than a block are zero padded.
+type FixedKeyAESCipher struct{}
+
+// the first 16 bytes of SHA-256("toygarble fixed-key AES")
+var fixedAESKey = []byte{
+    0xa6, 0xf3, 0xc0, 0xa5, 0xc5, 0x7a, 0x92, 0xbf,
+    0x0d, 0x69, 0x07, 0xc1, 0x02, 0x47, 0x39, 0x4d,
+}
+
+var fixedKeyAES cipher.Block
+
+func init() {
+    var err error
+    if fixedKeyAES, err = aes.NewCipher(fixedAESKey); err != nil {
+        panic(err)
+    }
+}
+
+//
+// Multiply a 16 byte big endian block by x in GF(2^128) mod x^128 + x^7 + x^2 + x + 1
+func doubleBlock(block *[16]byte) {
+    carry := block[0] >> 7
+    for i := 0; i < 15; i++ {
+        block[i] = block[i] << 1 | block[i+1] >> 7
+    }
+    block[15] = block[15] << 1 ^ 0x87 * carry
+}
+
+func (FixedKeyAESCipher) Hash(a Label_t, b Label_t, tweak uint64) Label_t {
+    var k, kb [16]byte
+    copy(k[:], a)
+    doubleBlock(&k)
+    if b != nil {
+        copy(kb[:], b)
+        doubleBlock(&kb)
+        doubleBlock(&kb)
+        for i := range k {
+            k[i] ^= kb[i]
+        }
+    }
+    var t [8]byte
+    binary.BigEndian.PutUint64(t[:], tweak)
+    for i := range t {
+        k[8+i] ^= t[i]
+    }
+
+    out := make(Label_t, LABEL_LEN_BYTES)
+    fixedKeyAES.Encrypt(out, k[:])
+    for i := range out {
+        out[i] ^= k[i]
+    }
+    return out
+}
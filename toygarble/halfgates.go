@@ -0,0 +1,279 @@
+package toygarble
+
+import (
+    "fmt"
+    "io"
+)
+
+//
+// Half-gates garbling (Zahur, Rosulek, Evans, "Two Halves Make a Whole",
+// EUROCRYPT 2015). Every wire has labels W0 and W1 = W0 ^ Delta with the point
+// and permute bit in the last bit of the label, so
+//
+//   XOR, NOT, COPY and OUTPUT gates cost nothing
+//   AND gates cost two ciphertexts, OR gates are rewritten a & b ^ a ^ b
+//   CONST gates publish the label of their value
+//
+// and the outputs are decoded with one public bit per output wire instead of
+// through an output table.
+//
+
+type HalfGatesGarbledCircuit struct {
+    NumInputWires           int
+    NumOutputWires          int
+    // tables of the AND, OR and CONST gates, empty for everything else
+    GarbledGates            []SimpleGarbledGate
+    // the point and permute bit of each output wire's 0 label
+    OutputDecoding          []byte
+    // only known to the garbler
+    WireLabels              []SimpleWireLabelSet
+    FreeXORDelta            Label_t
+    // what the halves are hashed with, nil for fixed-key AES
+    Cipher                  GateCipher
+}
+
+// Table rows each gate type needs
+func halfGatesTableSize(gateType GateType_t) int {
+    switch gateType {
+    case GateAND, GateOR:
+        return 2
+    case GateCONST:
+        return 1
+    }
+    return 0
+}
+
+func permuteBit(label Label_t) byte {
+    return label[LABEL_LEN_BYTES-1] & 0x01
+}
+
+func xorLabels(labels ...Label_t) Label_t {
+    result := make(Label_t, LABEL_LEN_BYTES)
+    for _, label := range labels {
+        for i := range result {
+            result[i] ^= label[i]
+        }
+    }
+    return result
+}
+
+//
+// The hash the halves are built from
+func (garb *HalfGatesGarbledCircuit) hash(label Label_t, tweak uint64) Label_t {
+    if garb.Cipher == nil {
+        return defaultGateCipher.Hash(label, nil, tweak)
+    }
+    return garb.Cipher.Hash(label, nil, tweak)
+}
+
+//
+// Garble a given circuit, reading Delta and the 0 labels of the input and
+// constant wires from random
+func (garb *HalfGatesGarbledCircuit) GarbleCircuit(circ *Circuit, random io.Reader) bool {
+    if circ.validCircuit() == false {
+        return false
+    }
+    order, ok := circ.evaluationOrder()
+    if !ok {
+        return false
+    }
+
+    garb.WireLabels = make([]SimpleWireLabelSet, len(circ.Gates))
+    garb.GarbledGates = make([]SimpleGarbledGate, len(circ.Gates))
+    garb.NumInputWires = circ.NumInputWires
+    garb.NumOutputWires = circ.NumOutputWires
+
+    garb.FreeXORDelta = make(Label_t, LABEL_LEN_BYTES)
+    if _, err := io.ReadFull(random, garb.FreeXORDelta); err != nil {
+        return false
+    }
+    // W0 and W1 always have opposite point and permute bits
+    garb.FreeXORDelta[LABEL_LEN_BYTES-1] |= 0x01
+
+    for _, gateID := range order {
+        gate := circ.Gates[gateID]
+        var zero Label_t
+        switch gate.GateType {
+        case GateINPUT, GateCONST:
+            zero = make(Label_t, LABEL_LEN_BYTES)
+            if _, err := io.ReadFull(random, zero); err != nil {
+                return false
+            }
+            if gate.GateType == GateCONST {
+                value := zero
+                if gate.ConstVal {
+                    value = xorLabels(zero, garb.FreeXORDelta)
+                }
+                garb.GarbledGates[gateID].Table = []Ciphertext_t{Ciphertext_t(value)}
+            }
+        case GateOUTPUT, GateCOPY:
+            zero = garb.WireLabels[gate.InFrom[0]].WireLabelPair[0]
+        case GateNOT:
+            zero = garb.WireLabels[gate.InFrom[0]].WireLabelPair[1]
+        case GateXOR:
+            zero = xorLabels(garb.WireLabels[gate.InFrom[0]].WireLabelPair[0], garb.WireLabels[gate.InFrom[1]].WireLabelPair[0])
+        case GateAND, GateOR:
+            a0 := garb.WireLabels[gate.InFrom[0]].WireLabelPair[0]
+            b0 := garb.WireLabels[gate.InFrom[1]].WireLabelPair[0]
+            zero = garb.garbleAND(gateID, a0, b0)
+            if gate.GateType == GateOR {
+                zero = xorLabels(zero, a0, b0)
+            }
+        default:
+            return false
+        }
+        garb.WireLabels[gateID].WireLabelPair[0] = zero
+        garb.WireLabels[gateID].WireLabelPair[1] = xorLabels(zero, garb.FreeXORDelta)
+    }
+
+    garb.OutputDecoding = make([]byte, circ.NumOutputWires)
+    for i := range garb.OutputDecoding {
+        garb.OutputDecoding[i] = permuteBit(garb.WireLabels[circ.getOutputGate(i)].WireLabelPair[0])
+    }
+    return true
+}
+
+//
+// Garble one AND gate with input 0 labels a0 and b0, returning the output 0 label
+func (garb *HalfGatesGarbledCircuit) garbleAND(gateID int, a0 Label_t, b0 Label_t) Label_t {
+    delta := garb.FreeXORDelta
+    a1, b1 := xorLabels(a0, delta), xorLabels(b0, delta)
+    pa, pb := permuteBit(a0), permuteBit(b0)
+    j, k := uint64(2*gateID), uint64(2*gateID + 1)
+    hA0, hB0 := garb.hash(a0, j), garb.hash(b0, k)
+
+    // garbler half: the garbler knows pb, this computes a & pb
+    tG := xorLabels(hA0, garb.hash(a1, j))
+    if pb == 1 {
+        tG = xorLabels(tG, delta)
+    }
+    wG := hA0
+    if pa == 1 {
+        wG = xorLabels(wG, tG)
+    }
+
+    // evaluator half: the evaluator knows b ^ pb, this computes a & (b ^ pb)
+    tE := xorLabels(hB0, garb.hash(b1, k), a0)
+    wE := hB0
+    if pb == 1 {
+        wE = xorLabels(wE, tE, a0)
+    }
+
+    garb.GarbledGates[gateID].Table = []Ciphertext_t{Ciphertext_t(tG), Ciphertext_t(tE)}
+    return xorLabels(wG, wE)
+}
+
+//
+// Returns the input labels
+func (garb *HalfGatesGarbledCircuit) GetInputWireLabels() []SimpleWireLabelSet {
+    return garb.WireLabels[0:garb.NumInputWires]
+}
+
+//
+// Packed as [the table rows of every gate, in gate order][output decoding bits]
+// where bit i of the decoding is bit i%8 of byte i/8. Unlike SimpleGarbledCircuit
+// no input labels are included, the evaluator gets exactly one per input wire
+// some other way.
+func (garb *HalfGatesGarbledCircuit) PackedMarshal() []byte {
+    size := (len(garb.OutputDecoding) + 7) / 8
+    for _, gate := range garb.GarbledGates {
+        size += len(gate.Table) * LABEL_LEN_BYTES
+    }
+    packed := make([]byte, 0, size)
+    for _, gate := range garb.GarbledGates {
+        for _, row := range gate.Table {
+            packed = append(packed, row...)
+        }
+    }
+    return append(packed, packOutputDecoding(garb.OutputDecoding)...)
+}
+
+func (garb *HalfGatesGarbledCircuit) PackedUnmarshal(b []byte, c *Circuit) error {
+    garb.NumInputWires = c.NumInputWires
+    garb.NumOutputWires = c.NumOutputWires
+
+    expected := (c.NumOutputWires + 7) / 8
+    for _, gate := range c.Gates {
+        expected += halfGatesTableSize(gate.GateType) * LABEL_LEN_BYTES
+    }
+    if len(b) != expected {
+        return fmt.Errorf("garbled circuit is %d bytes, expected %d", len(b), expected)
+    }
+
+    garb.GarbledGates = make([]SimpleGarbledGate, len(c.Gates))
+    for i, gate := range c.Gates {
+        rows := halfGatesTableSize(gate.GateType)
+        garb.GarbledGates[i].Table = make([]Ciphertext_t, rows)
+        for j := 0; j < rows; j++ {
+            garb.GarbledGates[i].Table[j] = Ciphertext_t(b[:LABEL_LEN_BYTES])
+            b = b[LABEL_LEN_BYTES:]
+        }
+    }
+    garb.OutputDecoding = unpackOutputDecoding(b, c.NumOutputWires)
+    return nil
+}
+
+//
+// Evaluate a garbled circuit on one label per input wire
+func (garb *HalfGatesGarbledCircuit) EvaluateCircuit(circ *Circuit, inputLabels []Label_t) (bool, []Label_t) {
+    if len(inputLabels) != circ.NumInputWires || circ.NumOutputWires < 1 || len(garb.GarbledGates) != len(circ.Gates) {
+        return false, nil
+    }
+    order, ok := circ.evaluationOrder()
+    if !ok {
+        return false, nil
+    }
+
+    labels := make([]Label_t, len(circ.Gates))
+    for _, gateID := range order {
+        gate := circ.Gates[gateID]
+        if len(garb.GarbledGates[gateID].Table) != halfGatesTableSize(gate.GateType) {
+            return false, nil
+        }
+        switch gate.GateType {
+        case GateINPUT:
+            if len(inputLabels[gateID]) != LABEL_LEN_BYTES {
+                return false, nil
+            }
+            labels[gateID] = inputLabels[gateID]
+        case GateCONST:
+            labels[gateID] = Label_t(garb.GarbledGates[gateID].Table[0])
+        case GateOUTPUT, GateCOPY, GateNOT:
+            labels[gateID] = labels[gate.InFrom[0]]
+        case GateXOR:
+            labels[gateID] = xorLabels(labels[gate.InFrom[0]], labels[gate.InFrom[1]])
+        case GateAND, GateOR:
+            a, b := labels[gate.InFrom[0]], labels[gate.InFrom[1]]
+            labels[gateID] = garb.evaluateAND(gateID, a, b)
+            if gate.GateType == GateOR {
+                labels[gateID] = xorLabels(labels[gateID], a, b)
+            }
+        default:
+            return false, nil
+        }
+    }
+
+    result := make([]Label_t, circ.NumOutputWires)
+    for i := range result {
+        result[i] = labels[circ.getOutputGate(i)]
+    }
+    return true, result
+}
+
+func (garb *HalfGatesGarbledCircuit) evaluateAND(gateID int, a Label_t, b Label_t) Label_t {
+    table := garb.GarbledGates[gateID].Table
+    j, k := uint64(2*gateID), uint64(2*gateID + 1)
+    wG := garb.hash(a, j)
+    if permuteBit(a) == 1 {
+        wG = xorLabels(wG, Label_t(table[0]))
+    }
+    wE := garb.hash(b, k)
+    if permuteBit(b) == 1 {
+        wE = xorLabels(wE, Label_t(table[1]), a)
+    }
+    return xorLabels(wG, wE)
+}
+
+func (garb *HalfGatesGarbledCircuit) DecodeOutputLabels(outLabels []Label_t) (string, error) {
+    return decodeOutputLabels(outLabels, garb.OutputDecoding)
+}
@@ -0,0 +1,34 @@
+package toygarble
+
+import (
+    "fmt"
+)
+
+//
+// Generating circuits instead of reading them from Bristol files
+//
+
+// The widest modulus GenerateModCircuit handles
+const MAX_MOD_BITS int = 32
+
+//
+// Build the circuit computing a mod b for a numBits-bit a and a modBits-bit b.
+// Like the CBMC-GC circuits it replaces, the inputs are a and then b and the
+// output is the modBits-bit remainder, all least significant bit first. b = 0
+// gives back a mod 2^modBits. See Builder.Mod.
+func GenerateModCircuit(numBits int, modBits int) (*Circuit, error) {
+    if modBits < 1 || modBits > MAX_MOD_BITS {
+        return nil, fmt.Errorf("modulus of %d bits is not supported", modBits)
+    }
+    if numBits < 1 {
+        return nil, fmt.Errorf("dividend of %d bits is not supported", numBits)
+    }
+    b := NewBuilder()
+    a, m := b.Input(numBits), b.Input(modBits)
+    b.Output(b.Mod(a, m))
+    circ, err := b.Build()
+    if err != nil {
+        return nil, fmt.Errorf("generated an invalid circuit for %d mod %d bits: %v", numBits, modBits, err)
+    }
+    return circ, nil
+}
@@ -0,0 +1,124 @@
+// Package opt rewrites toygarble circuits into equivalent ones with fewer
+// gates. Only AND and OR gates need garbled tables, so those are what count,
+// but the passes are local: they remove gates that are constant, unused,
+// copies or duplicates, and can't find a cheaper way to compute the same
+// thing. A circuit compiled without any of those, like the CBMC-GC ones in the
+// repo, needs as many tables afterwards as before.
+package opt
+
+import (
+    "bytes"
+    "fmt"
+    "text/tabwriter"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+// How many of each gate a circuit has, besides its input and output wires
+type Stats struct {
+    AND     int
+    XOR     int
+    OR      int
+    NOT     int
+    COPY    int
+    CONST   int
+}
+
+func Count(circ *toygarble.Circuit) Stats {
+    var s Stats
+    for _, gate := range circ.Gates {
+        switch gate.GateType {
+        case toygarble.GateAND:
+            s.AND++
+        case toygarble.GateXOR:
+            s.XOR++
+        case toygarble.GateOR:
+            s.OR++
+        case toygarble.GateNOT:
+            s.NOT++
+        case toygarble.GateCOPY:
+            s.COPY++
+        case toygarble.GateCONST:
+            s.CONST++
+        }
+    }
+    return s
+}
+
+func (s Stats) Gates() int {
+    return s.AND + s.XOR + s.OR + s.NOT + s.COPY + s.CONST
+}
+
+// The gates that need a garbled table under either scheme
+func (s Stats) Tables() int {
+    return s.AND + s.OR
+}
+
+func (s Stats) String() string {
+    return fmt.Sprintf("%d gates, %d tables (AND %d, XOR %d, OR %d, NOT %d, COPY %d, CONST %d)",
+        s.Gates(), s.Tables(), s.AND, s.XOR, s.OR, s.NOT, s.COPY, s.CONST)
+}
+
+// One pass over the circuit and what it changed
+type Step struct {
+    Pass    string
+    Before  Stats
+    After   Stats
+}
+
+type Report struct {
+    Before  Stats
+    After   Stats
+    Steps   []Step
+}
+
+// A table of the gates after every pass
+func (r *Report) String() string {
+    var buf bytes.Buffer
+    tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(tw, "\tgates\tAND\tXOR\tOR\tNOT\tCOPY\tCONST\t")
+    row := func(name string, s Stats) {
+        fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t\n", name, s.Gates(), s.AND, s.XOR, s.OR, s.NOT, s.COPY, s.CONST)
+    }
+    row("before", r.Before)
+    for _, step := range r.Steps {
+        row(step.Pass, step.After)
+    }
+    tw.Flush()
+    return buf.String()
+}
+
+// The passes Optimize runs
+var DefaultPasses = []Pass{ORRewriting, CopyRemoval, ConstantPropagation, StructuralHashing, DeadGateElimination}
+
+// Give up on reaching a fixed point after this many rounds of passes
+const maxRounds = 16
+
+//
+// Run the passes over circ in order, then again until a round changes nothing.
+// Returns the optimized circuit and the gates after every pass; circ itself is
+// left alone.
+func Run(circ *toygarble.Circuit, passes ...Pass) (*toygarble.Circuit, *Report, error) {
+    report := &Report{Before: Count(circ)}
+    for round := 0; round < maxRounds; round++ {
+        start := Count(circ)
+        for _, pass := range passes {
+            before := Count(circ)
+            next, err := pass.Apply(circ)
+            if err != nil {
+                return nil, nil, fmt.Errorf("%v (in %s)", err, pass.Name)
+            }
+            circ = next
+            report.Steps = append(report.Steps, Step{pass.Name, before, Count(circ)})
+        }
+        if Count(circ) == start {
+            break
+        }
+    }
+    report.After = Count(circ)
+    return circ, report, nil
+}
+
+func Optimize(circ *toygarble.Circuit) (*toygarble.Circuit, *Report, error) {
+    return Run(circ, DefaultPasses...)
+}
@@ -0,0 +1,193 @@
+package opt
+
+import (
+    mathRand "math/rand"
+    "os"
+    "strings"
+    "testing"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+func parse(t *testing.T, name string, bristol string) *toygarble.Circuit {
+    t.Helper()
+    circ, err := toygarble.ParseCircuit(strings.NewReader(bristol))
+    if err != nil {
+        t.Fatalf("%s: %v", name, err)
+    }
+    return circ
+}
+
+func parseFile(t *testing.T, fname string) *toygarble.Circuit {
+    t.Helper()
+    f, err := os.Open(fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    circ, err := toygarble.ParseCircuit(f)
+    if err != nil {
+        t.Fatalf("%s: %v", fname, err)
+    }
+    return circ
+}
+
+//
+// The two circuits give the same outputs, on every input if there are few
+// enough of them and on random ones otherwise
+func checkEquivalent(t *testing.T, name string, a *toygarble.Circuit, b *toygarble.Circuit, trials int) {
+    t.Helper()
+    if a.NumInputWires != b.NumInputWires || a.NumOutputWires != b.NumOutputWires {
+        t.Fatalf("%s: %d inputs and %d outputs became %d and %d", name, a.NumInputWires, a.NumOutputWires, b.NumInputWires, b.NumOutputWires)
+    }
+    exhaustive := a.NumInputWires <= 10
+    if exhaustive {
+        trials = 1 << uint(a.NumInputWires)
+    }
+    r := mathRand.New(mathRand.NewSource(1))
+    inputs := make([]bool, a.NumInputWires)
+    for trial := 0; trial < trials; trial++ {
+        for i := range inputs {
+            if exhaustive {
+                inputs[i] = trial >> uint(i) & 1 == 1
+            } else {
+                inputs[i] = r.Intn(2) == 1
+            }
+        }
+        okA, outA := a.EvaluateCircuit(inputs)
+        okB, outB := b.EvaluateCircuit(inputs)
+        if !okA || !okB {
+            t.Fatalf("%s: could not evaluate", name)
+        }
+        for i := range outA {
+            if outA[i] != outB[i] {
+                t.Fatalf("%s: output %d differs", name, i)
+            }
+        }
+    }
+}
+
+func TestPasses(t *testing.T) {
+    cases := []struct {
+        name    string
+        pass    Pass
+        bristol string
+        want    Stats
+    }{
+        // x0 & 1, (x0 & 1) ^ 1 and x1 | 1
+        {"constants", ConstantPropagation,
+            "4 6\n1 2\n1 2\n\n1 1 1 2 EQ\n2 1 0 2 3 AND\n2 1 3 2 4 XOR\n2 1 1 2 5 OR\n",
+            Stats{NOT: 1, CONST: 1}},
+        {"same input twice", ConstantPropagation,
+            "3 5\n1 2\n1 2\n\n2 1 0 0 2 AND\n2 1 2 0 3 XOR\n2 1 1 1 4 OR\n",
+            Stats{CONST: 1}},
+        {"dead", DeadGateElimination,
+            "2 4\n1 2\n1 1\n\n2 1 0 1 2 AND\n2 1 0 1 3 XOR\n",
+            Stats{XOR: 1}},
+        // dead gates are left for DeadGateElimination
+        {"copies", CopyRemoval,
+            "4 6\n1 2\n1 1\n\n1 1 0 2 EQW\n1 1 2 3 INV\n1 1 3 4 INV\n2 1 4 1 5 AND\n",
+            Stats{AND: 1, NOT: 1}},
+        {"hashing", StructuralHashing,
+            "5 7\n1 2\n1 1\n\n2 1 0 1 2 AND\n2 1 1 0 3 AND\n1 1 2 4 INV\n1 1 3 5 INV\n2 1 4 5 6 XOR\n",
+            Stats{AND: 1, NOT: 1, XOR: 1}},
+        {"OR", ORRewriting,
+            "1 3\n1 2\n1 1\n\n2 1 0 1 2 OR\n",
+            Stats{AND: 1, XOR: 2}},
+    }
+    for _, c := range cases {
+        circ := parse(t, c.name, c.bristol)
+        optimized, err := c.pass.Apply(circ)
+        if err != nil {
+            t.Fatalf("%s: %v", c.name, err)
+        }
+        if got := Count(optimized); got != c.want {
+            t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+        }
+        checkEquivalent(t, c.name, circ, optimized, 0)
+    }
+}
+
+// The passes together save tables when the circuit has something to share
+func TestOptimizeSmall(t *testing.T) {
+    cases := []struct {
+        name    string
+        bristol string
+        want    Stats
+    }{
+        // x0 | x1, x0 & x1 and x0 ^ x1 need one table instead of two
+        {"OR shares an AND", "3 5\n1 2\n1 3\n\n2 1 0 1 2 OR\n2 1 0 1 3 AND\n2 1 0 1 4 XOR\n", Stats{AND: 1, XOR: 2}},
+        // a half adder with an OR for its carry as well: s = x0 ^ x1, c = x0 & x1, x0 | x1 = s ^ c
+        {"OR from a half adder", "4 6\n1 2\n1 3\n\n2 1 0 1 2 XOR\n2 1 0 1 3 AND\n2 1 1 0 4 OR\n1 1 4 5 INV\n", Stats{AND: 1, XOR: 2, NOT: 1}},
+        // (x0 & x1) ^ (x1 & x0) is 0
+        {"cancels out", "4 6\n1 2\n1 1\n\n2 1 0 1 2 AND\n2 1 1 0 3 AND\n1 1 3 4 EQW\n2 1 2 4 5 XOR\n", Stats{CONST: 1}},
+    }
+    for _, c := range cases {
+        circ := parse(t, c.name, c.bristol)
+        optimized, report, err := Optimize(circ)
+        if err != nil {
+            t.Fatalf("%s: %v", c.name, err)
+        }
+        if report.After != c.want || Count(optimized) != c.want {
+            t.Errorf("%s: got %v, want %v", c.name, report.After, c.want)
+        }
+        if report.After.Tables() >= report.Before.Tables() {
+            t.Errorf("%s: %d tables became %d", c.name, report.Before.Tables(), report.After.Tables())
+        }
+        checkEquivalent(t, c.name, circ, optimized, 0)
+    }
+}
+
+//
+// What the optimizer does for the CBMC-GC circuits FracFMD used to garble. Their
+// ORs don't share inputs with any AND or XOR, so each still costs an AND and
+// the number of tables stays the same; GenerateModCircuit is what makes the
+// circuit smaller, 815 ANDs instead of 4078 for 48 mod 8 bits.
+func TestOptimizeModCircuits(t *testing.T) {
+    for _, fname := range []string{"../../48Num8Mod.circ", "../../64Num24Mod.circ"} {
+        circ := parseFile(t, fname)
+        optimized, report, err := Optimize(circ)
+        if err != nil {
+            t.Fatalf("%s: %v", fname, err)
+        }
+        t.Logf("%s\n%s", fname, report)
+        t.Logf("before: %v", report.Before)
+        t.Logf("after:  %v", report.After)
+
+        if report.Before != Count(circ) || report.After != Count(optimized) {
+            t.Errorf("%s: the report doesn't count the circuits", fname)
+        }
+        if s := report.After; s.OR != 0 || s.COPY != 0 {
+            t.Errorf("%s: %d OR and %d COPY gates left", fname, s.OR, s.COPY)
+        }
+        if report.After.Tables() > report.Before.Tables() {
+            t.Errorf("%s: %v became %v", fname, report.Before, report.After)
+        }
+        checkEquivalent(t, fname, circ, optimized, 200)
+    }
+}
+
+// The compiled circuits in toygarble/test-circuits and a generated one
+func TestOptimizeEquivalent(t *testing.T) {
+    files := []string{"adder64.txt", "sub64.txt", "neg64.txt", "mult64.txt", "mult2_64.txt", "divide64.txt", "zero_equal.txt", "aes_128.txt", "sha256.txt"}
+    circuits := make(map[string]*toygarble.Circuit)
+    for _, file := range files {
+        circuits[file] = parseFile(t, "../test-circuits/" + file)
+    }
+    generated, err := toygarble.GenerateModCircuit(24, 8)
+    if err != nil {
+        t.Fatal(err)
+    }
+    circuits["generated"] = generated
+
+    for name, circ := range circuits {
+        optimized, report, err := Optimize(circ)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if report.After.Tables() > report.Before.Tables() {
+            t.Errorf("%s: %v became %v", name, report.Before, report.After)
+        }
+        checkEquivalent(t, name, circ, optimized, 16)
+    }
+}
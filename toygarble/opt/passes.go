@@ -0,0 +1,163 @@
+package opt
+
+import (
+    "fmt"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+type Pass struct {
+    Name    string
+    Apply   func(circ *toygarble.Circuit) (*toygarble.Circuit, error)
+}
+
+var (
+    // Gates with a constant input become a constant or one of their other
+    // inputs, or a NOT for XOR with 1. So do AND, OR and XOR of a gate with itself.
+    ConstantPropagation = Pass{"constant propagation", propagateConstants}
+
+    // Gates no output depends on are dropped
+    DeadGateElimination = Pass{"dead gates", eliminateDeadGates}
+
+    // Gates reading a COPY read what it copies, and NOT(NOT(x)) is x
+    CopyRemoval = Pass{"copies and double NOTs", removeCopies}
+
+    // Gates of the same type reading the same gates become one gate
+    StructuralHashing = Pass{"structural hashing", hashStructurally}
+
+    // OR(a, b) becomes (a ^ b) ^ (a & b), leaving AND as the only gate that
+    // needs a garbled table. The XORs are free, and when the circuit already
+    // has a & b or a ^ b StructuralHashing merges them, so the OR costs nothing.
+    ORRewriting = Pass{"OR to AND", rewriteOR}
+)
+
+func propagateConstants(circ *toygarble.Circuit) (*toygarble.Circuit, error) {
+    return rebuildAll(circ, func(w *rewriter, gate toygarble.Gate, inFrom []int) int {
+        switch gate.GateType {
+        case toygarble.GateCONST:
+            return w.constant(gate.ConstVal)
+        case toygarble.GateCOPY, toygarble.GateNOT:
+            if v, ok := w.constValue(inFrom[0]); ok {
+                return w.constant(v != (gate.GateType == toygarble.GateNOT))
+            }
+            return keep(w, gate, inFrom)
+        case toygarble.GateAND, toygarble.GateOR, toygarble.GateXOR:
+        default:
+            return keep(w, gate, inFrom)
+        }
+
+        x, y := inFrom[0], inFrom[1]
+        if x == y {
+            if gate.GateType == toygarble.GateXOR {
+                return w.constant(false)
+            }
+            return x
+        }
+        // the constant, if there is one, first
+        if _, ok := w.constValue(y); ok {
+            x, y = y, x
+        }
+        c, ok := w.constValue(x)
+        if !ok {
+            return keep(w, gate, inFrom)
+        }
+        if v, ok := w.constValue(y); ok {
+            switch gate.GateType {
+            case toygarble.GateAND:
+                return w.constant(c && v)
+            case toygarble.GateOR:
+                return w.constant(c || v)
+            default:
+                return w.constant(c != v)
+            }
+        }
+        switch {
+        case gate.GateType == toygarble.GateAND && !c, gate.GateType == toygarble.GateOR && c:
+            return x
+        case gate.GateType == toygarble.GateXOR && c:
+            return w.add(toygarble.GateNOT, false, y)
+        }
+        return y
+    })
+}
+
+func eliminateDeadGates(circ *toygarble.Circuit) (*toygarble.Circuit, error) {
+    order, ok := circ.EvaluationOrder()
+    if !ok {
+        return nil, fmt.Errorf("opt: the circuit has a cycle or reads from a gate that doesn't exist")
+    }
+    live := make([]bool, len(circ.Gates))
+    for i := 0; i < circ.NumOutputWires; i++ {
+        live[circ.NumInputWires + i] = true
+    }
+    // every gate comes after what it reads, so backwards sees readers first
+    for i := len(order) - 1; i >= 0; i-- {
+        if live[order[i]] {
+            for _, in := range circ.Gates[order[i]].InFrom {
+                live[in] = true
+            }
+        }
+    }
+    liveOrder := order[:0]
+    for _, gateID := range order {
+        if live[gateID] {
+            liveOrder = append(liveOrder, gateID)
+        }
+    }
+    return rebuild(circ, liveOrder, keep)
+}
+
+func removeCopies(circ *toygarble.Circuit) (*toygarble.Circuit, error) {
+    return rebuildAll(circ, func(w *rewriter, gate toygarble.Gate, inFrom []int) int {
+        switch gate.GateType {
+        case toygarble.GateCOPY:
+            return inFrom[0]
+        case toygarble.GateNOT:
+            if in := w.gates[inFrom[0]]; in.GateType == toygarble.GateNOT {
+                return in.InFrom[0]
+            }
+        }
+        return keep(w, gate, inFrom)
+    })
+}
+
+// A gate by what it computes, the inputs of AND, OR and XOR in either order
+type gateKey struct {
+    gateType    toygarble.GateType_t
+    constVal    bool
+    in1         int
+    in2         int
+}
+
+func hashStructurally(circ *toygarble.Circuit) (*toygarble.Circuit, error) {
+    seen := make(map[gateKey]int)
+    return rebuildAll(circ, func(w *rewriter, gate toygarble.Gate, inFrom []int) int {
+        key := gateKey{gateType: gate.GateType, in1: -1, in2: -1}
+        switch len(inFrom) {
+        case 2:
+            key.in1, key.in2 = inFrom[0], inFrom[1]
+            if key.in1 > key.in2 {
+                key.in1, key.in2 = key.in2, key.in1
+            }
+        case 1:
+            key.in1 = inFrom[0]
+        case 0:
+            key.constVal = gate.ConstVal
+        }
+        if id, ok := seen[key]; ok {
+            return id
+        }
+        seen[key] = keep(w, gate, inFrom)
+        return seen[key]
+    })
+}
+
+func rewriteOR(circ *toygarble.Circuit) (*toygarble.Circuit, error) {
+    return rebuildAll(circ, func(w *rewriter, gate toygarble.Gate, inFrom []int) int {
+        if gate.GateType != toygarble.GateOR {
+            return keep(w, gate, inFrom)
+        }
+        x, y := inFrom[0], inFrom[1]
+        return w.add(toygarble.GateXOR, false, w.add(toygarble.GateXOR, false, x, y), w.add(toygarble.GateAND, false, x, y))
+    })
+}
@@ -0,0 +1,112 @@
+package opt
+
+import (
+    "fmt"
+
+    "github.com/becgabri/fuzzycrypto/toygarble"
+)
+
+//
+// Every pass rebuilds the circuit it is given one gate at a time, in evaluation
+// order, deciding what each gate becomes in the new circuit: a copy of itself,
+// some other gate it is equivalent to, or a few new gates.
+//
+
+type rewriter struct {
+    gates   []toygarble.Gate
+    // the CONST gates added so far, by value
+    consts  map[bool]int
+}
+
+// Add a gate reading from gates already in the new circuit
+func (w *rewriter) add(gateType toygarble.GateType_t, constVal bool, inFrom ...int) int {
+    w.gates = append(w.gates, toygarble.Gate{GateType: gateType, ConstVal: constVal, InFrom: inFrom})
+    return len(w.gates) - 1
+}
+
+// One CONST gate per value, however many times it is asked for
+func (w *rewriter) constant(v bool) int {
+    if id, ok := w.consts[v]; ok {
+        return id
+    }
+    w.consts[v] = w.add(toygarble.GateCONST, v)
+    return w.consts[v]
+}
+
+// The value of a gate in the new circuit, if it is a CONST gate
+func (w *rewriter) constValue(id int) (bool, bool) {
+    gate := w.gates[id]
+    return gate.ConstVal, gate.GateType == toygarble.GateCONST
+}
+
+// What a pass does with a gate whose inputs are already in the new circuit.
+// Returns the gate of the new circuit that computes the same thing.
+type visitFunc func(w *rewriter, gate toygarble.Gate, inFrom []int) int
+
+// Keep the gate as it is
+func keep(w *rewriter, gate toygarble.Gate, inFrom []int) int {
+    return w.add(gate.GateType, gate.ConstVal, inFrom...)
+}
+
+//
+// Rebuild circ, calling visit for every gate in order other than the input and
+// output wires. The input wires stay where they are and the output wires are
+// connected to wherever the gates driving them ended up. order must contain
+// every gate the outputs depend on, before the gates that read from it.
+func rebuild(circ *toygarble.Circuit, order []int, visit visitFunc) (*toygarble.Circuit, error) {
+    numWires := circ.NumInputWires + circ.NumOutputWires
+    w := &rewriter{
+        gates:  make([]toygarble.Gate, numWires, len(circ.Gates)),
+        consts: make(map[bool]int),
+    }
+    for i := range w.gates {
+        w.gates[i].GateType = toygarble.GateINPUT
+        if i >= circ.NumInputWires {
+            w.gates[i].GateType = toygarble.GateOUTPUT
+        }
+    }
+
+    moved := make([]int, len(circ.Gates))
+    for i := range moved {
+        moved[i] = -1
+    }
+    for i := 0; i < circ.NumInputWires; i++ {
+        moved[i] = i
+    }
+    for _, gateID := range order {
+        gate := circ.Gates[gateID]
+        inFrom := make([]int, len(gate.InFrom))
+        for i, in := range gate.InFrom {
+            if moved[in] < 0 {
+                return nil, fmt.Errorf("opt: gate %d reads from gate %d before it is rebuilt", gateID, in)
+            }
+            inFrom[i] = moved[in]
+        }
+        switch gate.GateType {
+        case toygarble.GateINPUT:
+        case toygarble.GateOUTPUT:
+            // other gates can read an output wire, they read what drives it
+            moved[gateID] = inFrom[0]
+        default:
+            moved[gateID] = visit(w, gate, inFrom)
+        }
+    }
+
+    for i := circ.NumInputWires; i < numWires; i++ {
+        driver := moved[i]
+        if driver < 0 {
+            return nil, fmt.Errorf("opt: output wire %d is not driven by anything", i - circ.NumInputWires)
+        }
+        w.gates[i].InFrom = []int{driver}
+    }
+    return toygarble.NewCircuit(circ.NumWiresIV, circ.NumWiresOV, w.gates)
+}
+
+// Rebuild every gate of circ, whether the outputs need it or not
+func rebuildAll(circ *toygarble.Circuit, visit visitFunc) (*toygarble.Circuit, error) {
+    order, ok := circ.EvaluationOrder()
+    if !ok {
+        return nil, fmt.Errorf("opt: the circuit has a cycle or reads from a gate that doesn't exist")
+    }
+    return rebuild(circ, order, visit)
+}
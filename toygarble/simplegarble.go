@@ -3,8 +3,7 @@ package toygarble
 import (
     "errors"
     "fmt"
-    "golang.org/x/crypto/blake2b"
-    "math/rand"
+    "io"
     "bytes"
     //b64 "encoding/base64"
     "strconv"
@@ -27,6 +26,17 @@ type SimpleGarbledCircuit struct {
     GarbledGates            []SimpleGarbledGate
     WireLabels              []SimpleWireLabelSet
     FreeXORDelta            Label_t
+    // the point and permute bit of each output wire's 0 label
+    OutputDecoding          []byte
+    // what the tables are encrypted with, nil for fixed-key AES
+    Cipher                  GateCipher
+}
+
+func (garb *SimpleGarbledCircuit) cipher() GateCipher {
+    if garb.Cipher == nil {
+        return defaultGateCipher
+    }
+    return garb.Cipher
 }
 
 /* Custom stream-lined format for a 
@@ -34,11 +44,13 @@ type SimpleGarbledCircuit struct {
 ** marshal. 
 ** What needs to be packed or communicated
 ** - Input labels
-** - All garbled gates (except output)
+** - All garbled gates (NOT, XOR, COPY and output are free)
+** - The output decoding bits
 */
 
 // this *generically* packs a circuit W/O input labels
 // packing here is [all wire labels ordered as input wire i, wire label 0 then wire label 1 for i=1 ... NumInputWires ]
+// followed by the tables and the output decoding bits (bit i is bit i%8 of byte i/8)
 func (g *SimpleGarbledCircuit) PackedMarshal() []byte {
     var packedGC bytes.Buffer
 
@@ -58,6 +70,7 @@ func (g *SimpleGarbledCircuit) PackedMarshal() []byte {
             check(err)
         }
     }
+    packedGC.Write(packOutputDecoding(g.OutputDecoding))
     return packedGC.Bytes()
 }
 
@@ -73,7 +86,6 @@ func (g *SimpleGarbledCircuit) PackedUnmarshal(b []byte, c *Circuit) error {
             var label Label_t = make(Label_t, LABEL_LEN_BYTES)
             numRead, err := packedGC.Read(label)
             if numRead != LABEL_LEN_BYTES || err != nil {
-                check(err)
                 return errors.New("Could not read in the correct number of bytes")
             }
             g.WireLabels[i].WireLabelPair[j] = label
@@ -87,11 +99,9 @@ func (g *SimpleGarbledCircuit) PackedUnmarshal(b []byte, c *Circuit) error {
         if c.Gates[i].GateType != GateINPUT {
             var tableSize int
 
-            if c.Gates[i].GateType == GateNOT || c.Gates[i].GateType == GateOUTPUT {
-                tableSize = 2
-            } else if c.Gates[i].GateType == GateCONST {
+            if c.Gates[i].GateType == GateCONST {
                 tableSize = 1
-            } else if c.Gates[i].GateType == GateXOR {
+            } else if c.Gates[i].GateType == GateXOR || c.Gates[i].GateType == GateNOT || c.Gates[i].GateType == GateOUTPUT || c.Gates[i].GateType == GateCOPY {
                 tableSize = 0
             } else {
                 tableSize = 4
@@ -102,17 +112,20 @@ func (g *SimpleGarbledCircuit) PackedUnmarshal(b []byte, c *Circuit) error {
                 var row Ciphertext_t = make(Ciphertext_t, LABEL_LEN_BYTES);
                 numBytes, err := packedGC.Read(row)
                 if numBytes != LABEL_LEN_BYTES || err != nil {
-                    check(err)
                     return errors.New("Could not read in the correct number of bytes")
                 }
                 g.GarbledGates[i].Table[j] = row
             }
         }
     }
+    decoding := packedGC.Next((g.NumOutputWires + 7) / 8)
+    if len(decoding) != (g.NumOutputWires + 7) / 8 {
+        return errors.New("Could not read in the output decoding")
+    }
+    g.OutputDecoding = unpackOutputDecoding(decoding, g.NumOutputWires)
     // check if there is more input -- if there IS more input something went wrong
     nullBytes := packedGC.Next(1)
     if len(nullBytes) != 0 {
-        fmt.Print("Next byte: ",nullBytes, "\n") 
         return errors.New("Too many bytes left over")
     }
     return nil
@@ -129,7 +142,10 @@ type SimpleWireLabelSet struct {
 
 //
 // Garble a given circuit
-func (garb *SimpleGarbledCircuit) GarbleCircuit(circ *Circuit, rand *rand.Rand) bool {
+//
+// All the randomness (the free XOR delta and the wire labels) is read from
+// random, so the same reader contents give the same garbling.
+func (garb *SimpleGarbledCircuit) GarbleCircuit(circ *Circuit, random io.Reader) bool {
 
     // Make sure that the circuit representation makes sense
     if circ.validCircuit() == false {
@@ -148,20 +164,33 @@ func (garb *SimpleGarbledCircuit) GarbleCircuit(circ *Circuit, rand *rand.Rand)
     
     // Generate the free XOR variable Delta
     garb.FreeXORDelta = make([]byte, LABEL_LEN_BYTES)
-    _, err := rand.Read(garb.FreeXORDelta)
+    _, err := io.ReadFull(random, garb.FreeXORDelta)
     if (err != nil) {
         return false
     }
     // this will flip so that the last bit is "correct" at least. 
     garb.FreeXORDelta[LABEL_LEN_BYTES-1] |= 0x01 // Set the final bit to 1
 
-    // Walk through each gate of the input circuit, and perform the
-    // appropriate label generation
-    for i := 0; i < len(circ.Gates); i++ {
-        // For input wires in this case -- take them from the input
-        garb.assignWireLabelsRecurs(i, circ, rand)
+    // Walk through the gates in evaluation order, so every gate's inputs
+    // have labels before it does, and perform the appropriate label generation
+    order, ok := circ.evaluationOrder()
+    if !ok {
+        return false
+    }
+    for _, gateID := range order {
+        if garb.assignWireLabels(gateID, circ, random) == false {
+            fmt.Printf("Unable to assign wires at gate %d\n", gateID)
+            return false
+        }
     }
     
+    // The output labels are the labels of whatever the output wire is
+    // connected to, only their point and permute bits get published
+    garb.OutputDecoding = make([]byte, circ.NumOutputWires)
+    for i := range garb.OutputDecoding {
+        garb.OutputDecoding[i] = garb.WireLabels[circ.getOutputGate(i)].WireLabelPair[0][LABEL_LEN_BYTES-1] & 0x01
+    }
+
     // Walk through each gate of the input circuit, and perform the
     // appropriate garbling
     for i := 0; i < len(circ.Gates); i++ {
@@ -169,7 +198,7 @@ func (garb *SimpleGarbledCircuit) GarbleCircuit(circ *Circuit, rand *rand.Rand)
         // The resulting garbled gate will be added to garb.GarbledGates.
         if (*circ).Gates[i].GateType != GateINPUT {
             // Call a function to do the actual garbling
-            if garb.garbleGate(i, circ, rand) == false {
+            if garb.garbleGate(i, circ) == false {
                 // Error in garbling
                 fmt.Printf("Error garbling a gate\n")
                 return false
@@ -209,164 +238,97 @@ func (garb *SimpleGarbledCircuit) GetInputLabelsFromBools(inputs []bool) []Label
 }
 
 //
-// Evaluate a garbled circuit
+// Evaluate a garbled circuit, one pass over the gates in evaluation order
 func (garb *SimpleGarbledCircuit) EvaluateCircuit(circ *Circuit, inputLabels []Label_t) (bool, []Label_t) {
-        // Make sure the number of input and output wires matches what we've been given
-        if len(inputLabels) != (*circ).NumInputWires || (*circ).NumOutputWires < 1 {
-            fmt.Printf("Number of labels does not match number of input wires or number of outputwires is less than one\n")
-            fmt.Printf("\nNumber of input labels: %d, Number of InputWires: %d\n",len(inputLabels), (*circ).NumInputWires)
-            return false, nil
-        }
-        
-        // Allocate return var and scratch variables to hold onto intermediate values
-        visited := make([]bool, len(circ.Gates))                // defaults to all false
-        calculated := make([]bool, len(circ.Gates))             // defaults to all empty/nil
-        values := make([]Label_t, len(circ.Gates))              // defaults to all false
-        result := make([]Label_t, (*circ).NumOutputWires)       // defaults to all empty/nil
-        
-        // For each output gate, recursively evaluate the entire circuit
-        // using the scratch variables
-        for i := 0; i < circ.NumOutputWires; i++ {
-            // Initialize the visited array to all zero, except for this output gate
-            for j := range visited {
-                visited[j] = false
-            }
-            
-            // Evaluate the output gate to get a result, error out if it fails
-            success, resultLabel := garb.evaluateGarbledGate(circ, (*circ).getOutputGate(i), &visited, &calculated, &values, &inputLabels)
-            
-            result[i] = resultLabel
-            if success == false {
-                fmt.Printf("Failed to evaluate garbled circuit\n")
-                return false, nil
-            }
-        }
-        
-        // Success
-        return true, result
-}
-
-// Gate evaluation for garbled gates, recursive subroutine
-func (garb *SimpleGarbledCircuit) evaluateGarbledGate(circ *Circuit, gateID int, visited *[]bool, calculated *[]bool, labels *[]Label_t, inputLabels *([]Label_t)) (bool, Label_t) {
-
-    // If the gate has already been visited, but not calculated, we're in a loop -- return an error
-    if (*visited)[gateID] == true && (*calculated)[gateID] == false {
+    // Make sure the number of input and output wires matches what we've been given
+    if len(inputLabels) != (*circ).NumInputWires || (*circ).NumOutputWires < 1 {
+        fmt.Printf("Number of labels does not match number of input wires or number of outputwires is less than one\n")
+        fmt.Printf("\nNumber of input labels: %d, Number of InputWires: %d\n",len(inputLabels), (*circ).NumInputWires)
+        return false, nil
+    }
+    if len(garb.GarbledGates) != len(circ.Gates) || !circ.validCircuit() {
+        return false, nil
+    }
+    order, ok := circ.evaluationOrder()
+    if !ok {
         return false, nil
     }
     
-    // If the gate has been calculated, we're done (but in a good way). Return the cached value.
-    if (*calculated)[gateID] == true {
-        return true, (*labels)[gateID]
+    labels := make([]Label_t, len(circ.Gates))
+    for _, gateID := range order {
+        if !garb.evaluateGarbledGate(circ, gateID, labels, inputLabels) {
+            fmt.Printf("Error in gate %d\n", gateID)
+            return false, nil
+        }
     }
     
-    // Evaluate the gate
-    (*visited)[gateID] = true
-    result := Label_t(make([]byte, LABEL_LEN_BYTES))
-    success := true
+    result := make([]Label_t, (*circ).NumOutputWires)
+    for i := range result {
+        result[i] = labels[circ.getOutputGate(i)]
+    }
+    return true, result
+}
+
+//
+// Evaluate one garbled gate, whose inputs have already been evaluated, into labels
+func (garb *SimpleGarbledCircuit) evaluateGarbledGate(circ *Circuit, gateID int, labels []Label_t, inputLabels []Label_t) bool {
+    gate := circ.Gates[gateID]
+    table := garb.GarbledGates[gateID].Table
     
-    switch circ.Gates[gateID].GateType {
+    switch gate.GateType {
     case GateINPUT:
-        //fmt.Printf("Evaluating IN  gate %d\n", gateID)
-        //fmt.Printf("Input label is %s\n", b64.StdEncoding.EncodeToString((*inputLabels)[gateID]))
-        result = (*inputLabels)[gateID] // TODO: change this in case input gates aren't 0-aligned
+        // TODO: change this in case input gates aren't 0-aligned
+        if gateID >= len(inputLabels) || len(inputLabels[gateID]) != LABEL_LEN_BYTES {
+            return false
+        }
+        labels[gateID] = inputLabels[gateID]
 
     case GateCONST:
         // Constant gates are easy: the label is in cleartext
-        //fmt.Printf("Evaluating COMPUTE  gate %d\n", gateID)
-        if len((*circ).Gates[gateID].InFrom) == 0 {
-            result = Label_t(garb.GarbledGates[gateID].Table[0])
-            success = true
-        } else {
-            success = false
-            fmt.Printf("Error evaluating output 'gate', wrong number of input wires")
+        if len(table) != 1 {
+            return false
         }
-        
-    default:
-        // All real garbled gates
-        /*
-        fmt.Printf("Evaluating COMPUTE  gate %d\n", gateID)
-        if len(circ.Gates[gateID].InFrom) == 1 {
-            fmt.Printf("   - input gate is %d\n", circ.Gates[gateID].InFrom[0])
-        } else {
-            fmt.Printf("   - input gates are %d and %d\n", circ.Gates[gateID].InFrom[0], circ.Gates[gateID].InFrom[1])
+        labels[gateID] = Label_t(table[0])
+
+    case GateNOT, GateOUTPUT, GateCOPY:
+        // Free gates: the label of the input, which for a NOT now stands for
+        // the opposite value
+        if len(table) != 0 {
+            return false
         }
-        */
-        // All other gates, we evaluate a garbled table on the given label(s)
-        success = false
+        labels[gateID] = labels[gate.InFrom[0]]
+
+    case GateXOR:
+        // Free XOR: simply output the XOR of the two input labels
+        label1, label2 := labels[gate.InFrom[0]], labels[gate.InFrom[1]]
+        result := make(Label_t, LABEL_LEN_BYTES)
+        for i := range result {
+            result[i] = label1[i] ^ label2[i]
+        }
+        labels[gateID] = result
 
-        // First verify that our table is the right length -- modifying to ignore XOR dropping tables
-        if len((*garb).GarbledGates[gateID].Table) != (1 << len((*circ).Gates[gateID].InFrom)) && circ.Gates[gateID].GateType != GateXOR {
-            fmt.Printf("Wrong table size for gate %d of type %d\n", gateID, circ.Gates[gateID].GateType)
-            fmt.Printf("Size of table is %d. Number of input wires is %d", len((*garb).GarbledGates[gateID].Table), len((*circ).Gates[gateID].InFrom))
-            success = false
+    default:
+        // All other gates, we evaluate a garbled table on the given label(s)
+        if len(table) != (1 << len(gate.InFrom)) {
+            fmt.Printf("Wrong table size for gate %d of type %d\n", gateID, gate.GateType)
+            fmt.Printf("Size of table is %d. Number of input wires is %d", len(table), len(gate.InFrom))
+            return false
+        }
+        
+        // The point and permute bits of the input labels pick the row
+        label1 := labels[gate.InFrom[0]]
+        selector1 := label1[LABEL_LEN_BYTES-1] & 0x01
+        if len(gate.InFrom) == 2 {
+            label2 := labels[gate.InFrom[1]]
+            selector2 := label2[LABEL_LEN_BYTES-1] & 0x01
+            row := 2*int(selector1) + int(selector2)
+            labels[gateID] = decryptTableEntry(garb.cipher(), tableTweak(gateID, row), label1[:LABEL_LEN_BYTES-1], label2[:LABEL_LEN_BYTES-1], table[row])
         } else {
-            // Recursively evaluate the (one or two) input gates
-            var success1 bool
-            var success2 bool
-            var label1  Label_t
-            var label2  Label_t
-            
-            // Recurse on the left gate
-            success1, label1 = garb.evaluateGarbledGate(circ, circ.Gates[gateID].InFrom[0], visited, calculated, labels, inputLabels)
-            
-            // Evaluate the right gate (if there is one)
-            if len(circ.Gates[gateID].InFrom) == 2 {
-                success2, label2 = garb.evaluateGarbledGate(circ, circ.Gates[gateID].InFrom[1], visited, calculated, labels, inputLabels)
-            } else {
-                // If there's no right gate, just set this to success
-                success2 = true
-            }
-            
-            result = Label_t(make([]byte, len(label1)))
-
-            //fmt.Printf("success1 = %t, success2 = %t\n", success1, success2)
-            
-            // If both evaluated successfully
-            if success1 == true && success2 == true {
-                // Special case for XOR gates: simply output the XOR of the two input gates
-                if (circ.Gates[gateID].GateType == GateXOR) {
-                    //fmt.Printf("Evaluating XOR gate #%d\n", gateID)
-                    for i := 0; i < len(label1); i++ {
-                        result[i] = label1[i] ^ label2[i]
-                    }
-                    //fmt.Printf("Evaluating XOR labels are: InLabel1=%s, Inlabel2=%s, Out=%s\n",  b64.StdEncoding.EncodeToString(label1), b64.StdEncoding.EncodeToString(label2), b64.StdEncoding.EncodeToString(result))
-                    success = true
-                } else {
-                    
-                    // Go through each entry on the table and attempt to decrypt with the
-                    // two possible input gates
-                    selector1 := label1[LABEL_LEN_BYTES-1] & 0x01
-                    possibleLabel := make(Label_t, LABEL_LEN_BYTES)
-                    if len(circ.Gates[gateID].InFrom) == 2 {
-                        selector2 := label2[LABEL_LEN_BYTES-1] & 0x01
-                        row := 2*int(selector1) + int(selector2)
-                        possibleLabel = decryptTableEntry(row, label1[:LABEL_LEN_BYTES-1], label2[:LABEL_LEN_BYTES-1], ((*garb).GarbledGates[gateID].Table[row]))
-                        //fmt.Printf("Test decrypting label in row %d\n. Inlabel1=%s, Inlabel2=%s, OutLabel=%s, ciph=%s Gate=%d\n", row, b64.StdEncoding.EncodeToString(label1[:LABEL_LEN_BYTES]), b64.StdEncoding.EncodeToString(label2[:LABEL_LEN_BYTES]),b64.StdEncoding.EncodeToString(possibleLabel), b64.StdEncoding.EncodeToString(((*garb).GarbledGates[gateID].Table[row])), gateID)
-
-                    } else if len(circ.Gates[gateID].InFrom) == 1 {
-                        row := int(selector1)
-                        possibleLabel = decryptTableEntry(row, label1[:LABEL_LEN_BYTES-1], nil, ((*garb).GarbledGates[gateID].Table[row]))
-                        //fmt.Printf("Test decrypting label in row %d\n. Inlabel1=%s, OutLabel=%s, ciph=%s Gate=%d\n", row, b64.StdEncoding.EncodeToString(label1[:LABEL_LEN_BYTES]), b64.StdEncoding.EncodeToString(possibleLabel), b64.StdEncoding.EncodeToString(((*garb).GarbledGates[gateID].Table[row])), gateID)
-                        
-                    }                    
-
-                    // We found the right label!
-                    result = possibleLabel
-                    success = true
-                                
-                }
-            }
+            row := int(selector1)
+            labels[gateID] = decryptTableEntry(garb.cipher(), tableTweak(gateID, row), label1[:LABEL_LEN_BYTES-1], nil, table[row])
         }
     }
-    
-    if success == false {
-        fmt.Printf("Error in gate %d\n", gateID)
-    } else {
-        (*calculated)[gateID] = true
-        (*labels)[gateID] = result
-    }
-
-    return success, result
+    return true
 }
 
 //
@@ -376,33 +338,23 @@ func (garb *SimpleGarbledCircuit) GetInputWireLabels() []SimpleWireLabelSet {
 }
 
 //
-// Recursively assign wire labels to all gates. This needs to be recursive because of the Free XOR
-// optimization. Some gates can have random wire labels, but XOR gates' output labels are equal to the
-// combination of their input wires' labels.
-func (garb *SimpleGarbledCircuit) assignWireLabelsRecurs(gateID int, circ *Circuit, rand *rand.Rand) bool {
-
-    //fmt.Printf("Entering assignWireLabelsRecurs() at gate %d\n", gateID)
-
-    // Avoid repeating a gate
-    if (garb.WireLabels[gateID]).WireLabelPair[0] != nil {
-        if len(garb.WireLabels[gateID].WireLabelPair[0]) != 0 {
-           //fmt.Printf("There is already a label allocated at gate %d\n", gateID)
-            return true
-        }
-    }
-    
-    // Recurse on all input gates (unless we're an input gate)
-    if (*circ).Gates[gateID].GateType != GateINPUT {
-        // For each previous gate, recurse
-        for i := 0; i < len((*circ).Gates[gateID].InFrom); i++ {
-            if garb.assignWireLabelsRecurs((*circ).Gates[gateID].InFrom[i], circ, rand) == false {
-                fmt.Printf("Unable to assign wires at gate %d\n", gateID)
-                return false
-            }
+// Assign wire labels to one gate, whose inputs already have theirs. Some gates
+// can have random wire labels, but because of the Free XOR optimization XOR
+// gates' output labels are equal to the combination of their input wires' labels.
+func (garb *SimpleGarbledCircuit) assignWireLabels(gateID int, circ *Circuit, random io.Reader) bool {
+
+    // NOT, OUTPUT and COPY gates are free: with free XOR a NOT is an XOR with
+    // Delta, so it has the labels of its input swapped, and the others have the
+    // labels of their input
+    gateType := (*circ).Gates[gateID].GateType
+    if gateType == GateNOT || gateType == GateOUTPUT || gateType == GateCOPY {
+        input := garb.WireLabels[(*circ).Gates[gateID].InFrom[0]].WireLabelPair
+        if gateType == GateNOT {
+            input[0], input[1] = input[1], input[0]
         }
+        garb.WireLabels[gateID].WireLabelPair = input
+        return true
     }
-    
-    isStructuredLabel := garb.getIsStructuredLabel(circ, gateID)
 
     // Allocate memory for the necessary labels for this gate
     for i := 0; i < 2; i++ {
@@ -433,14 +385,8 @@ func (garb *SimpleGarbledCircuit) assignWireLabelsRecurs(gateID int, circ *Circu
     // Otherwise: this is NOT an XOR gate
     
     // Generate the first label at random
-    if isStructuredLabel {
-        garb.WireLabels[gateID].WireLabelPair[0] = make([]byte, LABEL_LEN_BYTES)
-        garb.WireLabels[gateID].WireLabelPair[1] = make([]byte, LABEL_LEN_BYTES)
-        for k := 0; k < LABEL_LEN_BYTES; k++ { 
-            garb.WireLabels[gateID].WireLabelPair[1][k] = 0x01
-        }
-    } else {
-        _, err := rand.Read(garb.WireLabels[gateID].WireLabelPair[0])
+    {
+        _, err := io.ReadFull(random, garb.WireLabels[gateID].WireLabelPair[0])
         garb.WireLabels[gateID].WireLabelPair[0][0] = 0x0
         garb.WireLabels[gateID].WireLabelPair[0][1] = 0x0
         garb.WireLabels[gateID].WireLabelPair[0][2] = 0x0
@@ -463,19 +409,18 @@ func (garb *SimpleGarbledCircuit) assignWireLabelsRecurs(gateID int, circ *Circu
 //
 // Garbles one gate of the input circuit and adds the result
 // to the garbled gate table.
-func (garb *SimpleGarbledCircuit) garbleGate(gateID int, circ *Circuit, rand *rand.Rand) bool {
+func (garb *SimpleGarbledCircuit) garbleGate(gateID int, circ *Circuit) bool {
     //fmt.Printf("Garbling gate %d\n", gateID) 
     var b bool
     success := false
     var tableSize int = 4
     
     // Work out how many rows we need in this table
-    if circ.Gates[gateID].GateType == GateNOT || circ.Gates[gateID].GateType == GateOUTPUT {
-        tableSize = 2
-    } else if circ.Gates[gateID].GateType == GateCONST {
+    if circ.Gates[gateID].GateType == GateCONST {
         tableSize = 1
-    } else if circ.Gates[gateID].GateType == GateXOR {
-        tableSize = 0
+    } else if circ.Gates[gateID].GateType == GateXOR || circ.Gates[gateID].GateType == GateNOT || circ.Gates[gateID].GateType == GateOUTPUT || circ.Gates[gateID].GateType == GateCOPY {
+        // free, nothing to garble
+        return true
     } else {
         tableSize = 4
     }
@@ -517,6 +462,8 @@ func (garb *SimpleGarbledCircuit) garbleGate(gateID int, circ *Circuit, rand *ra
             b = (i == 0)
         case GateOUTPUT:
             b = (i == 1)
+        case GateCONST:
+            // the label is written out as is below
         default:
             fmt.Printf("Unknown gate type %d\n", circ.Gates[gateID].GateType)
             return false
@@ -538,14 +485,14 @@ func (garb *SimpleGarbledCircuit) garbleGate(gateID int, circ *Circuit, rand *ra
         if tableSize == 4 {
             inLabel1 := garb.WireLabels[(*circ).Gates[gateID].InFrom[0]].WireLabelPair[firstLabelBit][:LABEL_LEN_BYTES-1]
             inLabel2 := garb.WireLabels[(*circ).Gates[gateID].InFrom[1]].WireLabelPair[secondLabelBit][:LABEL_LEN_BYTES-1]
-            success, garb.GarbledGates[gateID].Table[gateLocs[i]] = encryptTableEntry(gateLocs[i], inLabel1, inLabel2, outLabel)
+            success, garb.GarbledGates[gateID].Table[gateLocs[i]] = encryptTableEntry(garb.cipher(), tableTweak(gateID, gateLocs[i]), inLabel1, inLabel2, outLabel)
             
             //fmt.Printf("Encrypting label to row %d\n. Inlabel1=%s, Inlabel2=%s, OutLabel=%s, ciph=%s", gateLocs[i], b64.StdEncoding.EncodeToString(inLabel1), b64.StdEncoding.EncodeToString(inLabel2), b64.StdEncoding.EncodeToString(outLabel),
 //                b64.StdEncoding.EncodeToString(garb.GarbledGates[gateID].Table[gateLocs[i]]))
         } else if tableSize == 2 {
             // One input wire label (NOT gates and IDENTITY GATES)
             inLabel1 := garb.WireLabels[(*circ).Gates[gateID].InFrom[0]].WireLabelPair[secondLabelBit][:LABEL_LEN_BYTES-1] 
-            success, garb.GarbledGates[gateID].Table[gateLocs[i]] = encryptTableEntry(gateLocs[i], inLabel1, nil, outLabel)
+            success, garb.GarbledGates[gateID].Table[gateLocs[i]] = encryptTableEntry(garb.cipher(), tableTweak(gateID, gateLocs[i]), inLabel1, nil, outLabel)
             //fmt.Printf("Encrypting label to row %d\n. Inlabel1=%s, OutLabel=%s, ciph=%s", gateLocs[i], b64.StdEncoding.EncodeToString(inLabel1), b64.StdEncoding.EncodeToString(outLabel),
 //                b64.StdEncoding.EncodeToString(garb.GarbledGates[gateID].Table[gateLocs[i]]))
         } else if tableSize == 1 {
@@ -556,6 +503,7 @@ func (garb *SimpleGarbledCircuit) garbleGate(gateID int, circ *Circuit, rand *ra
                 index = 1
             }
             garb.GarbledGates[gateID].Table[gateLocs[i]] = Ciphertext_t(garb.WireLabels[gateID].WireLabelPair[index])
+            success = true
         }
     }
     //fmt.Printf("Success\n") 
@@ -576,69 +524,44 @@ func getLabelBits(tableRow int) (int, int) {
 }
 
 //
-// Encrypts a single table entry with one or two labels (keys)
-func encryptTableEntry(rowNum int, inLabel1 Label_t, inLabel2 Label_t, outLabel Label_t) (bool, Ciphertext_t) {
-    // Create a Blake2b hash instance, because why not?
-    h, err := blake2b.New(LABEL_LEN_BYTES, nil)
-    if err != nil {
-        return false, nil
-    }
-     
-    // Hash in the table row number || inLabel1 || inLabel2 (if non-nil)
-    bs := make([]byte, 1)
-    bs[0] = byte(rowNum)
-    h.Write(bs)
-    h.Write(inLabel1)
-    if inLabel2 != nil {
-        h.Write(inLabel2)
-    }
-    
+// Encrypts a single table entry with one or two labels (keys). The tweak is
+// unique to the gate and row, see tableTweak.
+func encryptTableEntry(gateCipher GateCipher, tweak uint64, inLabel1 Label_t, inLabel2 Label_t, outLabel Label_t) (bool, Ciphertext_t) {
     // Encrypt using the output of the hash:
-    //   C = [outLabel || (1 byte mask)] XOR hash
-    encryptedLabel := h.Sum(nil)
+    //   C = outLabel XOR H(inLabel1, inLabel2, tweak)
+    encryptedLabel := gateCipher.Hash(inLabel1, inLabel2, tweak)
     for i := 0; i < len(outLabel); i++ {
         encryptedLabel[i] ^= outLabel[i]
     }
     
-    return true, encryptedLabel
+    return true, Ciphertext_t(encryptedLabel)
 }
 
 //
 // Decrypts a single table entry with one or two labels (keys)
-// Outputs false if the flag is not valid
-func decryptTableEntry(rowNum int, inLabel1 Label_t, inLabel2 Label_t, ciphertext Ciphertext_t) []byte {
-    
-    // Create a Blake2b hash instance, because why not?
-    h, err := blake2b.New(LABEL_LEN_BYTES, nil)
-    if err != nil {
-        return nil
-    }
-    
-    // Hash in the table row number || inLabel1 || inLabel2 (if non-nil)
-    bs := make([]byte, 1)
-    bs[0] = byte(rowNum)
-    h.Write(bs)
-    h.Write(inLabel1)
-    if inLabel2 != nil {
-        h.Write(inLabel2)
-    }
-    
+func decryptTableEntry(gateCipher GateCipher, tweak uint64, inLabel1 Label_t, inLabel2 Label_t, ciphertext Ciphertext_t) []byte {
     // Decrypt using the output of the hash:
-    //   C = [outLabel] XOR hash
-    encryptedLabel := h.Sum(nil)
+    //   outLabel = C XOR H(inLabel1, inLabel2, tweak)
+    decryptedLabel := gateCipher.Hash(inLabel1, inLabel2, tweak)
     for i := 0; i < len(ciphertext); i++ {
-        encryptedLabel[i] ^= ciphertext[i]
+        decryptedLabel[i] ^= ciphertext[i]
     }
-     
-    return encryptedLabel
+    
+    return decryptedLabel
+}
+
+//
+// Rows of different gates never share a tweak
+func tableTweak(gateID int, rowNum int) uint64 {
+    return uint64(gateID) << 2 | uint64(rowNum)
 }
 
 //
 // Generates a permuted table ordering. Not highly optimized.
 func getGatePermutation(tableSize int, masks []int) ([4]int, bool) {
     result := [4]int{0,1,2,3}
-    // fall through because why not
-    if tableSize == 0 {
+    // fall through because why not, and a CONST gate's one row stays put
+    if tableSize == 0 || tableSize == 1 {
         return result, true
     }
     
@@ -673,13 +596,13 @@ func getGatePermutation(tableSize int, masks []int) ([4]int, bool) {
 // isStructured refers to how the label is constructed -- in the case of output
 // gates the label must have the last bit correspond to actual output in the 
 // case of our scheme being anonymous 
-func GenerateWireLabels(labelSet *SimpleWireLabelSet, freeXORDelta Label_t, rand *rand.Rand, isStructured bool) bool {
+func GenerateWireLabels(labelSet *SimpleWireLabelSet, freeXORDelta Label_t, random io.Reader, isStructured bool) bool {
     // Allocate both labels
     (*labelSet).WireLabelPair[0] = make([]byte, LABEL_LEN_BYTES-1)
     (*labelSet).WireLabelPair[1] = make([]byte, LABEL_LEN_BYTES-1)
     
     // Generate the first label at random
-    _, err := rand.Read((*labelSet).WireLabelPair[0])
+    _, err := io.ReadFull(random, (*labelSet).WireLabelPair[0])
     if (err != nil) {
         return false
     }
@@ -695,11 +618,11 @@ func GenerateWireLabels(labelSet *SimpleWireLabelSet, freeXORDelta Label_t, rand
     } else {
         rand0 := make([]byte, 1)
         rand1 := make([]byte, 1)
-        _, err = rand.Read(rand0)
+        _, err = io.ReadFull(random, rand0)
         if err != nil {
             return false
         }
-        _, err = rand.Read(rand1)
+        _, err = io.ReadFull(random, rand1)
         if err != nil {
             return false
         } 
@@ -710,15 +633,40 @@ func GenerateWireLabels(labelSet *SimpleWireLabelSet, freeXORDelta Label_t, rand
     return true
 }
 
-// this is decoding for a GC scheme where output is
-// NOT encrypted
-func DecodePlaintextOutputLabels(outLabels []Label_t) string {
+//
+// Output decoding bits, one per output wire, packed eight to a byte
+func packOutputDecoding(decoding []byte) []byte {
+    packed := make([]byte, (len(decoding) + 7) / 8)
+    for i, bit := range decoding {
+        packed[i/8] |= bit << uint(i % 8)
+    }
+    return packed
+}
+
+func unpackOutputDecoding(packed []byte, numOutputWires int) []byte {
+    decoding := make([]byte, numOutputWires)
+    for i := range decoding {
+        decoding[i] = (packed[i/8] >> uint(i % 8)) & 0x01
+    }
+    return decoding
+}
+
+//
+// Output labels to a binary string, most significant (last output wire) first:
+// each bit is the label's point and permute bit XOR its decoding bit
+func decodeOutputLabels(outLabels []Label_t, decoding []byte) (string, error) {
+    if len(outLabels) != len(decoding) {
+        return "", errors.New("wrong number of output labels")
+    }
     out := ""
-    for _, label := range outLabels {
-        actualOutput := int(label[len(label)-1]) & 1
+    for i, label := range outLabels {
+        if len(label) != LABEL_LEN_BYTES {
+            return "", errors.New("output label has the wrong length")
+        }
+        actualOutput := int((label[LABEL_LEN_BYTES-1] & 1) ^ decoding[i])
         out = strconv.Itoa(actualOutput) + out
     }
-    return out
+    return out, nil
 }
 
 //
@@ -744,7 +692,3 @@ func decodeResultLabels(resultLabels []Label_t, labelMappings []SimpleWireLabelS
     
     return result, true
 }
-
-func (garb *SimpleGarbledCircuit) getIsStructuredLabel(circ *Circuit, gateID int) bool {
-    return (*circ).Gates[gateID].GateType == GateOUTPUT
-}
@@ -0,0 +1,230 @@
+package toygarble
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "math/bits"
+    mathRand "math/rand"
+    "testing"
+)
+
+//
+// The circuits in test-circuits checked against Go. Values go in and come out
+// through PadInputsToBoolArray and DecodeOutputVariables, so every input and
+// output variable is a big endian byte string whose last bit is wire 0.
+//
+
+func uint64Bytes(v uint64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, v)
+    return b
+}
+
+func mustHex(tb testing.TB, s string) []byte {
+    tb.Helper()
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    return b
+}
+
+// Evaluate circ in the clear on inputs, one byte string per input variable
+func evaluateVariables(tb testing.TB, circ *Circuit, inputs ...[]byte) [][]byte {
+    tb.Helper()
+    bits := circ.PadInputsToBoolArray(inputs)
+    if bits == nil {
+        tb.Fatalf("inputs don't fit the circuit")
+    }
+    ok, out := circ.EvaluateCircuit(bits)
+    if !ok {
+        tb.Fatalf("could not evaluate")
+    }
+    return circ.DecodeOutputVariables(out)
+}
+
+// Random 64 bit values along with the ones carries and signs go wrong on
+func testValues(r *mathRand.Rand, n int) []uint64 {
+    values := []uint64{0, 1, 2, 1 << 63, 1<<63 - 1, ^uint64(0), ^uint64(0) - 1}
+    for len(values) < n {
+        values = append(values, r.Uint64())
+    }
+    return values
+}
+
+func TestArithmeticCircuits(t *testing.T) {
+    ops := []struct {
+        file    string
+        f       func(a, b uint64) (uint64, bool)
+    }{
+        {"adder64.txt", func(a, b uint64) (uint64, bool) { return a + b, true }},
+        {"sub64.txt", func(a, b uint64) (uint64, bool) { return a - b, true }},
+        {"mult64.txt", func(a, b uint64) (uint64, bool) { return a * b, true }},
+        // signed, rounding towards zero like Go's /
+        {"divide64.txt", func(a, b uint64) (uint64, bool) {
+            if b == 0 || (int64(a) == -1 << 63 && int64(b) == -1) {
+                return 0, false
+            }
+            return uint64(int64(a) / int64(b)), true
+        }},
+    }
+    r := mathRand.New(mathRand.NewSource(1))
+    values := testValues(r, 16)
+    for _, c := range ops {
+        circ := parseTestCircuit(t, c.file)
+        for _, a := range values {
+            for _, b := range values {
+                want, ok := c.f(a, b)
+                if !ok {
+                    continue
+                }
+                out := evaluateVariables(t, circ, uint64Bytes(a), uint64Bytes(b))
+                if got := binary.BigEndian.Uint64(out[0]); got != want {
+                    t.Errorf("%s(%#x, %#x) = %#x, want %#x", c.file, a, b, got, want)
+                }
+            }
+        }
+    }
+
+    // the full 128 bit product, high word first
+    mult2 := parseTestCircuit(t, "mult2_64.txt")
+    for _, a := range values {
+        for _, b := range values {
+            hi, lo := bits.Mul64(a, b)
+            out := evaluateVariables(t, mult2, uint64Bytes(a), uint64Bytes(b))
+            if binary.BigEndian.Uint64(out[0]) != hi || binary.BigEndian.Uint64(out[1]) != lo {
+                t.Errorf("mult2_64.txt(%#x, %#x) = %x, want %#x %#x", a, b, out, hi, lo)
+            }
+        }
+    }
+
+    neg := parseTestCircuit(t, "neg64.txt")
+    zero := parseTestCircuit(t, "zero_equal.txt")
+    for _, a := range values {
+        if got := binary.BigEndian.Uint64(evaluateVariables(t, neg, uint64Bytes(a))[0]); got != -a {
+            t.Errorf("neg64.txt(%#x) = %#x, want %#x", a, got, -a)
+        }
+        isZero := evaluateVariables(t, zero, uint64Bytes(a))[0][0] == 1
+        if isZero != (a == 0) {
+            t.Errorf("zero_equal.txt(%#x) = %t", a, isZero)
+        }
+    }
+}
+
+// FIPS-197 appendix C
+func TestAESCircuits(t *testing.T) {
+    vectors := []struct {
+        file    string
+        key     string
+        out     string
+    }{
+        {"aes_128.txt", "000102030405060708090a0b0c0d0e0f", "69c4e0d86a7b0430d8cdb78070b4c55a"},
+        {"aes_192.txt", "000102030405060708090a0b0c0d0e0f1011121314151617", "dda97ca4864cdfe06eaf70a0ec0d7191"},
+        {"aes_256.txt", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "8ea2b7ca516745bfeafc49904b496089"},
+    }
+    plaintext := mustHex(t, "00112233445566778899aabbccddeeff")
+    for _, v := range vectors {
+        circ := parseTestCircuit(t, v.file)
+        out := evaluateVariables(t, circ, mustHex(t, v.key), plaintext)
+        if !bytes.Equal(out[0], mustHex(t, v.out)) {
+            t.Errorf("%s: got %x, want %s", v.file, out[0], v.out)
+        }
+    }
+}
+
+// The circuit is the compression function, on a block and a chaining state
+func TestSHA256Circuit(t *testing.T) {
+    circ := parseTestCircuit(t, "sha256.txt")
+    iv := mustHex(t, "6a09e667bb67ae853c6ef372a54ff53a510e527f9b05688c1f83d9ab5be0cd19")
+
+    // messages that pad out to a single block
+    r := mathRand.New(mathRand.NewSource(1))
+    for _, n := range []int{0, 3, 55} {
+        msg := make([]byte, n)
+        r.Read(msg)
+        block := make([]byte, 64)
+        copy(block, msg)
+        block[n] = 0x80
+        binary.BigEndian.PutUint64(block[56:], uint64(8*n))
+
+        want := sha256.Sum256(msg)
+        if got := evaluateVariables(t, circ, block, iv)[0]; !bytes.Equal(got, want[:]) {
+            t.Errorf("SHA-256 of %d bytes: got %x, want %x", n, got, want)
+        }
+    }
+}
+
+// Garbling doesn't change what any of them compute
+func TestGarbledTestCircuits(t *testing.T) {
+    files := []string{"adder64.txt", "sub64.txt", "neg64.txt", "mult64.txt", "mult2_64.txt", "divide64.txt", "zero_equal.txt", "aes_128.txt", "aes_192.txt", "aes_256.txt", "sha256.txt"}
+    for _, file := range files {
+        circ := parseTestCircuit(t, file)
+        for _, scheme := range []GarblingScheme{GarblingSimple, GarblingHalfGates} {
+            checkGarbledMatches(t, file, circ, scheme)
+        }
+    }
+}
+
+//
+// Garble circ with scheme, evaluate it on random inputs and check the output
+// is what it computes in the clear
+func checkGarbledMatches(t *testing.T, name string, circ *Circuit, scheme GarblingScheme) {
+    t.Helper()
+    garbler, _ := NewGarbledCircuit(scheme, CipherFixedKeyAES)
+    if !garbler.GarbleCircuit(circ, rand.Reader) {
+        t.Fatalf("%s, %v: could not garble", name, scheme)
+    }
+    inputs := make([]bool, circ.NumInputWires)
+    inputLabels := make([]Label_t, circ.NumInputWires)
+    for i, labels := range garbler.GetInputWireLabels() {
+        inputs[i] = mathRand.Intn(2) == 1
+        if inputs[i] {
+            inputLabels[i] = labels.WireLabelPair[1]
+        } else {
+            inputLabels[i] = labels.WireLabelPair[0]
+        }
+    }
+
+    evaluator, _ := NewGarbledCircuit(scheme, CipherFixedKeyAES)
+    if err := evaluator.PackedUnmarshal(garbler.PackedMarshal(), circ); err != nil {
+        t.Fatalf("%s, %v: %v", name, scheme, err)
+    }
+    ok, outLabels := evaluator.EvaluateCircuit(circ, inputLabels)
+    if !ok {
+        t.Fatalf("%s, %v: could not evaluate", name, scheme)
+    }
+    got, err := evaluator.DecodeOutputLabels(outLabels)
+    if err != nil {
+        t.Fatalf("%s, %v: %v", name, scheme, err)
+    }
+
+    _, outputs := circ.EvaluateCircuit(inputs)
+    want := make([]byte, len(outputs))
+    for i, bit := range outputs {
+        want[len(want)-1-i] = '0'
+        if bit {
+            want[len(want)-1-i] = '1'
+        }
+    }
+    if got != string(want) {
+        t.Errorf("%s, %v: garbled and plaintext outputs differ", name, scheme)
+    }
+}
+
+// Outputs straight from CONST gates, whose tables have a single row
+func TestGarbledConstants(t *testing.T) {
+    circ := new(Circuit)
+    circ.initializeCircuit(2, 3, 1, 1, []int{2}, []int{3})
+    circ.connectOutputWire(circ.addGate2(GateAND, 0, 1), 0)
+    circ.connectOutputWire(circ.addGate(GateCONST, true, nil), 1)
+    circ.connectOutputWire(circ.addGate(GateCONST, false, nil), 2)
+    if !circ.validCircuit() || !circ.finalize() {
+        t.Fatal("invalid circuit")
+    }
+    for _, scheme := range []GarblingScheme{GarblingSimple, GarblingHalfGates} {
+        checkGarbledMatches(t, "constants", circ, scheme)
+    }
+}